@@ -0,0 +1,50 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/greut/iiif/iiif"
+)
+
+// convert writes the tiled pyramids of the images, see iiif.Convert.
+//
+//	iiif convert [-config config.toml] [-force] [-workers n] [path ...]
+func convert(args []string) {
+	flags := flag.NewFlagSet("convert", flag.ExitOnError)
+	configFile := flags.String("config", "config.toml", "Define the configuration file to use.")
+	force := flags.Bool("force", false, "Convert the images even when the derivatives are up to date.")
+	workers := flags.Int("workers", 0, "Number of images converted in parallel (the number of CPUs by default).")
+	flags.Parse(args)
+
+	config, err := readConfig(*configFile)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if *workers > 0 {
+		config.Derivatives.Workers = *workers
+	}
+
+	failed := 0
+	err = iiif.Convert(config, flags.Args(), *force, func(done, total int, result iiif.ConvertResult) {
+		status := fmt.Sprintf("converted in %v", result.Duration)
+		if result.Err != nil {
+			failed++
+			status = fmt.Sprintf("failed (%v)", result.Err)
+		} else if result.Skipped {
+			status = "skipped"
+		}
+		log.Println(fmt.Sprintf("[%d/%d] %s %s", done, total, result.Source, status))
+	})
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if failed > 0 {
+		log.Println(fmt.Sprintf("%d image(s) couldn't be converted", failed))
+		os.Exit(1)
+	}
+}
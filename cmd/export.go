@@ -0,0 +1,64 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/greut/iiif/iiif"
+)
+
+// export writes the static Level 0 images, see iiif.Export.
+//
+//	iiif export [-config config.toml] [-base url] [-output dir] [-tile n] [-format jpg] identifier ...
+func export(args []string) {
+	flags := flag.NewFlagSet("export", flag.ExitOnError)
+	configFile := flags.String("config", "config.toml", "Define the configuration file to use.")
+	base := flags.String("base", "", "Base URL of the identifiers, e.g. https://example.org/iiif.")
+	output := flags.String("output", "", "Directory where the files are written.")
+	tileSize := flags.Int("tile", 0, "Width and height of the tiles.")
+	format := flags.String("format", "", "Format of the images.")
+	flags.Parse(args)
+
+	config, err := readConfig(*configFile)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if *base != "" {
+		config.Export.BaseURL = *base
+	}
+	if *output != "" {
+		config.Export.Output = *output
+	}
+	if *tileSize > 0 {
+		config.Export.TileSize = *tileSize
+	}
+	if *format != "" {
+		config.Export.Format = *format
+	}
+
+	if flags.NArg() == 0 {
+		fmt.Println("No identifiers were given.")
+		os.Exit(1)
+	}
+
+	failed := 0
+	err = iiif.Export(config, flags.Args(), func(identifier string, files int, err error) {
+		if err != nil {
+			failed++
+			log.Println(fmt.Sprintf("%s failed (%v)", identifier, err))
+			return
+		}
+		log.Println(fmt.Sprintf("%s exported %d file(s)", identifier, files))
+	})
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if failed > 0 {
+		log.Println(fmt.Sprintf("%d identifier(s) couldn't be exported", failed))
+		os.Exit(1)
+	}
+}
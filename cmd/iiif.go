@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"os"
 
 	"code.cloudfoundry.org/bytefmt"
 	"github.com/BurntSushi/toml"
@@ -12,6 +13,17 @@ import (
 )
 
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "convert":
+			convert(os.Args[2:])
+			return
+		case "export":
+			export(os.Args[2:])
+			return
+		}
+	}
+
 	// Configuration
 	var configFile = flag.String("config", "config.toml", "Define the configuration file to use.")
 	flag.Parse()
@@ -20,32 +32,58 @@ func main() {
 		*configFile = flag.Arg(0)
 	}
 
-	var config iiif.Config
-	log.Println(fmt.Sprintf("Reading configuration from %s", *configFile))
-	if _, err := toml.DecodeFile(*configFile, &config); err != nil {
+	config, err := readConfig(*configFile)
+	if err != nil {
 		fmt.Println(err)
 		return
 	}
 
-	iS, _ := bytefmt.ToBytes(config.Cache.Images)
-	tS, _ := bytefmt.ToBytes(config.Cache.Thumbnails)
-	config.Cache.ImagesSize = int64(iS)
-	config.Cache.ThumbnailsSize = int64(tS)
+	// Watcher of the images, versioning the caches.
+	if config.Watch.Enabled {
+		config.Watcher = iiif.NewWatcher(config)
+		go config.Watcher.Watch(nil)
+	}
 
 	// build router with root directory.
-	handler := iiif.WithConfig(iiif.MakeRouter(), &config)
+	handler := iiif.WithConfig(iiif.MakeRouter(), config)
 	// add group cache middleware if the cache size is greater than zero.
 	if config.Cache.ImagesSize > 0 && config.Cache.ThumbnailsSize > 0 {
 		handler = iiif.SetGroupCache(
 			handler,
-			&config,
+			config,
 			fmt.Sprintf("http://%s/", config.Host), // TODO add any other servers here...
 		)
 	}
 
+	// Change Discovery feed, if any.
+	if config.Discovery.Log != "" {
+		discovery, err := iiif.NewDiscovery(config)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		go discovery.Watch(nil)
+		handler = iiif.WithDiscovery(handler, discovery)
+	}
+
 	// Serving
 	listen := fmt.Sprintf("%v:%v", config.Host, config.Port)
 
 	log.Println(fmt.Sprintf("Server running on %v", listen))
 	panic(http.ListenAndServe(listen, handler))
 }
+
+func readConfig(configFile string) (*iiif.Config, error) {
+	var config iiif.Config
+	log.Println(fmt.Sprintf("Reading configuration from %s", configFile))
+	if _, err := toml.DecodeFile(configFile, &config); err != nil {
+		return nil, err
+	}
+
+	iS, _ := bytefmt.ToBytes(config.Cache.Images)
+	tS, _ := bytefmt.ToBytes(config.Cache.Thumbnails)
+	config.Cache.ImagesSize = int64(iS)
+	config.Cache.ThumbnailsSize = int64(tS)
+
+	return &config, nil
+}
@@ -0,0 +1,245 @@
+package iiif
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/png"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"gopkg.in/h2non/bimg.v1"
+)
+
+// error messages
+var adjustError = "The adjustment `%s` is not recognized: %#v"
+var adjustRangeError = "The adjustment `%s` is out of the limits %v-%v: %v"
+
+// adjustQuality is the quality applying the enhanced adjustments of the
+// configuration.
+const adjustQuality = "enhanced"
+
+// adjustURI is the base of the features of the adjustments, as advertised in
+// the profile.
+const adjustURI = "https://github.com/greut/iiif/extensions/adjust#"
+
+// adjustParams are the query parameters adjusting the images, and their
+// limits.
+var adjustParams = []struct {
+	Name     string
+	Min, Max float64
+}{
+	{"autolevels", 0, 1},
+	{"blur", 0.1, 50},
+	{"brightness", -100, 100},
+	{"contrast", -100, 100},
+	{"gamma", 0.1, 10},
+	{"sharpen", 1, 10},
+}
+
+// adjustments are the parsed adjustments, the zero values changing nothing.
+type adjustments struct {
+	AutoLevels bool
+	Blur       float64
+	Brightness float64
+	Contrast   float64
+	Gamma      float64
+	Sharpen    int
+}
+
+// canonicalAdjustments keeps only the known adjustments of the query string,
+// completed by the ones of the enhanced quality. The result is sorted by key
+// so it can be part of the cache key.
+func canonicalAdjustments(query url.Values, quality string, config *Config) string {
+	if !config.Adjustments.Enabled {
+		return ""
+	}
+
+	values := url.Values{}
+	if quality == adjustQuality {
+		enhanced, _ := url.ParseQuery(config.Adjustments.Enhanced)
+		for _, p := range adjustParams {
+			if v := enhanced.Get(p.Name); v != "" {
+				values.Set(p.Name, v)
+			}
+		}
+	}
+	for _, p := range adjustParams {
+		if v := query.Get(p.Name); v != "" {
+			values.Set(p.Name, v)
+		}
+	}
+	return values.Encode()
+}
+
+// canonicalQuery gives the query string of the cache key, made of the
+// canonical encoding and adjustments.
+func canonicalQuery(vars map[string]string) string {
+	var parts []string
+	for _, k := range []string{"encoding", "adjust"} {
+		if vars[k] != "" {
+			parts = append(parts, vars[k])
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// parseAdjustments reads the canonical adjustments (see canonicalAdjustments).
+func parseAdjustments(adjust string) (*adjustments, error) {
+	query, err := url.ParseQuery(adjust)
+	if err != nil {
+		message := fmt.Sprintf(adjustError, "query", adjust)
+		return nil, ParameterError{HTTPError{http.StatusBadRequest, message}, "query"}
+	}
+
+	a := &adjustments{}
+	for _, p := range adjustParams {
+		v := query.Get(p.Name)
+		if v == "" {
+			continue
+		}
+
+		var n float64
+		if p.Name == "autolevels" {
+			var b bool
+			b, err = strconv.ParseBool(v)
+			if b {
+				n = 1
+			}
+		} else {
+			n, err = strconv.ParseFloat(v, 64)
+		}
+		if err != nil {
+			message := fmt.Sprintf(adjustError, p.Name, v)
+			return nil, ParameterError{HTTPError{http.StatusBadRequest, message}, p.Name}
+		}
+		if n < p.Min || n > p.Max {
+			message := fmt.Sprintf(adjustRangeError, p.Name, p.Min, p.Max, v)
+			return nil, ParameterError{HTTPError{http.StatusBadRequest, message}, p.Name}
+		}
+
+		switch p.Name {
+		case "autolevels":
+			a.AutoLevels = n == 1
+		case "blur":
+			a.Blur = n
+		case "brightness":
+			a.Brightness = n
+		case "contrast":
+			a.Contrast = n
+		case "gamma":
+			a.Gamma = n
+		case "sharpen":
+			a.Sharpen = int(n)
+		}
+	}
+	return a, nil
+}
+
+// handleAdjustments applies the adjustments to the output. The levels
+// (auto-levels, brightness and contrast) aren't known to libvips, they're
+// changed on the pixels before the filters of bimg are applied. The options
+// are the ones of the encoding.
+func handleAdjustments(img *bimg.Image, adjust string, options bimg.Options) error {
+	if adjust == "" {
+		return nil
+	}
+	a, err := parseAdjustments(adjust)
+	if err != nil {
+		return err
+	}
+
+	if a.AutoLevels || a.Brightness != 0 || a.Contrast != 0 {
+		buffer, err := img.Process(bimg.Options{Type: bimg.PNG, NoAutoRotate: true})
+		if err != nil {
+			return err
+		}
+		buffer, err = adjustLevels(buffer, a)
+		if err != nil {
+			return err
+		}
+		*img = *bimg.NewImage(buffer)
+	}
+
+	if a.Sharpen > 0 {
+		options.Sharpen = bimg.Sharpen{Radius: a.Sharpen, X1: 2, Y2: 10, Y3: 20, M1: 0, M2: 3}
+	}
+	if a.Blur > 0 {
+		options.GaussianBlur = bimg.GaussianBlur{Sigma: a.Blur, MinAmpl: 0.2}
+	}
+	options.Gamma = a.Gamma
+
+	_, err = img.Process(options)
+	return err
+}
+
+// adjustLevels stretches the levels of the PNG image to its full range (for
+// auto-levels), then changes its brightness and contrast (in percents). The
+// alpha channel is kept as is.
+func adjustLevels(buffer []byte, a *adjustments) ([]byte, error) {
+	src, err := png.Decode(bytes.NewReader(buffer))
+	if err != nil {
+		return nil, err
+	}
+	img := image.NewNRGBA(src.Bounds())
+	draw.Draw(img, img.Bounds(), src, src.Bounds().Min, draw.Src)
+
+	// out = in * scale + offset
+	scale, offset := 1., 0.
+	if a.AutoLevels {
+		low, high := uint8(255), uint8(0)
+		for i := 0; i < len(img.Pix); i += 4 {
+			if img.Pix[i+3] == 0 {
+				continue
+			}
+			for _, v := range img.Pix[i : i+3] {
+				if v < low {
+					low = v
+				}
+				if v > high {
+					high = v
+				}
+			}
+		}
+		if high > low {
+			scale = 255 / float64(high-low)
+			offset = -float64(low) * scale
+		}
+	}
+	contrast := 1 + a.Contrast/100
+	scale *= contrast
+	offset = (offset-127.5)*contrast + 127.5 + a.Brightness*2.55
+
+	var table [256]uint8
+	for v := range table {
+		table[v] = uint8(math.Max(0, math.Min(255, math.Round(float64(v)*scale+offset))))
+	}
+	for i := 0; i < len(img.Pix); i += 4 {
+		img.Pix[i] = table[img.Pix[i]]
+		img.Pix[i+1] = table[img.Pix[i+1]]
+		img.Pix[i+2] = table[img.Pix[i+2]]
+	}
+
+	var output bytes.Buffer
+	if err = png.Encode(&output, img); err != nil {
+		return nil, err
+	}
+	return output.Bytes(), nil
+}
+
+// adjustSupports gives the features of the enabled adjustments, for the
+// profile.
+func adjustSupports(config *Config) []string {
+	if !config.Adjustments.Enabled {
+		return nil
+	}
+	supports := make([]string, len(adjustParams))
+	for i, p := range adjustParams {
+		supports[i] = adjustURI + p.Name
+	}
+	return supports
+}
@@ -0,0 +1,152 @@
+package iiif
+
+import (
+	"bytes"
+	"encoding/json"
+	"image"
+	"image/color"
+	"image/png"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestCanonicalAdjustments(t *testing.T) {
+	config := &Config{
+		Adjustments: AdjustmentsConfig{
+			Enabled:  true,
+			Enhanced: "autolevels=true&sharpen=1",
+		},
+	}
+
+	var tests = []struct {
+		query   string
+		quality string
+		adjust  string
+	}{
+		{"", "default", ""},
+		{"dl&q=80", "default", ""},
+		{"sharpen=2&gamma=1.5", "default", "gamma=1.5&sharpen=2"},
+		{"", "enhanced", "autolevels=true&sharpen=1"},
+		{"sharpen=3&contrast=10", "enhanced", "autolevels=true&contrast=10&sharpen=3"},
+	}
+
+	for _, test := range tests {
+		query, _ := url.ParseQuery(test.query)
+		if adjust := canonicalAdjustments(query, test.quality, config); adjust != test.adjust {
+			t.Errorf("%s (%s): got %#v want %#v", test.query, test.quality, adjust, test.adjust)
+		}
+	}
+
+	query, _ := url.ParseQuery("sharpen=2")
+	if adjust := canonicalAdjustments(query, "enhanced", &Config{}); adjust != "" {
+		t.Errorf("disabled: got %#v", adjust)
+	}
+}
+
+func TestParseAdjustments(t *testing.T) {
+	var tests = []struct {
+		adjust    string
+		parameter string
+	}{
+		{"", ""},
+		{"autolevels=true&blur=0.5&brightness=-20&contrast=30&gamma=2.2&sharpen=3", ""},
+		{"autolevels=maybe", "autolevels"},
+		{"blur=0", "blur"},
+		{"brightness=200", "brightness"},
+		{"gamma=abc", "gamma"},
+		{"sharpen=11", "sharpen"},
+	}
+
+	for _, test := range tests {
+		_, err := parseAdjustments(test.adjust)
+		parameter := ""
+		if e, ok := err.(ParameterError); ok {
+			parameter = e.Parameter
+		} else if err != nil {
+			t.Errorf("%s: unexpected error %s", test.adjust, err)
+		}
+		if parameter != test.parameter {
+			t.Errorf("%s: got %#v want %#v", test.adjust, parameter, test.parameter)
+		}
+	}
+}
+
+func TestAdjustLevels(t *testing.T) {
+	src := image.NewNRGBA(image.Rect(0, 0, 2, 1))
+	src.Set(0, 0, color.NRGBA{100, 100, 100, 255})
+	src.Set(1, 0, color.NRGBA{150, 150, 150, 128})
+
+	var buffer bytes.Buffer
+	if err := png.Encode(&buffer, src); err != nil {
+		log.Fatal(err)
+	}
+
+	var tests = []struct {
+		adjustments adjustments
+		low, high   uint8
+	}{
+		{adjustments{}, 100, 150},
+		{adjustments{AutoLevels: true}, 0, 255},
+		{adjustments{Brightness: 10}, 126, 176},
+		{adjustments{Contrast: -100}, 128, 128},
+	}
+
+	for _, test := range tests {
+		output, err := adjustLevels(buffer.Bytes(), &test.adjustments)
+		if err != nil {
+			t.Fatal(err)
+		}
+		img, err := png.Decode(bytes.NewReader(output))
+		if err != nil {
+			t.Fatal(err)
+		}
+		low := color.NRGBAModel.Convert(img.At(0, 0)).(color.NRGBA)
+		high := color.NRGBAModel.Convert(img.At(1, 0)).(color.NRGBA)
+		if low.R != test.low || high.G != test.high {
+			t.Errorf("%#v: got %d-%d want %d-%d", test.adjustments, low.R, high.G, test.low, test.high)
+		}
+		if high.A != 128 {
+			t.Errorf("%#v: the alpha changed to %d", test.adjustments, high.A)
+		}
+	}
+}
+
+func TestAdjustments(t *testing.T) {
+	ts := newServerWithConfig(&Config{
+		Adjustments: AdjustmentsConfig{Enabled: true},
+	})
+	defer ts.Close()
+
+	res, err := http.Get(ts.URL + "/lena.jpg/info.json")
+	if err != nil {
+		log.Fatal(err)
+	}
+	var info struct {
+		Profile []json.RawMessage `json:"profile"`
+	}
+	err = json.NewDecoder(res.Body).Decode(&info)
+	res.Body.Close()
+	if err != nil || len(info.Profile) != 2 {
+		t.Fatalf("Cannot read the profile: %v", err)
+	}
+	var profile ImageProfile
+	if err = json.Unmarshal(info.Profile[1], &profile); err != nil {
+		t.Fatal(err)
+	}
+	qualities, supports := strings.Join(profile.Qualities, " "), strings.Join(profile.Supports, " ")
+	if !strings.Contains(qualities, adjustQuality) || !strings.Contains(supports, adjustURI+"sharpen") {
+		t.Errorf("The adjustments aren't advertised: %v %v", profile.Qualities, profile.Supports)
+	}
+
+	res, err = http.Get(ts.URL + "/lena.jpg/full/max/0/default.jpg?sharpen=99")
+	if err != nil {
+		log.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusBadRequest {
+		t.Errorf("sharpen=99: got %d want %d", res.StatusCode, http.StatusBadRequest)
+	}
+}
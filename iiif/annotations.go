@@ -0,0 +1,579 @@
+package iiif
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang/groupcache"
+	"github.com/gorilla/mux"
+)
+
+// error messages
+var annotationInvalidError = "Invalid annotation: %s"
+var annotationRegionError = "The region %#v is not within the image"
+var annotationPageError = "The page %#v doesn't exist"
+var annotationMatchError = "The If-Match header is required"
+
+// the contexts and media type of the Web Annotation Protocol.
+const (
+	annotationContext   = "http://www.w3.org/ns/anno.jsonld"
+	ldpContext          = "http://www.w3.org/ns/ldp.jsonld"
+	annotationMediaType = `application/ld+json; profile="http://www.w3.org/ns/anno.jsonld"`
+)
+
+// maxAnnotationSize is the largest annotation accepted.
+const maxAnnotationSize = 1 << 20
+
+// annotationSlug are the identifiers proposed by the clients that are kept.
+var annotationSlug = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+// AnnotationContainer is the collection of the annotations of an image, see
+// https://www.w3.org/TR/annotation-protocol/
+type AnnotationContainer struct {
+	Context  []string                  `json:"@context"`
+	ID       string                    `json:"id"`
+	Type     []string                  `json:"type"`
+	Label    string                    `json:"label,omitempty"`
+	Total    int                       `json:"total"`
+	Modified string                    `json:"modified,omitempty"`
+	First    *AnnotationCollectionPage `json:"first,omitempty"`
+	Last     string                    `json:"last,omitempty"`
+}
+
+// AnnotationCollectionPage is a page of the annotations of an image.
+type AnnotationCollectionPage struct {
+	Context    string                   `json:"@context,omitempty"`
+	ID         string                   `json:"id"`
+	Type       string                   `json:"type"`
+	PartOf     *AnnotationCollectionRef `json:"partOf,omitempty"`
+	StartIndex int                      `json:"startIndex"`
+	Prev       string                   `json:"prev,omitempty"`
+	Next       string                   `json:"next,omitempty"`
+	Items      []interface{}            `json:"items"`
+}
+
+// AnnotationCollectionRef points at the container of a page.
+type AnnotationCollectionRef struct {
+	ID    string `json:"id"`
+	Total int    `json:"total"`
+}
+
+// AnnotationContainerHandler lists (GET) or creates (POST) the annotations of
+// the image.
+func AnnotationContainerHandler(w http.ResponseWriter, r *http.Request) {
+	identifier, config, store, ok := annotationRequest(w, r)
+	if !ok {
+		return
+	}
+
+	header := w.Header()
+	if config.Annotations.Writable {
+		header.Set("Allow", "GET, HEAD, OPTIONS, POST")
+		header.Set("Accept-Post", annotationMediaType)
+	} else {
+		header.Set("Allow", "GET, HEAD, OPTIONS")
+	}
+	header.Add("Link", `<http://www.w3.org/ns/ldp#BasicContainer>; rel="type"`)
+	header.Add("Link", `<http://www.w3.org/TR/annotation-protocol/>; rel="http://www.w3.org/ns/ldp#constrainedBy"`)
+	header.Set("Vary", "Accept, Prefer")
+
+	container := fmt.Sprintf("%s/%s/annotations/", baseURL(r), identifier)
+
+	switch r.Method {
+	case http.MethodOptions:
+		return
+	case http.MethodPost:
+		if !annotationWritable(w, r, config) {
+			return
+		}
+		images, _ := r.Context().Value(ContextKey("images")).(*groupcache.Group)
+		body, err := readAnnotation(w, r, identifier, config, images)
+		if err != nil {
+			annotationStoreError(w, r, err)
+			return
+		}
+
+		id := r.Header.Get("Slug")
+		if !annotationSlug.MatchString(id) {
+			id = newAnnotationID()
+		}
+
+		now := time.Now().UTC()
+		annotation := &StoredAnnotation{
+			ID:       id,
+			Body:     body,
+			Created:  now,
+			Modified: now,
+		}
+		if err = store.Create(identifier, annotation); err != nil {
+			annotationStoreError(w, r, err)
+			return
+		}
+
+		header.Set("Location", container+id)
+		serveAnnotation(w, r, annotation, container, http.StatusCreated)
+		return
+	case http.MethodGet, http.MethodHead:
+		header.Set("Access-Control-Allow-Origin", "*")
+	default:
+		serveError(w, r, HTTPError{http.StatusMethodNotAllowed, http.StatusText(http.StatusMethodNotAllowed)})
+		return
+	}
+
+	annotations, err := store.List(identifier)
+	if err != nil {
+		annotationStoreError(w, r, err)
+		return
+	}
+
+	pageSize := config.Annotations.PageSize
+	if pageSize <= 0 {
+		pageSize = defaultPageSize
+	}
+	pages := (len(annotations) + pageSize - 1) / pageSize
+	iris := strings.Contains(r.Header.Get("Prefer"), "http://www.w3.org/ns/oa#PreferContainedIRIs")
+
+	var modTime time.Time
+	var etags bytes.Buffer
+	for _, a := range annotations {
+		if a.Modified.After(modTime) {
+			modTime = a.Modified
+		}
+		etags.WriteString(a.ETag())
+	}
+
+	var p interface{}
+	if s := r.URL.Query().Get("page"); s != "" {
+		page, err := strconv.Atoi(s)
+		if err != nil || page < 0 || page >= pages {
+			serveError(w, r, HTTPError{http.StatusNotFound, fmt.Sprintf(annotationPageError, s)})
+			return
+		}
+		collectionPage := annotationPage(annotations, container, page, pageSize, iris)
+		collectionPage.Context = annotationContext
+		p = collectionPage
+	} else {
+		c := &AnnotationContainer{
+			Context: []string{annotationContext, ldpContext},
+			ID:      container,
+			Type:    []string{"BasicContainer", "AnnotationCollection"},
+			Label:   identifier,
+			Total:   len(annotations),
+		}
+		if pages > 0 {
+			c.Modified = modTime.Format(time.RFC3339)
+			c.First = annotationPage(annotations, container, 0, pageSize, iris)
+			c.Last = fmt.Sprintf("%s?page=%d", container, pages-1)
+		}
+		p = c
+	}
+
+	buffer, err := json.MarshalIndent(p, "", "  ")
+	if err != nil {
+		serveError(w, r, HTTPError{http.StatusInternalServerError, "Cannot create the annotation container"})
+		return
+	}
+
+	header.Set("Content-Type", annotationMediaType)
+	header.Set("ETag", getETag(fmt.Sprintf("%v%v%s", r.URL, iris, etags.String())))
+	http.ServeContent(w, r, "annotations.json", modTime, bytes.NewReader(buffer))
+}
+
+// AnnotationHandler reads (GET), replaces (PUT) or deletes (DELETE) an
+// annotation of the image. The changes require the If-Match header.
+func AnnotationHandler(w http.ResponseWriter, r *http.Request) {
+	identifier, config, store, ok := annotationRequest(w, r)
+	if !ok {
+		return
+	}
+
+	id := mux.Vars(r)["id"]
+
+	header := w.Header()
+	if config.Annotations.Writable {
+		header.Set("Allow", "GET, HEAD, OPTIONS, PUT, DELETE")
+	} else {
+		header.Set("Allow", "GET, HEAD, OPTIONS")
+	}
+	header.Add("Link", `<http://www.w3.org/ns/ldp#Resource>; rel="type"`)
+
+	container := fmt.Sprintf("%s/%s/annotations/", baseURL(r), identifier)
+
+	switch r.Method {
+	case http.MethodOptions:
+		return
+	case http.MethodGet, http.MethodHead:
+		header.Set("Access-Control-Allow-Origin", "*")
+		annotation, err := store.Get(identifier, id)
+		if err != nil {
+			annotationStoreError(w, r, err)
+			return
+		}
+		serveAnnotation(w, r, annotation, container, http.StatusOK)
+	case http.MethodPut:
+		if !annotationWritable(w, r, config) {
+			return
+		}
+		etag := r.Header.Get("If-Match")
+		if etag == "" {
+			serveError(w, r, HTTPError{http.StatusPreconditionRequired, annotationMatchError})
+			return
+		}
+
+		images, _ := r.Context().Value(ContextKey("images")).(*groupcache.Group)
+		body, err := readAnnotation(w, r, identifier, config, images)
+		if err != nil {
+			annotationStoreError(w, r, err)
+			return
+		}
+
+		annotation := &StoredAnnotation{
+			ID:       id,
+			Body:     body,
+			Modified: time.Now().UTC(),
+		}
+		if err = store.Update(identifier, annotation, etag); err != nil {
+			annotationStoreError(w, r, err)
+			return
+		}
+		serveAnnotation(w, r, annotation, container, http.StatusOK)
+	case http.MethodDelete:
+		if !annotationWritable(w, r, config) {
+			return
+		}
+		etag := r.Header.Get("If-Match")
+		if etag == "" {
+			serveError(w, r, HTTPError{http.StatusPreconditionRequired, annotationMatchError})
+			return
+		}
+
+		if err := store.Delete(identifier, id, etag); err != nil {
+			annotationStoreError(w, r, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		serveError(w, r, HTTPError{http.StatusMethodNotAllowed, http.StatusText(http.StatusMethodNotAllowed)})
+	}
+}
+
+// annotationRequest gives the identifier, configuration and store of the
+// request, responding with a 404 when the annotations are not enabled.
+func annotationRequest(w http.ResponseWriter, r *http.Request) (string, *Config, AnnotationStore, bool) {
+	identifier, err := url.QueryUnescape(mux.Vars(r)["identifier"])
+	if err != nil {
+		log.Printf("Filename is frob %#v", identifier)
+		serveError(w, r, HTTPError{http.StatusNotFound, identifier})
+		return "", nil, nil, false
+	}
+	identifier = strings.Replace(identifier, "../", "", -1)
+
+	config, _ := r.Context().Value(ContextKey("config")).(*Config)
+	store := annotationStore(r.Context(), config)
+	if store == nil {
+		serveError(w, r, HTTPError{http.StatusNotFound, identifier})
+		return "", nil, nil, false
+	}
+	return identifier, config, store, true
+}
+
+// annotationWritable tells whether the request may change the annotations,
+// responding with the error otherwise. The changes must be enabled, and carry
+// JSON which the browsers don't send to another origin without asking it
+// first (CORS), the changes not being allowed across the origins.
+func annotationWritable(w http.ResponseWriter, r *http.Request, config *Config) bool {
+	if !config.Annotations.Writable {
+		serveError(w, r, HTTPError{http.StatusMethodNotAllowed, http.StatusText(http.StatusMethodNotAllowed)})
+		return false
+	}
+	if r.Method == http.MethodDelete {
+		return true
+	}
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType != "application/ld+json" && mediaType != "application/json" {
+		serveError(w, r, HTTPError{http.StatusUnsupportedMediaType, http.StatusText(http.StatusUnsupportedMediaType)})
+		return false
+	}
+	return true
+}
+
+// annotationStoreError responds with the status matching the error.
+func annotationStoreError(w http.ResponseWriter, r *http.Request, err error) {
+	switch err {
+	case ErrAnnotationNotFound:
+		serveError(w, r, HTTPError{http.StatusNotFound, err.Error()})
+	case ErrAnnotationExists:
+		serveError(w, r, HTTPError{http.StatusConflict, err.Error()})
+	case ErrAnnotationModified:
+		serveError(w, r, HTTPError{http.StatusPreconditionFailed, err.Error()})
+	default:
+		if _, ok := err.(HTTPError); ok {
+			serveError(w, r, err)
+		} else {
+			log.Printf("Annotation store error: %s", err)
+			serveError(w, r, HTTPError{http.StatusInternalServerError, "Cannot access the annotations"})
+		}
+	}
+}
+
+// serveAnnotation responds with the annotation, its id being within the
+// container. Only the reads are conditional, the changes being checked by the
+// store.
+func serveAnnotation(w http.ResponseWriter, r *http.Request, annotation *StoredAnnotation, container string, status int) {
+	buffer, err := annotationDocument(annotation, container)
+	if err != nil {
+		serveError(w, r, HTTPError{http.StatusInternalServerError, "Cannot create the annotation"})
+		return
+	}
+
+	header := w.Header()
+	header.Set("Content-Type", annotationMediaType)
+	header.Set("ETag", annotation.ETag())
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.WriteHeader(status)
+		w.Write(buffer)
+		return
+	}
+	http.ServeContent(w, r, "annotation.json", annotation.Modified, bytes.NewReader(buffer))
+}
+
+// annotationPage gives the page of the annotations, the items being only
+// their IRIs when asked so.
+func annotationPage(annotations []*StoredAnnotation, container string, page, pageSize int, iris bool) *AnnotationCollectionPage {
+	start := page * pageSize
+	end := start + pageSize
+	if end > len(annotations) {
+		end = len(annotations)
+	}
+
+	p := &AnnotationCollectionPage{
+		ID:   fmt.Sprintf("%s?page=%d", container, page),
+		Type: "AnnotationPage",
+		PartOf: &AnnotationCollectionRef{
+			ID:    container,
+			Total: len(annotations),
+		},
+		StartIndex: start,
+		Items:      []interface{}{},
+	}
+	if page > 0 {
+		p.Prev = fmt.Sprintf("%s?page=%d", container, page-1)
+	}
+	if end < len(annotations) {
+		p.Next = fmt.Sprintf("%s?page=%d", container, page+1)
+	}
+
+	for _, a := range annotations[start:end] {
+		if iris {
+			p.Items = append(p.Items, container+a.ID)
+			continue
+		}
+		document, err := annotationDocument(a, container)
+		if err != nil {
+			log.Printf("Cannot read the annotation %#v: %s", a.ID, err)
+			continue
+		}
+		p.Items = append(p.Items, json.RawMessage(document))
+	}
+	return p
+}
+
+// annotationDocument gives the JSON-LD document of the annotation.
+func annotationDocument(annotation *StoredAnnotation, container string) ([]byte, error) {
+	var document map[string]interface{}
+	if err := json.Unmarshal(annotation.Body, &document); err != nil {
+		return nil, err
+	}
+	document["id"] = container + annotation.ID
+	return json.Marshal(document)
+}
+
+// readAnnotation reads the annotation from the request body, and checks that
+// it targets the image. Its id is removed, the store giving it.
+func readAnnotation(w http.ResponseWriter, r *http.Request, identifier string, config *Config, images *groupcache.Group) (json.RawMessage, error) {
+	data, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxAnnotationSize))
+	if err != nil {
+		return nil, HTTPError{http.StatusRequestEntityTooLarge, err.Error()}
+	}
+
+	var document map[string]interface{}
+	if err = json.Unmarshal(data, &document); err != nil {
+		return nil, HTTPError{http.StatusBadRequest, fmt.Sprintf(annotationInvalidError, err.Error())}
+	}
+	if document["type"] != "Annotation" {
+		return nil, HTTPError{http.StatusBadRequest, fmt.Sprintf(annotationInvalidError, "the type must be Annotation")}
+	}
+
+	target, ok := document["target"]
+	if !ok {
+		return nil, HTTPError{http.StatusBadRequest, fmt.Sprintf(annotationInvalidError, "the target is missing")}
+	}
+
+	size, _, err := imageSize(identifier, config, images)
+	if err != nil {
+		return nil, err
+	}
+	if err = checkTarget(target, baseURL(r)+"/"+identifier, size.Width, size.Height); err != nil {
+		return nil, err
+	}
+
+	delete(document, "id")
+	if _, ok := document["@context"]; !ok {
+		document["@context"] = annotationContext
+	}
+	return json.Marshal(document)
+}
+
+// checkTarget verifies that the target is the image, given by its URI, or a
+// region of it given by a media fragment (xywh=) or an IIIF ImageApiSelector.
+func checkTarget(target interface{}, image string, width, height int) error {
+	switch t := target.(type) {
+	case string:
+		source := t
+		fragment := ""
+		if i := strings.Index(t, "#"); i >= 0 {
+			source, fragment = t[:i], t[i+1:]
+		}
+		if err := checkSource(source, image); err != nil {
+			return err
+		}
+		if fragment == "" {
+			return nil
+		}
+		region, err := fragmentRegion(fragment)
+		if err != nil {
+			return err
+		}
+		return checkRegion(region, width, height)
+	case map[string]interface{}:
+		source, _ := t["source"].(string)
+		if source == "" {
+			source, _ = t["id"].(string)
+		}
+		if err := checkSource(source, image); err != nil {
+			return err
+		}
+
+		selectors, ok := t["selector"].([]interface{})
+		if !ok && t["selector"] != nil {
+			selectors = []interface{}{t["selector"]}
+		}
+		for _, selector := range selectors {
+			if err := checkSelector(selector, width, height); err != nil {
+				return err
+			}
+		}
+		return nil
+	case []interface{}:
+		for _, target := range t {
+			if err := checkTarget(target, image, width, height); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return HTTPError{http.StatusBadRequest, fmt.Sprintf(annotationInvalidError, "the target is neither a string nor an object")}
+}
+
+// checkSource verifies that the URI is the one of the image, or of its
+// info.json.
+func checkSource(source, image string) error {
+	source = strings.TrimSuffix(source, "/info.json")
+	if unescaped, err := url.PathUnescape(source); err == nil {
+		source = unescaped
+	}
+	if unescaped, err := url.PathUnescape(image); err == nil {
+		image = unescaped
+	}
+	if source != image {
+		return HTTPError{http.StatusBadRequest, fmt.Sprintf(annotationInvalidError, fmt.Sprintf("the target %#v is not this image", source))}
+	}
+	return nil
+}
+
+// checkSelector verifies the region of a FragmentSelector or an
+// ImageApiSelector.
+func checkSelector(selector interface{}, width, height int) error {
+	s, _ := selector.(map[string]interface{})
+
+	var region string
+	switch s["type"] {
+	case "FragmentSelector":
+		value, _ := s["value"].(string)
+		r, err := fragmentRegion(value)
+		if err != nil {
+			return err
+		}
+		region = r
+	case "ImageApiSelector":
+		region, _ = s["region"].(string)
+		if region == "" {
+			region = "full"
+		}
+	default:
+		return HTTPError{http.StatusBadRequest, fmt.Sprintf(annotationInvalidError, fmt.Sprintf("the selector %#v is not supported", s["type"]))}
+	}
+	return checkRegion(region, width, height)
+}
+
+// fragmentRegion gives the IIIF region of the xywh media fragment.
+func fragmentRegion(fragment string) (string, error) {
+	if !strings.HasPrefix(fragment, "xywh=") {
+		return "", HTTPError{http.StatusBadRequest, fmt.Sprintf(annotationInvalidError, fmt.Sprintf("the fragment %#v is not a xywh one", fragment))}
+	}
+	value := strings.TrimPrefix(fragment, "xywh=")
+	if strings.HasPrefix(value, "percent:") {
+		return "pct:" + strings.TrimPrefix(value, "percent:"), nil
+	}
+	return strings.TrimPrefix(value, "pixel:"), nil
+}
+
+// checkRegion verifies that the IIIF region is within the image.
+func checkRegion(region string, width, height int) error {
+	if region == "full" || region == "square" {
+		return nil
+	}
+
+	isPercent := strings.HasPrefix(region, "pct:")
+	values := strings.Split(strings.TrimPrefix(region, "pct:"), ",")
+	if len(values) != 4 {
+		return HTTPError{http.StatusBadRequest, fmt.Sprintf(annotationRegionError, region)}
+	}
+
+	box := make([]float64, 4)
+	for i, value := range values {
+		n, err := strconv.ParseFloat(value, 64)
+		if err != nil || (!isPercent && n != float64(int(n))) {
+			return HTTPError{http.StatusBadRequest, fmt.Sprintf(annotationRegionError, region)}
+		}
+		box[i] = n
+	}
+
+	w, h := float64(width), float64(height)
+	if isPercent {
+		w, h = 100, 100
+	}
+	if box[0] < 0 || box[1] < 0 || box[2] <= 0 || box[3] <= 0 || box[0]+box[2] > w || box[1]+box[3] > h {
+		return HTTPError{http.StatusBadRequest, fmt.Sprintf(annotationRegionError, region)}
+	}
+	return nil
+}
+
+// newAnnotationID gives a random identifier.
+func newAnnotationID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,227 @@
+package iiif
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"testing"
+)
+
+func TestCheckTarget(t *testing.T) {
+	var tests = []struct {
+		target string
+		ok     bool
+	}{
+		{`"http://server/lena.jpg"`, true},
+		{`"http://server/lena.jpg#xywh=10,10,100,100"`, true},
+		{`"http://server/lena.jpg#xywh=percent:50,50,50,50"`, true},
+		{`"http://server/lena.jpg#xywh=percent:50,50,60,60"`, false},
+		{`"http://server/lena.jpg#xywh=1000,2300,84,18"`, true},
+		{`"http://server/lena.jpg#xywh=0,0,999999,999999"`, false},
+		{`"http://server/lena.jpg#xywh=2000,10,100,100"`, false},
+		{`"http://server/lena.jpg#xywh=10,10,0,100"`, false},
+		{`"http://server/lena.jpg#t=10"`, false},
+		{`"http://server/other.jpg"`, false},
+		{`"http://elsewhere/x/lena.jpg"`, false},
+		{`"http://server/sub/lena.jpg"`, false},
+		{`{"source": "http://server/lena.jpg/info.json", "selector": {"type": "ImageApiSelector", "region": "pct:10,10,20,20"}}`, true},
+		{`{"source": "http://server/lena.jpg", "selector": [{"type": "FragmentSelector", "value": "xywh=pixel:0,0,10,10"}]}`, true},
+		{`{"source": "http://server/lena.jpg", "selector": {"type": "ImageApiSelector", "region": "1084,0,10,10"}}`, false},
+		{`{"source": "http://server/lena.jpg", "selector": {"type": "SvgSelector", "value": "<svg/>"}}`, false},
+		{`[{"source": "http://server/lena.jpg"}, "http://server/lena.jpg#xywh=0,0,1,1.5"]`, false},
+		{`42`, false},
+	}
+
+	for _, test := range tests {
+		var target interface{}
+		if err := json.Unmarshal([]byte(test.target), &target); err != nil {
+			log.Fatal(err)
+		}
+		err := checkTarget(target, "http://server/lena.jpg", 1084, 2318)
+		if (err == nil) != test.ok {
+			t.Errorf("%v: got %v", test.target, err)
+		}
+	}
+}
+
+func TestLocalAnnotationStore(t *testing.T) {
+	path, err := ioutil.TempDir("", "iiif-annotations")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(path)
+
+	store := NewLocalAnnotationStore(path)
+
+	a := &StoredAnnotation{ID: "a", Body: json.RawMessage(`{"type":"Annotation"}`)}
+	if err = store.Create("images/test.png", a); err != nil {
+		log.Fatal(err)
+	}
+	if err = store.Create("images/test.png", a); err != ErrAnnotationExists {
+		t.Errorf("a duplicate was expected, got %v", err)
+	}
+
+	etag := a.ETag()
+	b := &StoredAnnotation{ID: "a", Body: json.RawMessage(`{"type":"Annotation","bodyValue":"b"}`)}
+	if err = store.Update("images/test.png", b, `"stale"`); err != ErrAnnotationModified {
+		t.Errorf("a stale ETag was expected to fail, got %v", err)
+	}
+	if err = store.Update("images/test.png", b, etag); err != nil {
+		log.Fatal(err)
+	}
+
+	annotations, err := store.List("images/test.png")
+	if err != nil || len(annotations) != 1 || string(annotations[0].Body) != string(b.Body) {
+		t.Errorf("unexpected annotations %v %v", annotations, err)
+	}
+
+	if err = store.Delete("images/test.png", "a", etag); err != ErrAnnotationModified {
+		t.Errorf("a stale ETag was expected to fail, got %v", err)
+	}
+	if err = store.Delete("images/test.png", "a", b.ETag()); err != nil {
+		log.Fatal(err)
+	}
+	if _, err = store.Get("images/test.png", "a"); err != ErrAnnotationNotFound {
+		t.Errorf("the annotation was expected to be deleted, got %v", err)
+	}
+}
+
+func TestAnnotations(t *testing.T) {
+	path, err := ioutil.TempDir("", "iiif-annotations")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(path)
+
+	ts := newServerWithConfig(&Config{
+		Annotations: AnnotationsConfig{
+			Path:     path,
+			PageSize: 1,
+			Writable: true,
+		},
+	})
+	defer ts.Close()
+
+	container := ts.URL + "/lena.jpg/annotations/"
+
+	do := func(method, u string, body string, header map[string]string) *http.Response {
+		req, err := http.NewRequest(method, u, bytes.NewBufferString(body))
+		if err != nil {
+			log.Fatal(err)
+		}
+		req.Header.Set("Content-Type", annotationMediaType)
+		for k, v := range header {
+			req.Header.Set(k, v)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			log.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+
+	annotation := `{"type": "Annotation", "bodyValue": "eye", "target": "` + ts.URL + `/lena.jpg#xywh=10,10,100,100"}`
+	resp := do("POST", container, annotation, map[string]string{"Slug": "eye"})
+	if resp.StatusCode != http.StatusCreated || resp.Header.Get("Location") != container+"eye" {
+		t.Fatalf("unexpected creation %v %v", resp.StatusCode, resp.Header.Get("Location"))
+	}
+	etag := resp.Header.Get("ETag")
+
+	resp = do("POST", container, annotation, nil)
+	if resp.StatusCode != http.StatusCreated {
+		t.Errorf("unexpected creation %v", resp.StatusCode)
+	}
+
+	outside := `{"type": "Annotation", "target": "` + ts.URL + `/lena.jpg#xywh=5000,10,100,100"}`
+	if resp = do("POST", container, outside, nil); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("a region outside of the image expected a 400, got %v", resp.StatusCode)
+	}
+
+	// The changes must be JSON, which the browsers can't send to another
+	// origin without its consent.
+	if resp = do("POST", container, annotation, map[string]string{"Content-Type": "text/plain"}); resp.StatusCode != http.StatusUnsupportedMediaType {
+		t.Errorf("a form expected a 415, got %v", resp.StatusCode)
+	}
+	if cors := resp.Header.Get("Access-Control-Allow-Origin"); cors != "" {
+		t.Errorf("the changes aren't expected to be allowed across the origins, got %#v", cors)
+	}
+
+	resp, err = http.Get(container)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if cors := resp.Header.Get("Access-Control-Allow-Origin"); cors != "*" {
+		t.Errorf("the reads are expected to be allowed across the origins, got %#v", cors)
+	}
+
+	var c AnnotationContainer
+	if err = json.NewDecoder(resp.Body).Decode(&c); err != nil {
+		log.Fatal(err)
+	}
+	if c.Total != 2 || len(c.First.Items) != 1 || c.First.Next != container+"?page=1" || c.Last != container+"?page=1" {
+		t.Errorf("unexpected container %#v", c)
+	}
+
+	if resp = do("PUT", container+"eye", annotation, nil); resp.StatusCode != http.StatusPreconditionRequired {
+		t.Errorf("an If-Match header was expected to be required, got %v", resp.StatusCode)
+	}
+	if resp = do("PUT", container+"eye", annotation, map[string]string{"If-Match": `"stale"`}); resp.StatusCode != http.StatusPreconditionFailed {
+		t.Errorf("a stale ETag expected a 412, got %v", resp.StatusCode)
+	}
+
+	changed := `{"type": "Annotation", "bodyValue": "left eye", "target": "` + ts.URL + `/lena.jpg#xywh=10,10,50,50"}`
+	resp = do("PUT", container+"eye", changed, map[string]string{"If-Match": `"stale", ` + etag})
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("ETag") == etag {
+		t.Errorf("unexpected update %v %v", resp.StatusCode, resp.Header.Get("ETag"))
+	}
+
+	if resp = do("DELETE", container+"eye", "", map[string]string{"If-Match": "*"}); resp.StatusCode != http.StatusNoContent {
+		t.Errorf("unexpected deletion %v", resp.StatusCode)
+	}
+	if resp = do("GET", container+"eye", "", nil); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("the annotation expected to be deleted, got %v", resp.StatusCode)
+	}
+}
+
+func TestAnnotationsReadOnly(t *testing.T) {
+	path, err := ioutil.TempDir("", "iiif-annotations")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(path)
+
+	ts := newServerWithConfig(&Config{
+		Annotations: AnnotationsConfig{Path: path},
+	})
+	defer ts.Close()
+
+	annotation := `{"type": "Annotation", "target": "` + ts.URL + `/lena.jpg"}`
+	resp, err := http.Post(ts.URL+"/lena.jpg/annotations/", annotationMediaType, bytes.NewBufferString(annotation))
+	if err != nil {
+		log.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("the changes were expected to be disabled, got %v", resp.StatusCode)
+	}
+}
+
+func TestAnnotationsDisabled(t *testing.T) {
+	ts := newServer()
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL + "/lena.jpg/annotations/")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("expected to be disabled, got %v", resp.StatusCode)
+	}
+}
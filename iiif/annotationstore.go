@@ -0,0 +1,217 @@
+package iiif
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// errors of the annotation stores
+var (
+	ErrAnnotationNotFound = errors.New("the annotation doesn't exist")
+	ErrAnnotationExists   = errors.New("the annotation already exists")
+	ErrAnnotationModified = errors.New("the annotation has been modified")
+)
+
+// StoredAnnotation is an annotation as kept by the stores, its body being the
+// JSON-LD document without its id.
+type StoredAnnotation struct {
+	ID       string          `json:"id"`
+	Body     json.RawMessage `json:"body"`
+	Created  time.Time       `json:"created"`
+	Modified time.Time       `json:"modified"`
+}
+
+// ETag identifies the version of the annotation.
+func (a *StoredAnnotation) ETag() string {
+	return getETag(string(a.Body))
+}
+
+// AnnotationStore keeps the annotations of each image, in their creation
+// order. The updates and deletions only happen when the annotation still
+// matches the given If-Match header, a list of ETags or *,
+// ErrAnnotationModified being returned otherwise.
+type AnnotationStore interface {
+	List(identifier string) ([]*StoredAnnotation, error)
+	Get(identifier, id string) (*StoredAnnotation, error)
+	Create(identifier string, annotation *StoredAnnotation) error
+	Update(identifier string, annotation *StoredAnnotation, etag string) error
+	Delete(identifier, id, etag string) error
+}
+
+// localStores are the local stores by path, sharing their lock between the
+// requests.
+var localStores sync.Map
+
+// annotationStore gives the store set by WithAnnotationStore, or the local
+// one when a path is configured.
+func annotationStore(ctx context.Context, config *Config) AnnotationStore {
+	if store, ok := ctx.Value(ContextKey("annotations")).(AnnotationStore); ok {
+		return store
+	}
+	if config.Annotations.Path == "" {
+		return nil
+	}
+	store, _ := localStores.LoadOrStore(config.Annotations.Path, NewLocalAnnotationStore(config.Annotations.Path))
+	return store.(AnnotationStore)
+}
+
+// LocalAnnotationStore keeps the annotations of each image in a JSON file
+// under its path.
+type LocalAnnotationStore struct {
+	Path string
+	mu   sync.Mutex
+}
+
+// NewLocalAnnotationStore creates the store writing under the path.
+func NewLocalAnnotationStore(path string) *LocalAnnotationStore {
+	return &LocalAnnotationStore{Path: path}
+}
+
+// List gives the annotations of the image.
+func (s *LocalAnnotationStore) List(identifier string) ([]*StoredAnnotation, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.read(identifier)
+}
+
+// Get gives the annotation of the image.
+func (s *LocalAnnotationStore) Get(identifier, id string) (*StoredAnnotation, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	annotations, err := s.read(identifier)
+	if err != nil {
+		return nil, err
+	}
+	i := findAnnotation(annotations, id)
+	if i < 0 {
+		return nil, ErrAnnotationNotFound
+	}
+	return annotations[i], nil
+}
+
+// Create adds the annotation to the image.
+func (s *LocalAnnotationStore) Create(identifier string, annotation *StoredAnnotation) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	annotations, err := s.read(identifier)
+	if err != nil {
+		return err
+	}
+	if findAnnotation(annotations, annotation.ID) >= 0 {
+		return ErrAnnotationExists
+	}
+	return s.write(identifier, append(annotations, annotation))
+}
+
+// Update replaces the body of the annotation matching the If-Match header,
+// see matchETag.
+func (s *LocalAnnotationStore) Update(identifier string, annotation *StoredAnnotation, etag string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	annotations, err := s.read(identifier)
+	if err != nil {
+		return err
+	}
+	i := findAnnotation(annotations, annotation.ID)
+	if i < 0 {
+		return ErrAnnotationNotFound
+	}
+	if !matchETag(etag, annotations[i].ETag(), false) {
+		return ErrAnnotationModified
+	}
+	annotation.Created = annotations[i].Created
+	annotations[i] = annotation
+	return s.write(identifier, annotations)
+}
+
+// Delete removes the annotation matching the If-Match header, see matchETag.
+func (s *LocalAnnotationStore) Delete(identifier, id, etag string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	annotations, err := s.read(identifier)
+	if err != nil {
+		return err
+	}
+	i := findAnnotation(annotations, id)
+	if i < 0 {
+		return ErrAnnotationNotFound
+	}
+	if !matchETag(etag, annotations[i].ETag(), false) {
+		return ErrAnnotationModified
+	}
+	return s.write(identifier, append(annotations[:i], annotations[i+1:]...))
+}
+
+func (s *LocalAnnotationStore) filename(identifier string) string {
+	return filepath.Join(s.Path, filepath.FromSlash(identifier)+".annotations.json")
+}
+
+// read gives the annotations of the image, none when its file is missing.
+func (s *LocalAnnotationStore) read(identifier string) ([]*StoredAnnotation, error) {
+	data, err := ioutil.ReadFile(s.filename(identifier))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var annotations []*StoredAnnotation
+	err = json.Unmarshal(data, &annotations)
+	return annotations, err
+}
+
+// write replaces the file of the image, removing it when there are no
+// annotations left.
+func (s *LocalAnnotationStore) write(identifier string, annotations []*StoredAnnotation) error {
+	filename := s.filename(identifier)
+	if len(annotations) == 0 {
+		err := os.Remove(filename)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	data, err := json.Marshal(annotations)
+	if err != nil {
+		return err
+	}
+
+	if err = os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(filename), ".iiif-*.json")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err = tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filename)
+}
+
+func findAnnotation(annotations []*StoredAnnotation, id string) int {
+	for i, a := range annotations {
+		if a.ID == id {
+			return i
+		}
+	}
+	return -1
+}
@@ -0,0 +1,299 @@
+package iiif
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang/groupcache"
+	"github.com/gorilla/mux"
+)
+
+// error messages
+var collectionError = "%#v is not a directory"
+var collectionPageError = "The page %#v doesn't exist"
+
+// collectionPrefix distinguishes the directory listings from the URLs in the
+// images cache.
+const collectionPrefix = "collection:"
+
+// defaultPageSize is the number of items of a collection page.
+const defaultPageSize = 100
+
+// Collection lists the manifests and sub-collections of a directory following
+// the IIIF Presentation API 3.0. The large directories are split into pages,
+// being collections within the collection of the directory.
+type Collection struct {
+	Context string           `json:"@context"`
+	ID      string           `json:"id"`
+	Type    string           `json:"type"`
+	Label   LanguageMap      `json:"label"`
+	Items   []CollectionItem `json:"items"`
+	PartOf  []Reference      `json:"partOf,omitempty"`
+}
+
+// CollectionItem is a manifest or a collection within a collection.
+type CollectionItem struct {
+	ID    string      `json:"id"`
+	Type  string      `json:"type"`
+	Label LanguageMap `json:"label"`
+}
+
+// collectionEntry is a sub-directory, being a manifest when it contains
+// images.
+type collectionEntry struct {
+	Name     string `json:"name"`
+	Manifest bool   `json:"manifest"`
+}
+
+// CollectionHandler responds with the Presentation collection of a directory.
+func CollectionHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	path, err := url.QueryUnescape(vars["path"])
+	if err != nil {
+		log.Printf("Path is frob %#v", path)
+		serveError(w, r, HTTPError{http.StatusNotFound, path})
+		return
+	}
+
+	ctx := r.Context()
+	config, _ := ctx.Value(ContextKey("config")).(*Config)
+	images, _ := ctx.Value(ContextKey("images")).(*groupcache.Group)
+
+	path = strings.Trim(strings.Replace(path, "../", "", -1), "/")
+
+	page := 0
+	if p := r.URL.Query().Get("page"); p != "" {
+		page, err = strconv.Atoi(p)
+		if err != nil || page < 1 {
+			serveError(w, r, HTTPError{http.StatusBadRequest, fmt.Sprintf(collectionPageError, p)})
+			return
+		}
+	}
+
+	p, modTime, err := newCollection(path, page, baseURL(r), config, images)
+	if err != nil {
+		serveError(w, r, err)
+		return
+	}
+
+	buffer, err := json.MarshalIndent(p, "", "  ")
+	if err != nil {
+		serveError(w, r, HTTPError{http.StatusInternalServerError, "Cannot create collection"})
+		return
+	}
+
+	header := w.Header()
+
+	contentType := "application/json"
+	if strings.Contains(r.Header.Get("Accept"), "application/ld+json") {
+		contentType = fmt.Sprintf("application/ld+json;profile=%q", presentation3Context)
+	}
+	header.Set("Content-Type", contentType)
+	header.Set("Access-Control-Allow-Origin", "*")
+	// The ETag changes with the directories, and the representation.
+	header.Set("ETag", getETag(fmt.Sprintf("%s %s@%d", r.URL, contentType, modTime.UnixNano())))
+	header.Set("Cache-Control", fmt.Sprintf("max-age=%v, public", config.Cache.HTTP))
+	http.ServeContent(w, r, "collection.json", modTime, bytes.NewReader(buffer))
+}
+
+// newCollection describes the directory, the sub-directories with images
+// being manifests and the others collections. A large directory lists its
+// pages instead, as collections of the given page size, starting at 1. The
+// modification time is the latest of the directory and its sub-directories.
+func newCollection(path string, page int, base string, config *Config, images *groupcache.Group) (*Collection, time.Time, error) {
+	dir := filepath.Join(config.Images, path)
+
+	entries, modTime, err := loadCollection(path, config, images)
+	if err != nil {
+		return nil, modTime, HTTPError{http.StatusNotFound, fmt.Sprintf(collectionError, path)}
+	}
+
+	pageSize := config.Collections.PageSize
+	if pageSize <= 0 {
+		pageSize = defaultPageSize
+	}
+	pages := (len(entries) + pageSize - 1) / pageSize
+	if pages == 0 {
+		pages = 1
+	}
+	if page > pages {
+		return nil, modTime, HTTPError{http.StatusNotFound, fmt.Sprintf(collectionPageError, strconv.Itoa(page))}
+	}
+
+	id := base + "/collection"
+	prefix := ""
+	if path != "" {
+		id += "/" + path
+		prefix = path + "/"
+	}
+
+	p := &Collection{
+		Context: presentation3Context,
+		ID:      id,
+		Type:    "Collection",
+		Label:   newLanguageMap(filepath.Base(dir)),
+		Items:   []CollectionItem{},
+	}
+
+	pageRange := func(n int) (int, int) {
+		start := (n - 1) * pageSize
+		end := start + pageSize
+		if end > len(entries) {
+			end = len(entries)
+		}
+		return start, end
+	}
+
+	// The pages are labelled by the range of their entries.
+	if page == 0 && pages > 1 {
+		for n := 1; n <= pages; n++ {
+			start, end := pageRange(n)
+			p.Items = append(p.Items, CollectionItem{
+				ID:    fmt.Sprintf("%s?page=%d", id, n),
+				Type:  "Collection",
+				Label: newLanguageMap(fmt.Sprintf("%s - %s", entries[start].Name, entries[end-1].Name)),
+			})
+		}
+		return p, modTime, nil
+	}
+
+	start, end := 0, len(entries)
+	if page > 0 && pages > 1 {
+		start, end = pageRange(page)
+		p.ID = fmt.Sprintf("%s?page=%d", id, page)
+		p.Label = newLanguageMap(fmt.Sprintf("%s - %s", entries[start].Name, entries[end-1].Name))
+		p.PartOf = []Reference{{id, "Collection"}}
+	}
+
+	for _, entry := range entries[start:end] {
+		item := CollectionItem{
+			ID:    fmt.Sprintf("%s/collection/%s%s", base, prefix, entry.Name),
+			Type:  "Collection",
+			Label: newLanguageMap(entry.Name),
+		}
+		if entry.Manifest {
+			item.ID = fmt.Sprintf("%s/%s%s/manifest.json", base, prefix, entry.Name)
+			item.Type = "Manifest"
+		}
+		p.Items = append(p.Items, item)
+	}
+
+	return p, modTime, nil
+}
+
+// loadCollection gives the entries of the directory from the cache, the
+// modification times being part of the key so that any change in the
+// directory or its sub-directories invalidates it.
+func loadCollection(path string, config *Config, cache *groupcache.Group) ([]collectionEntry, time.Time, error) {
+	modTime, err := collectionModTime(filepath.Join(config.Images, path))
+	if err != nil {
+		return nil, modTime, err
+	}
+
+	var buffer []byte
+	if cache != nil {
+		key := fmt.Sprintf("%s%d:%s", collectionPrefix, modTime.UnixNano(), path)
+		err = cache.Get(nil, key, groupcache.AllocatingByteSliceSink(&buffer))
+	} else {
+		buffer, err = readCollection(path, config)
+	}
+	if err != nil {
+		return nil, modTime, err
+	}
+
+	var entries []collectionEntry
+	err = json.Unmarshal(buffer, &entries)
+	return entries, modTime, err
+}
+
+// readCollection lists the sub-directories as JSON, in their natural order.
+// The hidden and empty ones, and the derivatives, are left out.
+func readCollection(path string, config *Config) ([]byte, error) {
+	dir := filepath.Join(config.Images, path)
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := []collectionEntry{}
+	for _, file := range files {
+		name := file.Name()
+		sub := filepath.Join(dir, name)
+		if !file.IsDir() || strings.HasPrefix(name, ".") {
+			continue
+		}
+		if config.Derivatives.Path != "" && isWithin(sub, config.Derivatives.Path) {
+			continue
+		}
+
+		names, err := listImages(sub, config)
+		if err != nil {
+			log.Printf("Cannot list %#v: %s", sub, err)
+			continue
+		}
+		if len(names) > 0 {
+			entries = append(entries, collectionEntry{name, true})
+		} else if hasDirectories(sub) {
+			entries = append(entries, collectionEntry{name, false})
+		}
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return naturalLess(entries[i].Name, entries[j].Name)
+	})
+	return json.Marshal(entries)
+}
+
+// collectionKey gives the path of a directory listing cache key.
+func collectionKey(key string) string {
+	key = strings.TrimPrefix(key, collectionPrefix)
+	return key[strings.Index(key, ":")+1:]
+}
+
+// collectionModTime gives the latest modification time of the directory and
+// of its sub-directories.
+func collectionModTime(dir string) (time.Time, error) {
+	stat, err := os.Stat(dir)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if !stat.IsDir() {
+		return time.Time{}, fmt.Errorf(collectionError, dir)
+	}
+
+	modTime := stat.ModTime()
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return modTime, err
+	}
+	for _, file := range files {
+		if file.IsDir() && file.ModTime().After(modTime) {
+			modTime = file.ModTime()
+		}
+	}
+	return modTime, nil
+}
+
+func hasDirectories(dir string) bool {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return false
+	}
+	for _, file := range files {
+		if file.IsDir() && !strings.HasPrefix(file.Name(), ".") {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,116 @@
+package iiif
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCollectionKey(t *testing.T) {
+	if path := collectionKey("collection:1234:books/a:b"); path != "books/a:b" {
+		t.Errorf("got %#v", path)
+	}
+}
+
+func TestCollection(t *testing.T) {
+	images, err := ioutil.TempDir("", "iiif-images")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(images)
+
+	for _, name := range []string{"book10/1.jpg", "book2/1.jpg", "series/book/1.jpg", "empty/notes.txt", ".hidden/1.jpg"} {
+		filename := filepath.Join(images, name)
+		if err = os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
+			log.Fatal(err)
+		}
+		if err = ioutil.WriteFile(filename, []byte{}, 0644); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	config := &Config{
+		Images: images,
+		Collections: CollectionsConfig{
+			PageSize: 2,
+		},
+	}
+	ts := httptest.NewServer(WithConfig(MakeRouter(), config))
+	defer ts.Close()
+
+	get := func(u string) (*Collection, int) {
+		resp, err := http.Get(ts.URL + u)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK {
+			return nil, resp.StatusCode
+		}
+
+		var c Collection
+		if err = json.NewDecoder(resp.Body).Decode(&c); err != nil {
+			log.Fatal(err)
+		}
+		return &c, resp.StatusCode
+	}
+
+	c, _ := get("/collection")
+	if len(c.Items) != 2 || c.Items[0].ID != ts.URL+"/collection?page=1" || c.Items[1].Type != "Collection" {
+		t.Fatalf("unexpected pages %#v", c)
+	}
+	if label := c.Items[0].Label["none"]; len(label) != 1 || label[0] != "book2 - book10" {
+		t.Errorf("unexpected label of the first page %#v", c.Items[0].Label)
+	}
+
+	c, _ = get("/collection?page=1")
+	if len(c.Items) != 2 || len(c.PartOf) != 1 || c.PartOf[0].ID != ts.URL+"/collection" {
+		t.Fatalf("unexpected first page %#v", c)
+	}
+	if c.Items[0].ID != ts.URL+"/book2/manifest.json" || c.Items[1].Type != "Manifest" {
+		t.Errorf("unexpected manifests %#v", c.Items)
+	}
+
+	c, _ = get("/collection?page=2")
+	if len(c.Items) != 1 || c.ID != ts.URL+"/collection?page=2" || c.Items[0].ID != ts.URL+"/collection/series" || c.Items[0].Type != "Collection" {
+		t.Errorf("unexpected second page %#v", c)
+	}
+
+	c, _ = get("/collection/series")
+	if len(c.Items) != 1 || c.PartOf != nil || c.Items[0].ID != ts.URL+"/series/book/manifest.json" {
+		t.Errorf("unexpected sub-collection %#v", c)
+	}
+
+	for _, u := range []string{"/collection?page=3", "/collection/nothing", "/collection/book2/1.jpg"} {
+		if _, status := get(u); status != http.StatusNotFound {
+			t.Errorf("%v: a 404 was expected, got %v", u, status)
+		}
+	}
+	if _, status := get("/collection?page=zero"); status != http.StatusBadRequest {
+		t.Errorf("a 400 was expected, got %v", status)
+	}
+
+	etag := func() string {
+		resp, err := http.Get(ts.URL + "/collection/series")
+		if err != nil {
+			log.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.Header.Get("ETag")
+	}
+	before := etag()
+	later := time.Now().Add(time.Minute)
+	if err = os.Chtimes(filepath.Join(images, "series", "book"), later, later); err != nil {
+		log.Fatal(err)
+	}
+	if after := etag(); after == before {
+		t.Errorf("the ETag %v was expected to change with the directories", after)
+	}
+}
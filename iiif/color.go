@@ -0,0 +1,25 @@
+package iiif
+
+import (
+	"gopkg.in/h2non/bimg.v1"
+)
+
+// defaultProfile is the libvips built-in sRGB profile.
+const defaultProfile = "srgb"
+
+// embeddedProfile keeps the pixels in the colour space of the source.
+const embeddedProfile = "embedded"
+
+// handleColor converts the images holding an ICC profile to the configured
+// output profile. libvips attaches the output profile to the result, which
+// is removed later on when StripProfile is set.
+func handleColor(config *Config, opts *bimg.Options) {
+	profile := config.Color.Profile
+	if profile == "" {
+		profile = defaultProfile
+	}
+
+	if profile != embeddedProfile {
+		opts.OutputICC = profile
+	}
+}
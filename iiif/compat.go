@@ -0,0 +1,387 @@
+package iiif
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/golang/groupcache"
+	"github.com/gorilla/mux"
+)
+
+// error messages
+var iipError = "The IIP command is not supported: %#v"
+var zoomifyTileError = "The Zoomify tile %v-%v-%v doesn't exist"
+
+// The Zoomify and Deep Zoom requests made through iipsrv, e.g.
+// ?Zoomify=/path/image.tif/TileGroup0/0-0-0.jpg
+var (
+	iipZoomifyProperties = regexp.MustCompile(`^(.+)/ImageProperties\.xml$`)
+	iipZoomifyTile       = regexp.MustCompile(`^(.+)/TileGroup[0-9]+/([0-9]+)-([0-9]+)-([0-9]+)\.jpg$`)
+	iipDZI               = regexp.MustCompile(`^(.+)\.dzi$`)
+	iipDZITile           = regexp.MustCompile(`^(.+)_files/([0-9]+)/([0-9]+)_([0-9]+)\.(jpg|png)$`)
+)
+
+// ZoomifyProperties describes the Zoomify image.
+type ZoomifyProperties struct {
+	XMLName   xml.Name `xml:"IMAGE_PROPERTIES"`
+	Width     int      `xml:"WIDTH,attr"`
+	Height    int      `xml:"HEIGHT,attr"`
+	NumTiles  int      `xml:"NUMTILES,attr"`
+	NumImages int      `xml:"NUMIMAGES,attr"`
+	Version   string   `xml:"VERSION,attr"`
+	TileSize  int      `xml:"TILESIZE,attr"`
+}
+
+// isIIP tells whether the request is made to iipsrv, whatever its path, once
+// enabled.
+func isIIP(r *http.Request, rm *mux.RouteMatch) bool {
+	config, _ := r.Context().Value(ContextKey("config")).(*Config)
+	if config == nil || !config.Compat.IIP {
+		return false
+	}
+
+	for k := range r.URL.Query() {
+		switch strings.ToUpper(k) {
+		case "FIF", "ZOOMIFY", "DEEPZOOM":
+			return true
+		}
+	}
+	return false
+}
+
+// IIPHandler responds to the IIP protocol, and to the Zoomify and Deep Zoom
+// requests made the iipsrv way.
+func IIPHandler(w http.ResponseWriter, r *http.Request) {
+	config, _ := r.Context().Value(ContextKey("config")).(*Config)
+	if !config.Compat.IIP {
+		serveError(w, r, HTTPError{http.StatusNotFound, r.URL.Path})
+		return
+	}
+
+	// The IIP parameters are case insensitive.
+	query := url.Values{}
+	for k, v := range r.URL.Query() {
+		query[strings.ToUpper(k)] = v
+	}
+
+	if fif := query.Get("FIF"); fif != "" {
+		serveIIP(w, r, iipIdentifier(fif, config), query)
+		return
+	}
+
+	if path := query.Get("ZOOMIFY"); path != "" {
+		if m := iipZoomifyProperties.FindStringSubmatch(path); m != nil {
+			serveZoomify(w, r, iipIdentifier(m[1], config))
+			return
+		}
+		if m := iipZoomifyTile.FindStringSubmatch(path); m != nil {
+			z, _ := strconv.Atoi(m[2])
+			x, _ := strconv.Atoi(m[3])
+			y, _ := strconv.Atoi(m[4])
+			serveZoomifyTile(w, r, iipIdentifier(m[1], config), z, x, y)
+			return
+		}
+	}
+
+	if path := query.Get("DEEPZOOM"); path != "" {
+		if m := iipDZI.FindStringSubmatch(path); m != nil {
+			serveDZI(w, r, iipIdentifier(m[1], config))
+			return
+		}
+		if m := iipDZITile.FindStringSubmatch(path); m != nil {
+			level, _ := strconv.Atoi(m[2])
+			col, _ := strconv.Atoi(m[3])
+			row, _ := strconv.Atoi(m[4])
+			serveDZITile(w, r, iipIdentifier(m[1], config), level, col, row, m[5])
+			return
+		}
+	}
+
+	message := fmt.Sprintf(iipError, r.URL.RawQuery)
+	serveError(w, r, HTTPError{http.StatusBadRequest, message})
+}
+
+// ZoomifyHandler responds with the ImageProperties.xml of the image.
+func ZoomifyHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	identifier, err := url.QueryUnescape(vars["identifier"])
+	if err != nil {
+		log.Printf("Filename is frob %#v", identifier)
+		serveError(w, r, HTTPError{http.StatusNotFound, identifier})
+		return
+	}
+
+	config, _ := r.Context().Value(ContextKey("config")).(*Config)
+	if !config.Compat.Zoomify {
+		serveError(w, r, HTTPError{http.StatusNotFound, identifier})
+		return
+	}
+
+	serveZoomify(w, r, identifier)
+}
+
+// ZoomifyTileHandler responds with a tile of the Zoomify image, the tile
+// group is ignored.
+func ZoomifyTileHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	identifier, err := url.QueryUnescape(vars["identifier"])
+	if err != nil {
+		log.Printf("Filename is frob %#v", identifier)
+		serveError(w, r, HTTPError{http.StatusNotFound, identifier})
+		return
+	}
+
+	config, _ := r.Context().Value(ContextKey("config")).(*Config)
+	if !config.Compat.Zoomify {
+		serveError(w, r, HTTPError{http.StatusNotFound, identifier})
+		return
+	}
+
+	z, _ := strconv.Atoi(vars["z"])
+	x, _ := strconv.Atoi(vars["x"])
+	y, _ := strconv.Atoi(vars["y"])
+	serveZoomifyTile(w, r, identifier, z, x, y)
+}
+
+// serveIIP responds to the IIP commands: the OBJ metadata, the JTL and PTL
+// tiles and the CVT images.
+func serveIIP(w http.ResponseWriter, r *http.Request, identifier string, query url.Values) {
+	ctx := r.Context()
+	config, _ := ctx.Value(ContextKey("config")).(*Config)
+	images, _ := ctx.Value(ContextKey("images")).(*groupcache.Group)
+
+	size, modTime, err := loadImageSize(identifier, config, images)
+	if err != nil {
+		serveError(w, r, err)
+		return
+	}
+
+	tileSize := compatTileSize(config)
+	levels := zoomLevels(size.Width, size.Height, tileSize)
+
+	if objects, ok := query["OBJ"]; ok {
+		etag, done := sourceETag(w, r, url.QueryEscape(identifier), config, images)
+		if done {
+			return
+		}
+
+		var buffer bytes.Buffer
+		for _, obj := range objects {
+			switch strings.ToLower(obj) {
+			case "iip,1.0":
+				buffer.WriteString("IIP:1.0\r\n")
+			case "basic-info":
+				fmt.Fprintf(&buffer, "Max-size:%d %d\r\n", size.Width, size.Height)
+				fmt.Fprintf(&buffer, "Tile-size:%d %d\r\n", tileSize, tileSize)
+				fmt.Fprintf(&buffer, "Resolution-number:%d\r\n", len(levels))
+			case "max-size":
+				fmt.Fprintf(&buffer, "Max-size:%d %d\r\n", size.Width, size.Height)
+			case "tile-size":
+				fmt.Fprintf(&buffer, "Tile-size:%d %d\r\n", tileSize, tileSize)
+			case "resolution-number":
+				fmt.Fprintf(&buffer, "Resolution-number:%d\r\n", len(levels))
+			default:
+				message := fmt.Sprintf(iipError, "OBJ="+obj)
+				serveError(w, r, HTTPError{http.StatusBadRequest, message})
+				return
+			}
+		}
+
+		header := w.Header()
+		header.Set("Content-Type", "text/plain")
+		header.Set("Access-Control-Allow-Origin", "*")
+		header.Set("ETag", etag)
+		header.Set("Cache-Control", fmt.Sprintf("max-age=%v, public", config.Cache.HTTP))
+		http.ServeContent(w, r, "iip.txt", *modTime, bytes.NewReader(buffer.Bytes()))
+		return
+	}
+
+	for _, t := range []struct{ command, format string }{{"JTL", "jpg"}, {"PTL", "png"}} {
+		command, format := t.command, t.format
+		value := query.Get(command)
+		if value == "" {
+			continue
+		}
+
+		var resolution, n int
+		if _, err := fmt.Sscanf(value, "%d,%d", &resolution, &n); err != nil || resolution < 0 || resolution >= len(levels) {
+			message := fmt.Sprintf(iipError, command+"="+value)
+			serveError(w, r, HTTPError{http.StatusBadRequest, message})
+			return
+		}
+
+		cols := scaled(levels[resolution].Width, tileSize)
+		region, tile, ok := zoomTile(size.Width, size.Height, tileSize, levels, resolution, n%cols, n/cols)
+		if !ok {
+			message := fmt.Sprintf(iipError, command+"="+value)
+			serveError(w, r, HTTPError{http.StatusBadRequest, message})
+			return
+		}
+
+		serveTile(w, r, identifier, region, tile, format, 0)
+		return
+	}
+
+	if cvt := strings.ToLower(query.Get("CVT")); cvt != "" {
+		format := map[string]string{"jpeg": "jpg", "jpg": "jpg", "png": "png"}[cvt]
+		if format == "" {
+			message := fmt.Sprintf(iipError, "CVT="+cvt)
+			serveError(w, r, HTTPError{http.StatusBadRequest, message})
+			return
+		}
+
+		// RGN is relative to the image.
+		region := "full"
+		if rgn := query.Get("RGN"); rgn != "" {
+			var pct []string
+			for _, v := range strings.Split(rgn, ",") {
+				f, _ := strconv.ParseFloat(v, 64)
+				pct = append(pct, strconv.FormatFloat(f*100, 'f', -1, 64))
+			}
+			region = "pct:" + strings.Join(pct, ",")
+		}
+
+		wid, hei := query.Get("WID"), query.Get("HEI")
+		s := "max"
+		if wid != "" && hei != "" {
+			s = fmt.Sprintf("!%s,%s", wid, hei)
+		} else if wid != "" {
+			s = wid + ","
+		} else if hei != "" {
+			s = "," + hei
+		}
+
+		serveTile(w, r, identifier, region, s, format, 0)
+		return
+	}
+
+	message := fmt.Sprintf(iipError, r.URL.RawQuery)
+	serveError(w, r, HTTPError{http.StatusBadRequest, message})
+}
+
+func serveZoomify(w http.ResponseWriter, r *http.Request, identifier string) {
+	ctx := r.Context()
+	config, _ := ctx.Value(ContextKey("config")).(*Config)
+	images, _ := ctx.Value(ContextKey("images")).(*groupcache.Group)
+
+	identifier = strings.Replace(identifier, "../", "", -1)
+
+	etag, done := sourceETag(w, r, url.QueryEscape(identifier), config, images)
+	if done {
+		return
+	}
+
+	size, modTime, err := loadImageSize(identifier, config, images)
+	if err != nil {
+		serveError(w, r, err)
+		return
+	}
+
+	tileSize := compatTileSize(config)
+	numTiles := 0
+	for _, level := range zoomLevels(size.Width, size.Height, tileSize) {
+		numTiles += scaled(level.Width, tileSize) * scaled(level.Height, tileSize)
+	}
+
+	p := ZoomifyProperties{
+		Width:     size.Width,
+		Height:    size.Height,
+		NumTiles:  numTiles,
+		NumImages: 1,
+		Version:   "1.8",
+		TileSize:  tileSize,
+	}
+
+	buffer, err := xml.Marshal(p)
+	if err != nil {
+		serveError(w, r, HTTPError{http.StatusInternalServerError, "Cannot create properties"})
+		return
+	}
+
+	header := w.Header()
+	header.Set("Content-Type", "application/xml")
+	header.Set("Access-Control-Allow-Origin", "*")
+	header.Set("ETag", etag)
+	header.Set("Cache-Control", fmt.Sprintf("max-age=%v, public", config.Cache.HTTP))
+	http.ServeContent(w, r, "ImageProperties.xml", *modTime, bytes.NewReader(buffer))
+}
+
+func serveZoomifyTile(w http.ResponseWriter, r *http.Request, identifier string, z, x, y int) {
+	ctx := r.Context()
+	config, _ := ctx.Value(ContextKey("config")).(*Config)
+	images, _ := ctx.Value(ContextKey("images")).(*groupcache.Group)
+
+	identifier = strings.Replace(identifier, "../", "", -1)
+
+	size, _, err := loadImageSize(identifier, config, images)
+	if err != nil {
+		serveError(w, r, err)
+		return
+	}
+
+	tileSize := compatTileSize(config)
+	levels := zoomLevels(size.Width, size.Height, tileSize)
+	region, tile, ok := zoomTile(size.Width, size.Height, tileSize, levels, z, x, y)
+	if !ok {
+		message := fmt.Sprintf(zoomifyTileError, z, x, y)
+		serveError(w, r, HTTPError{http.StatusNotFound, message})
+		return
+	}
+
+	serveTile(w, r, identifier, region, tile, "jpg", 0)
+}
+
+// zoomLevels gives the sizes of the Zoomify tiers, or IIP resolutions, from
+// the smallest, fitting in a tile, to the full image. Each is half the next
+// one, rounded down.
+func zoomLevels(width, height, tileSize int) []Size {
+	levels := []Size{{Width: width, Height: height}}
+	for width > tileSize || height > tileSize {
+		width, height = width/2, height/2
+		levels = append([]Size{{Width: width, Height: height}}, levels...)
+	}
+	return levels
+}
+
+// zoomTile gives the IIIF region and size of the tile at x, y of the level.
+func zoomTile(width, height, tileSize int, levels []Size, level, x, y int) (string, string, bool) {
+	if level < 0 || level >= len(levels) || x < 0 || y < 0 {
+		return "", "", false
+	}
+
+	l := levels[level]
+	left, top := x*tileSize, y*tileSize
+	if left >= l.Width || top >= l.Height {
+		return "", "", false
+	}
+
+	tw := int(math.Min(float64(tileSize), float64(l.Width-left)))
+	th := int(math.Min(float64(tileSize), float64(l.Height-top)))
+	sf := 1 << uint(len(levels)-1-level)
+
+	region, size := tileRegion(width, height, l.Width, l.Height, sf, left, top, tw, th)
+	return region, size, true
+}
+
+// iipIdentifier turns the path of the image, as known by iipsrv, into its
+// identifier.
+func iipIdentifier(path string, config *Config) string {
+	path = strings.TrimPrefix(path, config.Compat.IIPRoot)
+	path = strings.Replace(path, "../", "", -1)
+	return strings.TrimLeft(path, "/")
+}
+
+func compatTileSize(config *Config) int {
+	if config.Compat.TileSize == 0 {
+		return defaultTileSize
+	}
+	return config.Compat.TileSize
+}
@@ -0,0 +1,169 @@
+package iiif
+
+import (
+	"encoding/xml"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+func TestZoomLevels(t *testing.T) {
+	levels := zoomLevels(1084, 2318, 256)
+	expected := []Size{
+		{Width: 67, Height: 144},
+		{Width: 135, Height: 289},
+		{Width: 271, Height: 579},
+		{Width: 542, Height: 1159},
+		{Width: 1084, Height: 2318},
+	}
+	if !reflect.DeepEqual(levels, expected) {
+		t.Errorf("got %v want %v", levels, expected)
+	}
+
+	if levels = zoomLevels(200, 100, 256); len(levels) != 1 {
+		t.Errorf("a single level expected, got %v", levels)
+	}
+}
+
+func TestZoomTile(t *testing.T) {
+	levels := zoomLevels(1084, 2318, 256)
+
+	var tests = []struct {
+		level  int
+		x      int
+		y      int
+		region string
+		size   string
+		ok     bool
+	}{
+		{0, 0, 0, "full", "67,144", true},
+		{3, 0, 0, "0,0,512,512", "256,", true},
+		{3, 2, 0, "1024,0,60,512", "30,", true},
+		{3, 3, 0, "", "", false},
+		{5, 0, 0, "", "", false},
+		{-1, 0, 0, "", "", false},
+	}
+
+	for _, test := range tests {
+		region, size, ok := zoomTile(1084, 2318, 256, levels, test.level, test.x, test.y)
+		if region != test.region || size != test.size || ok != test.ok {
+			t.Errorf("%v-%v-%v: got %#v %#v %v want %#v %#v %v", test.level, test.x, test.y, region, size, ok, test.region, test.size, test.ok)
+		}
+	}
+}
+
+func TestIIPIdentifier(t *testing.T) {
+	config := &Config{Compat: CompatConfig{IIPRoot: "/var/www/images"}}
+
+	var tests = []struct {
+		path       string
+		identifier string
+	}{
+		{"/var/www/images/lena.jpg", "lena.jpg"},
+		{"/var/www/images/books/a.tif", "books/a.tif"},
+		{"lena.jpg", "lena.jpg"},
+		{"/var/www/images/../../etc/passwd", "etc/passwd"},
+	}
+
+	for _, test := range tests {
+		if identifier := iipIdentifier(test.path, config); identifier != test.identifier {
+			t.Errorf("got %#v want %#v", identifier, test.identifier)
+		}
+	}
+}
+
+func TestCompat(t *testing.T) {
+	ts := newServerWithConfig(&Config{
+		Compat: CompatConfig{
+			IIP:     true,
+			Zoomify: true,
+		},
+	})
+	defer ts.Close()
+
+	var tests = []struct {
+		url         string
+		status      int
+		contentType string
+	}{
+		{"/lena.jpg/ImageProperties.xml", http.StatusOK, "application/xml"},
+		{"/lena.jpg/TileGroup0/3-0-0.jpg", http.StatusOK, "image/jpeg"},
+		{"/lena.jpg/TileGroup0/3-3-0.jpg", http.StatusNotFound, ""},
+		{"/fcgi-bin/iipsrv.fcgi?FIF=lena.jpg&OBJ=IIP,1.0&OBJ=Max-size", http.StatusOK, "text/plain"},
+		{"/fcgi-bin/iipsrv.fcgi?FIF=lena.jpg&JTL=3,1", http.StatusOK, "image/jpeg"},
+		{"/fcgi-bin/iipsrv.fcgi?FIF=lena.jpg&WID=100&CVT=png", http.StatusOK, "image/png"},
+		{"/fcgi-bin/iipsrv.fcgi?FIF=lena.jpg&SDS=0,90", http.StatusBadRequest, ""},
+		{"/fcgi-bin/iipsrv.fcgi?Zoomify=lena.jpg/ImageProperties.xml", http.StatusOK, "application/xml"},
+		{"/fcgi-bin/iipsrv.fcgi?DeepZoom=lena.jpg_files/12/0_0.jpg", http.StatusOK, "image/jpeg"},
+	}
+
+	for _, test := range tests {
+		resp, err := http.Get(ts.URL + test.url)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode != test.status {
+			t.Errorf("%v: got the status %v want %v", test.url, resp.StatusCode, test.status)
+			continue
+		}
+		if test.contentType != "" && resp.Header.Get("Content-Type") != test.contentType {
+			t.Errorf("%v: got the type %v want %v", test.url, resp.Header.Get("Content-Type"), test.contentType)
+		}
+	}
+
+	resp, err := http.Get(ts.URL + "/fcgi-bin/iipsrv.fcgi?FIF=lena.jpg&OBJ=IIP,1.0&OBJ=Max-size")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	if string(body) != "IIP:1.0\r\nMax-size:1084 2318\r\n" {
+		t.Errorf("unexpected IIP response %#v", string(body))
+	}
+
+	resp, err = http.Get(ts.URL + "/lena.jpg/ImageProperties.xml")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	var p ZoomifyProperties
+	if err = xml.NewDecoder(resp.Body).Decode(&p); err != nil {
+		log.Fatal(err)
+	}
+	// 1 + 1x2 + 2x3 + 3x5 + 5x10 tiles.
+	if p.NumTiles != 74 || p.TileSize != 256 {
+		t.Errorf("unexpected properties %#v", p)
+	}
+}
+
+func TestCompatDisabled(t *testing.T) {
+	ts := newServer()
+	defer ts.Close()
+
+	for _, u := range []string{"/lena.jpg/ImageProperties.xml", "/iipsrv.fcgi?FIF=lena.jpg&OBJ=IIP,1.0"} {
+		resp, err := http.Get(ts.URL + u)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode != http.StatusNotFound {
+			t.Errorf("%v: expected to be disabled, got %v", u, resp.StatusCode)
+		}
+	}
+
+	// The IIIF requests are served whatever their query.
+	resp, err := http.Get(ts.URL + "/lena.jpg/full/max/0/default.jpg?fif=1")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("an image with a FIF query expected a 200, got %v", resp.StatusCode)
+	}
+}
@@ -0,0 +1,147 @@
+package iiif
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/golang/groupcache"
+)
+
+// sourceTag fingerprints the source of the image, and gives its modification
+// time. A local file isn't read, its size, modification time and generation
+// being enough, nor is a remote image whose server validates it.
+func sourceTag(identifier string, config *Config, cache *groupcache.Group) (string, time.Time, error) {
+	identifier, err := url.QueryUnescape(identifier)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	identifier = strings.Replace(identifier, "../", "", -1)
+
+	filename, page, ok := localPage(identifier, config)
+	if !ok {
+		sURL, err := remoteURL(identifier)
+		if err != nil {
+			return "", time.Time{}, err
+		}
+		return remoteTag(sURL, cache)
+	}
+
+	stat, err := os.Stat(filename)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	// The generation is the one of the file, without the page.
+	name := identifier
+	if page >= 0 {
+		name, _ = splitPage(identifier, config)
+	}
+	tag := fmt.Sprintf("%d-%d-%d", stat.Size(), stat.ModTime().UnixNano(), config.Watcher.Generation(name))
+	return tag, stat.ModTime(), nil
+}
+
+// remoteTag fingerprints the remote image from the ETag, or else the
+// Last-Modified, given by its server. The image is only downloaded, and
+// hashed, without any.
+func remoteTag(sURL string, cache *groupcache.Group) (string, time.Time, error) {
+	resp, err := http.Head(sURL)
+	if err == nil {
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusOK {
+			modTime, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+			if etag := resp.Header.Get("ETag"); etag != "" {
+				return fmt.Sprintf("%x", sha1.Sum([]byte(etag))), modTime, nil
+			}
+			if !modTime.IsZero() {
+				return fmt.Sprintf("%d", modTime.Unix()), modTime, nil
+			}
+		}
+	}
+
+	buffer, modTime, err := loadRemote(sURL, cache)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	return fmt.Sprintf("%x", sha1.Sum(buffer)), modTime, nil
+}
+
+// checkPreconditions evaluates the conditional headers of the request, see
+// RFC 7232, before the response is made. It tells whether the response, a 304
+// or a 412, was already sent.
+func checkPreconditions(w http.ResponseWriter, r *http.Request, etag string, modTime time.Time, config *Config) bool {
+	// HTTP dates have no sub-second precision.
+	modTime = modTime.Truncate(time.Second)
+
+	if ifMatch := r.Header.Get("If-Match"); ifMatch != "" {
+		if !matchETag(ifMatch, etag, false) {
+			w.WriteHeader(http.StatusPreconditionFailed)
+			return true
+		}
+	} else if since, err := http.ParseTime(r.Header.Get("If-Unmodified-Since")); err == nil && !modTime.IsZero() {
+		if modTime.After(since) {
+			w.WriteHeader(http.StatusPreconditionFailed)
+			return true
+		}
+	}
+
+	get := r.Method == "GET" || r.Method == "HEAD"
+	if ifNoneMatch := r.Header.Get("If-None-Match"); ifNoneMatch != "" {
+		if !matchETag(ifNoneMatch, etag, true) {
+			return false
+		}
+		if !get {
+			w.WriteHeader(http.StatusPreconditionFailed)
+			return true
+		}
+	} else if since, err := http.ParseTime(r.Header.Get("If-Modified-Since")); err != nil || !get || modTime.IsZero() || modTime.After(since) {
+		return false
+	}
+
+	header := w.Header()
+	header.Set("ETag", etag)
+	if header.Get("Cache-Control") == "" {
+		header.Set("Cache-Control", fmt.Sprintf("max-age=%v, public", config.Cache.HTTP))
+	}
+	if !modTime.IsZero() {
+		header.Set("Last-Modified", modTime.UTC().Format(http.TimeFormat))
+	}
+	w.WriteHeader(http.StatusNotModified)
+	return true
+}
+
+// matchETag tells whether the list of entity tags (or *) of the header
+// matches the ETag. The weak comparison ignores the W/ prefix.
+func matchETag(list, etag string, weak bool) bool {
+	for _, candidate := range strings.Split(list, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" {
+			return true
+		}
+		if weak {
+			candidate = strings.TrimPrefix(candidate, "W/")
+			etag = strings.TrimPrefix(etag, "W/")
+		} else if strings.HasPrefix(candidate, "W/") {
+			continue
+		}
+		if candidate == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// sourceETag gives the ETag of the response from the request and the
+// fingerprint of the source of the image, and evaluates the conditional
+// headers with it. It tells whether the response was already sent.
+func sourceETag(w http.ResponseWriter, r *http.Request, identifier string, config *Config, cache *groupcache.Group) (string, bool) {
+	tag, modTime, err := sourceTag(identifier, config, cache)
+	if err != nil {
+		return getETag(r.URL.String()), false
+	}
+	etag := getETag(fmt.Sprintf("%s@%s", r.URL, tag))
+	return etag, checkPreconditions(w, r, etag, modTime, config)
+}
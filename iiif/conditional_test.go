@@ -0,0 +1,118 @@
+package iiif
+
+import (
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMatchETag(t *testing.T) {
+	var tests = []struct {
+		list  string
+		weak  bool
+		match bool
+	}{
+		{`"a"`, false, true},
+		{`"b", "a"`, false, true},
+		{`*`, false, true},
+		{`W/"a"`, false, false},
+		{`W/"a"`, true, true},
+		{`"b"`, true, false},
+	}
+
+	for _, test := range tests {
+		if match := matchETag(test.list, `"a"`, test.weak); match != test.match {
+			t.Errorf("%#v (weak %v): got %v want %v", test.list, test.weak, match, test.match)
+		}
+	}
+}
+
+func TestSourceTag(t *testing.T) {
+	dir, err := ioutil.TempDir("", "iiif-source")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	filename := filepath.Join(dir, "test.png")
+	if err = ioutil.WriteFile(filename, []byte("first"), 0644); err != nil {
+		log.Fatal(err)
+	}
+
+	config := &Config{Images: dir}
+	tag, modTime, err := sourceTag("test.png", config, nil)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	later := modTime.Add(time.Minute)
+	if err = os.Chtimes(filename, later, later); err != nil {
+		log.Fatal(err)
+	}
+	changed, modTime, err := sourceTag("test.png", config, nil)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if changed == tag || !modTime.Equal(later) {
+		t.Errorf("the tag was expected to change with the file, got %#v %v", changed, modTime)
+	}
+
+	// The pages follow the generation of their file.
+	config.Watcher = NewWatcher(config)
+	if err = config.Watcher.Scan(); err != nil {
+		log.Fatal(err)
+	}
+	if err = ioutil.WriteFile(filename, []byte("second"), 0644); err != nil {
+		log.Fatal(err)
+	}
+	if err = config.Watcher.Scan(); err != nil {
+		log.Fatal(err)
+	}
+	if page, _, err := sourceTag("test.png;1", config, nil); err != nil || !strings.HasSuffix(page, "-1") {
+		t.Errorf("the page was expected to have the generation of its file, got %#v %v", page, err)
+	}
+
+	if _, _, err = sourceTag("missing.png", config, nil); err == nil {
+		t.Errorf("a missing file was expected to fail")
+	}
+}
+
+func TestRemoteTag(t *testing.T) {
+	etag := `"first"`
+	downloads := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if etag != "" {
+			w.Header().Set("ETag", etag)
+		}
+		if r.Method == "GET" {
+			downloads++
+		}
+		w.Write([]byte("image"))
+	}))
+	defer ts.Close()
+
+	tag, _, err := remoteTag(ts.URL, nil)
+	if err != nil {
+		log.Fatal(err)
+	}
+	etag = `"second"`
+	changed, _, err := remoteTag(ts.URL, nil)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if changed == tag || downloads != 0 {
+		t.Errorf("the tag was expected from the ETag, got %#v after %d downloads", changed, downloads)
+	}
+
+	// Without any validator, the image is hashed.
+	etag = ""
+	if _, _, err = remoteTag(ts.URL, nil); err != nil || downloads != 1 {
+		t.Errorf("the image was expected to be downloaded, got %d downloads (%v)", downloads, err)
+	}
+}
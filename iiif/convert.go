@@ -0,0 +1,325 @@
+package iiif
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// error messages
+var convertError = "vips couldn't convert %#v: %s"
+var convertPathError = "%#v is not within the images directory %#v"
+
+// defaults of the derivatives.
+const (
+	defaultDerivativeFormat = "tiff"
+	defaultTileSize         = 256
+	defaultCompression      = "jpeg"
+	defaultDerivativeQ      = 85
+)
+
+// convertExtensions are the source images that are converted, the documents
+// keep their pages.
+var convertExtensions = map[string]bool{
+	".gif":  true,
+	".jpeg": true,
+	".jpg":  true,
+	".png":  true,
+	".tif":  true,
+	".tiff": true,
+	".webp": true,
+}
+
+// ConvertResult tells what happened to a source image.
+type ConvertResult struct {
+	Source     string
+	Derivative string
+	Skipped    bool
+	Duration   time.Duration
+	Err        error
+}
+
+// Convert writes the tiled pyramids of the images found under the paths, or
+// the whole images directory, using the vips command line tool. The up to
+// date derivatives are skipped, unless forced. The progress is called for
+// each image, one at a time.
+func Convert(config *Config, paths []string, force bool, progress func(done, total int, result ConvertResult)) error {
+	if config.Derivatives.Path == "" {
+		return fmt.Errorf("the derivatives path is not configured")
+	}
+
+	if len(paths) == 0 {
+		paths = []string{config.Images}
+	}
+
+	var sources []string
+	for _, p := range paths {
+		if !filepath.IsAbs(p) {
+			p = filepath.Join(config.Images, p)
+		}
+		if _, ok := derivativePath(p, config); !ok {
+			return fmt.Errorf(convertPathError, p, config.Images)
+		}
+
+		err := filepath.Walk(p, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if info.IsDir() {
+				if (strings.HasPrefix(info.Name(), ".") && path != p) || isWithin(path, config.Derivatives.Path) {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if !strings.HasPrefix(info.Name(), ".") && convertExtensions[strings.ToLower(filepath.Ext(path))] {
+				sources = append(sources, path)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	workers := config.Derivatives.Workers
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+
+	jobs := make(chan string)
+	results := make(chan ConvertResult)
+
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for source := range jobs {
+				results <- convertImage(source, force, config)
+			}
+		}()
+	}
+
+	go func() {
+		for _, source := range sources {
+			jobs <- source
+		}
+		close(jobs)
+		wg.Wait()
+		close(results)
+	}()
+
+	done := 0
+	for result := range results {
+		done++
+		if progress != nil {
+			progress(done, len(sources), result)
+		}
+	}
+	return nil
+}
+
+// convertImage writes the derivative of the source unless it's up to date.
+// Pyramids and documents are left as is.
+func convertImage(source string, force bool, config *Config) ConvertResult {
+	start := time.Now()
+	derivative, _ := derivativePath(source, config)
+	result := ConvertResult{
+		Source:     source,
+		Derivative: derivative,
+	}
+
+	stat, err := os.Stat(source)
+	if err != nil {
+		result.Err = err
+		return result
+	}
+
+	if isPyramid(pyramidLevels(source)) {
+		result.Skipped = true
+		return result
+	}
+	count, err := pageCount(source, config)
+	if err != nil {
+		result.Err = err
+		return result
+	}
+	if count > 1 {
+		result.Skipped = true
+		return result
+	}
+
+	if !force && upToDate(source, derivative, stat) {
+		result.Skipped = true
+		return result
+	}
+
+	result.Err = writeDerivative(source, derivative, config)
+	if result.Err == nil {
+		// The hash tells apart the sources that were only touched.
+		var hash string
+		hash, result.Err = fileHash(source)
+		if result.Err == nil {
+			result.Err = ioutil.WriteFile(derivative+".sha256", []byte(hash), 0644)
+		}
+	}
+	result.Duration = time.Since(start)
+	return result
+}
+
+// writeDerivative saves the tiled pyramid to a temporary file which replaces
+// the derivative once complete.
+func writeDerivative(source, derivative string, config *Config) error {
+	c := config.Derivatives
+
+	err := os.MkdirAll(filepath.Dir(derivative), 0755)
+	if err != nil {
+		return err
+	}
+
+	// vips picks the saver from the extension.
+	tmp, err := ioutil.TempFile(filepath.Dir(derivative), ".iiif-*"+filepath.Ext(derivative))
+	if err != nil {
+		return err
+	}
+	tmp.Close()
+	defer os.Remove(tmp.Name())
+
+	tileSize := c.TileSize
+	if tileSize == 0 {
+		tileSize = defaultTileSize
+	}
+	quality := c.Quality
+	if quality == 0 {
+		quality = defaultDerivativeQ
+	}
+
+	// The pyramids are cropped before being rotated, the orientation is
+	// thus applied beforehand.
+	load := source
+	if autoOrient(config) && isJPEG(source) {
+		load += "[autorotate=true]"
+	}
+
+	size := strconv.Itoa(tileSize)
+	var args []string
+	if derivativeFormat(config) == "jp2" {
+		args = []string{"jp2ksave", load, tmp.Name(), "--tile-width", size, "--tile-height", size, "--Q", strconv.Itoa(quality)}
+	} else {
+		compression := c.Compression
+		if compression == "" {
+			compression = defaultCompression
+		}
+		args = []string{"tiffsave", load, tmp.Name(), "--tile", "--pyramid", "--tile-width", size, "--tile-height", size, "--compression", compression, "--Q", strconv.Itoa(quality)}
+	}
+
+	output, err := exec.Command(vipsCommand(config), args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf(convertError, source, strings.TrimSpace(string(output)))
+	}
+
+	return os.Rename(tmp.Name(), derivative)
+}
+
+// upToDate tells whether the derivative is newer than the source, or was made
+// from the same content.
+func upToDate(source, derivative string, stat os.FileInfo) bool {
+	d, err := os.Stat(derivative)
+	if err != nil {
+		return false
+	}
+	if !d.ModTime().Before(stat.ModTime()) {
+		return true
+	}
+
+	sum, err := ioutil.ReadFile(derivative + ".sha256")
+	if err != nil {
+		return false
+	}
+	hash, err := fileHash(source)
+	if err != nil || string(sum) != hash {
+		return false
+	}
+
+	// The source was only touched, so is the derivative for the loader to
+	// keep on using it.
+	return os.Chtimes(derivative, stat.ModTime(), stat.ModTime()) == nil
+}
+
+// derivativePath gives where the derivative of the file is, the extension of
+// the source is kept to avoid any clash, e.g. lena.jpg.tif.
+func derivativePath(filename string, config *Config) (string, bool) {
+	if config.Derivatives.Path == "" || !isWithin(filename, config.Images) {
+		return "", false
+	}
+
+	rel, _ := filepath.Rel(config.Images, filename)
+	ext := ".tif"
+	if derivativeFormat(config) == "jp2" {
+		ext = ".jp2"
+	}
+	return filepath.Join(config.Derivatives.Path, rel+ext), true
+}
+
+// findDerivative gives the derivative of the file, if any and if it's not
+// older than the file itself. Only the tiled pyramids, whose levels and
+// regions are read on their own, replace the file.
+func findDerivative(filename string, stat os.FileInfo, config *Config) (string, bool) {
+	derivative, ok := derivativePath(filename, config)
+	if !ok || stat == nil {
+		return "", false
+	}
+
+	d, err := os.Stat(derivative)
+	if err != nil || d.ModTime().Before(stat.ModTime()) || !isPyramid(pyramidLevels(derivative)) {
+		return "", false
+	}
+	return derivative, true
+}
+
+func derivativeFormat(config *Config) string {
+	if config.Derivatives.Format == "" {
+		return defaultDerivativeFormat
+	}
+	return strings.ToLower(config.Derivatives.Format)
+}
+
+// isJP2 tells whether the file is a JPEG 2000, bimg doesn't read them. They
+// are loaded by libvips within the server, see jp2Levels.
+func isJP2(filename string) bool {
+	return strings.EqualFold(filepath.Ext(filename), ".jp2")
+}
+
+func isJPEG(filename string) bool {
+	ext := strings.ToLower(filepath.Ext(filename))
+	return ext == ".jpg" || ext == ".jpeg"
+}
+
+func isWithin(path, dir string) bool {
+	rel, err := filepath.Rel(dir, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+func fileHash(filename string) (string, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,130 @@
+package iiif
+
+import (
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestDerivativePath(t *testing.T) {
+	config := &Config{
+		Images: "../fixtures",
+		Derivatives: DerivativesConfig{
+			Path: "/var/cache/iiif",
+		},
+	}
+
+	var tests = []struct {
+		filename   string
+		derivative string
+		ok         bool
+	}{
+		{"../fixtures/lena.jpg", "/var/cache/iiif/lena.jpg.tif", true},
+		{"../fixtures/images/test.png", "/var/cache/iiif/images/test.png.tif", true},
+		{"../lena.jpg", "", false},
+		{"../fixtures/../cmd/lena.jpg", "", false},
+	}
+
+	for _, test := range tests {
+		derivative, ok := derivativePath(test.filename, config)
+		if derivative != test.derivative || ok != test.ok {
+			t.Errorf("%v: got %#v, %v want %#v, %v", test.filename, derivative, ok, test.derivative, test.ok)
+		}
+	}
+
+	config.Derivatives.Format = "jp2"
+	if derivative, _ := derivativePath("../fixtures/lena.jpg", config); derivative != "/var/cache/iiif/lena.jpg.jp2" {
+		t.Errorf("unexpected JPEG 2000 derivative %#v", derivative)
+	}
+
+	config.Derivatives.Path = ""
+	if _, ok := derivativePath("../fixtures/lena.jpg", config); ok {
+		t.Error("no derivatives are expected without a path")
+	}
+}
+
+func TestConvert(t *testing.T) {
+	images, err := ioutil.TempDir("", "iiif-images")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(images)
+
+	buffer, err := ioutil.ReadFile("../fixtures/lena.jpg")
+	if err != nil {
+		log.Fatal(err)
+	}
+	source := filepath.Join(images, "lena.jpg")
+	if err = ioutil.WriteFile(source, buffer, 0644); err != nil {
+		log.Fatal(err)
+	}
+
+	config := &Config{
+		Images: images,
+		Derivatives: DerivativesConfig{
+			Path:     filepath.Join(images, ".derivatives"),
+			TileSize: 64,
+			Workers:  2,
+		},
+	}
+
+	convert := func() []ConvertResult {
+		var results []ConvertResult
+		err := Convert(config, nil, false, func(done, total int, result ConvertResult) {
+			if total != 1 {
+				t.Errorf("a single image was expected, got %v", total)
+			}
+			results = append(results, result)
+		})
+		if err != nil {
+			log.Fatal(err)
+		}
+		return results
+	}
+
+	results := convert()
+	if len(results) != 1 || results[0].Err != nil || results[0].Skipped {
+		t.Fatalf("the image expected to be converted, got %#v", results)
+	}
+
+	derivative := results[0].Derivative
+	if !isPyramid(tiffLevels(derivative)) {
+		t.Errorf("%v is expected to be a pyramid", derivative)
+	}
+
+	if results = convert(); len(results) != 1 || !results[0].Skipped {
+		t.Errorf("the up to date derivative expected to be skipped, got %#v", results)
+	}
+
+	// A touched source keeps its derivative.
+	later := time.Now().Add(time.Minute)
+	if err = os.Chtimes(source, later, later); err != nil {
+		log.Fatal(err)
+	}
+	if results = convert(); len(results) != 1 || !results[0].Skipped {
+		t.Errorf("the unchanged source expected to be skipped, got %#v", results)
+	}
+
+	stat, _ := os.Stat(source)
+	if d, ok := findDerivative(source, stat, config); !ok || d != derivative {
+		t.Errorf("the derivative expected to be used, got %#v", d)
+	}
+
+	ts := httptest.NewServer(WithConfig(MakeRouter(), config))
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL + "/lena.jpg/0,0,64,64/32,/0/default.png")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("the derivative couldn't be served, got %v", resp.StatusCode)
+	}
+}
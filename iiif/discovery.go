@@ -0,0 +1,403 @@
+package iiif
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// error messages
+var discoveryPageError = "The page %#v doesn't exist"
+
+// discoveryContext is the context of the Change Discovery API.
+const discoveryContext = "http://iiif.io/api/discovery/1/context.json"
+
+// the kinds of the objects of the activities.
+const (
+	imageKind    = "ImageService2"
+	manifestKind = "Manifest"
+)
+
+// defaultDiscoveryInterval is the number of seconds between two scans of the
+// images directory, without a watcher.
+const defaultDiscoveryInterval = 60
+
+// discoveryDelay is the time waited after a change before scanning the images
+// directory.
+const discoveryDelay = time.Second
+
+// Activity is a change of an image or manifest, as written in the log. State
+// identifies the version of the object (the modification time of an image,
+// the content of a directory), so that the changes made while the server
+// was stopped are found too.
+type Activity struct {
+	Type       string    `json:"type"`
+	Kind       string    `json:"kind"`
+	Identifier string    `json:"identifier"`
+	State      string    `json:"state,omitempty"`
+	EndTime    time.Time `json:"endTime"`
+}
+
+// Discovery records the changes of the images, and of the manifests of their
+// directories, into the activity log.
+type Discovery struct {
+	config     *Config
+	mu         sync.Mutex
+	activities []Activity
+	states     map[string]string
+}
+
+// OrderedCollection lists the activities page by page, following the IIIF
+// Change Discovery API, see https://iiif.io/api/discovery/1.0/
+type OrderedCollection struct {
+	Context    string     `json:"@context"`
+	ID         string     `json:"id"`
+	Type       string     `json:"type"`
+	TotalItems int        `json:"totalItems"`
+	First      *Reference `json:"first,omitempty"`
+	Last       *Reference `json:"last,omitempty"`
+}
+
+// OrderedCollectionPage is a page of activities, the oldest first.
+type OrderedCollectionPage struct {
+	Context      string             `json:"@context"`
+	ID           string             `json:"id"`
+	Type         string             `json:"type"`
+	PartOf       Reference          `json:"partOf"`
+	StartIndex   int                `json:"startIndex"`
+	Prev         *Reference         `json:"prev,omitempty"`
+	Next         *Reference         `json:"next,omitempty"`
+	OrderedItems []ActivityDocument `json:"orderedItems"`
+}
+
+// ActivityDocument is an activity as published.
+type ActivityDocument struct {
+	Type    string    `json:"type"`
+	Object  Reference `json:"object"`
+	EndTime string    `json:"endTime"`
+}
+
+// NewDiscovery reads the activity log of the configuration.
+func NewDiscovery(config *Config) (*Discovery, error) {
+	d := &Discovery{
+		config: config,
+		states: make(map[string]string),
+	}
+
+	f, err := os.Open(config.Discovery.Log)
+	if os.IsNotExist(err) {
+		return d, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var a Activity
+		if err = json.Unmarshal(scanner.Bytes(), &a); err != nil {
+			return nil, err
+		}
+		d.replay(a)
+	}
+	return d, scanner.Err()
+}
+
+// Watch scans the images directory once the watcher of the configuration
+// tells about changes, or every interval without a watcher, until stopped.
+func (d *Discovery) Watch(stop <-chan struct{}) {
+	var changes <-chan struct{}
+	var tick <-chan time.Time
+	if d.config.Watcher != nil {
+		changes = d.config.Watcher.Changes()
+	} else {
+		interval := d.config.Discovery.Interval
+		if interval <= 0 {
+			interval = defaultDiscoveryInterval
+		}
+		ticker := time.NewTicker(time.Duration(interval) * time.Second)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	for {
+		if err := d.Scan(); err != nil {
+			log.Printf("Cannot scan the images: %s", err)
+		}
+		select {
+		case <-stop:
+			return
+		case <-tick:
+		case <-changes:
+			// The files being copied are awaited, their changes being
+			// coalesced into the next scan.
+			select {
+			case <-stop:
+				return
+			case <-time.After(discoveryDelay):
+			}
+		}
+	}
+}
+
+// Scan compares the images directory with the known states, and logs the
+// creations, updates and deletions of the images and manifests.
+func (d *Discovery) Scan() error {
+	states, err := scanImages(d.config)
+	if err != nil {
+		return err
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	now := time.Now().UTC()
+	var activities []Activity
+	for key, state := range states {
+		kind, identifier := splitStateKey(key)
+		known, ok := d.states[key]
+		if !ok {
+			activities = append(activities, Activity{"Create", kind, identifier, state, now})
+		} else if known != state {
+			activities = append(activities, Activity{"Update", kind, identifier, state, now})
+		}
+	}
+	for key := range d.states {
+		if _, ok := states[key]; !ok {
+			kind, identifier := splitStateKey(key)
+			activities = append(activities, Activity{"Delete", kind, identifier, "", now})
+		}
+	}
+
+	// The images before their manifests, in a stable order.
+	sort.Slice(activities, func(i, j int) bool {
+		if activities[i].Kind != activities[j].Kind {
+			return activities[i].Kind == imageKind
+		}
+		return activities[i].Identifier < activities[j].Identifier
+	})
+
+	return d.append(activities)
+}
+
+// Activities gives the number of activities, and the ones of the range.
+func (d *Discovery) Activities(start, end int) (int, []Activity) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if end > len(d.activities) {
+		end = len(d.activities)
+	}
+	if start > end {
+		start = end
+	}
+	return len(d.activities), append([]Activity(nil), d.activities[start:end]...)
+}
+
+// append writes the activities to the log, and applies them.
+func (d *Discovery) append(activities []Activity) error {
+	if len(activities) == 0 {
+		return nil
+	}
+
+	var buffer bytes.Buffer
+	encoder := json.NewEncoder(&buffer)
+	for _, a := range activities {
+		if err := encoder.Encode(a); err != nil {
+			return err
+		}
+	}
+
+	f, err := os.OpenFile(d.config.Discovery.Log, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(buffer.Bytes()); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+
+	for _, a := range activities {
+		d.replay(a)
+	}
+	return nil
+}
+
+// replay applies the activity to the known states.
+func (d *Discovery) replay(a Activity) {
+	d.activities = append(d.activities, a)
+	key := a.Kind + ":" + a.Identifier
+	if a.Type == "Delete" {
+		delete(d.states, key)
+	} else {
+		d.states[key] = a.State
+	}
+}
+
+func splitStateKey(key string) (string, string) {
+	i := strings.Index(key, ":")
+	return key[:i], key[i+1:]
+}
+
+// scanImages gives the states of the images, being their modification time,
+// and of the directories having images, being a hash of their images and
+// sidecar.
+func scanImages(config *Config) (map[string]string, error) {
+	states := make(map[string]string)
+	directories := make(map[string][]string)
+
+	err := filepath.Walk(config.Images, func(filename string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			if (strings.HasPrefix(info.Name(), ".") && filename != config.Images) || (config.Derivatives.Path != "" && isWithin(filename, config.Derivatives.Path)) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if strings.HasPrefix(info.Name(), ".") || !isImageFile(info.Name()) {
+			return nil
+		}
+
+		rel, err := filepath.Rel(config.Images, filename)
+		if err != nil {
+			return err
+		}
+		identifier := filepath.ToSlash(rel)
+		state := strconv.FormatInt(info.ModTime().UnixNano(), 10)
+		states[imageKind+":"+identifier] = state
+
+		if dir := path.Dir(identifier); dir != "." {
+			directories[dir] = append(directories[dir], identifier+"@"+state)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for dir, images := range directories {
+		sort.Strings(images)
+		_, sidecarTime, _ := readManifestSidecar(filepath.Join(config.Images, filepath.FromSlash(dir)))
+		images = append(images, strconv.FormatInt(sidecarTime.UnixNano(), 10))
+		states[manifestKind+":"+dir] = fmt.Sprintf("%x", sha1.Sum([]byte(strings.Join(images, "\n"))))
+	}
+	return states, nil
+}
+
+// ActivityCollectionHandler responds with the ordered collection of the
+// activities.
+func ActivityCollectionHandler(w http.ResponseWriter, r *http.Request) {
+	d, ok := r.Context().Value(ContextKey("discovery")).(*Discovery)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	total, _ := d.Activities(0, 0)
+	pageSize := discoveryPageSize(d.config)
+	base := baseURL(r) + "/activity"
+
+	p := &OrderedCollection{
+		Context:    discoveryContext,
+		ID:         base + "/all-changes",
+		Type:       "OrderedCollection",
+		TotalItems: total,
+	}
+	if total > 0 {
+		p.First = &Reference{base + "/page/0", "OrderedCollectionPage"}
+		p.Last = &Reference{fmt.Sprintf("%s/page/%d", base, (total-1)/pageSize), "OrderedCollectionPage"}
+	}
+
+	serveDiscovery(w, r, p)
+}
+
+// ActivityPageHandler responds with a page of the activities, the oldest
+// first.
+func ActivityPageHandler(w http.ResponseWriter, r *http.Request) {
+	d, ok := r.Context().Value(ContextKey("discovery")).(*Discovery)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	page, _ := strconv.Atoi(mux.Vars(r)["page"])
+	pageSize := discoveryPageSize(d.config)
+	total, activities := d.Activities(page*pageSize, (page+1)*pageSize)
+	if len(activities) == 0 && page > 0 {
+		http.Error(w, fmt.Sprintf(discoveryPageError, mux.Vars(r)["page"]), http.StatusNotFound)
+		return
+	}
+
+	base := baseURL(r)
+	p := &OrderedCollectionPage{
+		Context:      discoveryContext,
+		ID:           fmt.Sprintf("%s/activity/page/%d", base, page),
+		Type:         "OrderedCollectionPage",
+		PartOf:       Reference{base + "/activity/all-changes", "OrderedCollection"},
+		StartIndex:   page * pageSize,
+		OrderedItems: []ActivityDocument{},
+	}
+	if page > 0 {
+		p.Prev = &Reference{fmt.Sprintf("%s/activity/page/%d", base, page-1), "OrderedCollectionPage"}
+	}
+	if (page+1)*pageSize < total {
+		p.Next = &Reference{fmt.Sprintf("%s/activity/page/%d", base, page+1), "OrderedCollectionPage"}
+	}
+
+	for _, a := range activities {
+		object := Reference{base + "/" + a.Identifier, a.Kind}
+		if a.Kind == manifestKind {
+			object.ID += "/manifest.json"
+		}
+		p.OrderedItems = append(p.OrderedItems, ActivityDocument{
+			Type:    a.Type,
+			Object:  object,
+			EndTime: a.EndTime.Format(time.RFC3339),
+		})
+	}
+
+	serveDiscovery(w, r, p)
+}
+
+func serveDiscovery(w http.ResponseWriter, r *http.Request, p interface{}) {
+	buffer, err := json.MarshalIndent(p, "", "  ")
+	if err != nil {
+		http.Error(w, "Cannot create the activities", http.StatusInternalServerError)
+		return
+	}
+
+	header := w.Header()
+	if strings.Contains(r.Header.Get("Accept"), "application/ld+json") {
+		header.Set("Content-Type", fmt.Sprintf("application/ld+json;profile=%q", "https://www.w3.org/ns/activitystreams"))
+	} else {
+		header.Set("Content-Type", "application/json")
+	}
+	header.Set("Access-Control-Allow-Origin", "*")
+	w.Write(buffer)
+}
+
+func discoveryPageSize(config *Config) int {
+	if config.Discovery.PageSize > 0 {
+		return config.Discovery.PageSize
+	}
+	return defaultPageSize
+}
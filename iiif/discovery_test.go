@@ -0,0 +1,159 @@
+package iiif
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestDiscovery(t *testing.T) {
+	images, err := ioutil.TempDir("", "iiif-images")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(images)
+
+	book := filepath.Join(images, "book")
+	if err = os.Mkdir(book, 0755); err != nil {
+		log.Fatal(err)
+	}
+	for _, name := range []string{"book/1.jpg", "book/2.jpg", "cover.png", "notes.txt"} {
+		if err = ioutil.WriteFile(filepath.Join(images, name), []byte{}, 0644); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	config := &Config{
+		Images: images,
+		Discovery: DiscoveryConfig{
+			Log:      filepath.Join(images, ".activities.log"),
+			PageSize: 2,
+		},
+	}
+
+	d, err := NewDiscovery(config)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	scan := func(d *Discovery) []Activity {
+		before, _ := d.Activities(0, 0)
+		if err := d.Scan(); err != nil {
+			log.Fatal(err)
+		}
+		total, activities := d.Activities(before, before+100)
+		if total != before+len(activities) {
+			t.Errorf("unexpected total %v", total)
+		}
+		return activities
+	}
+
+	activities := scan(d)
+	if len(activities) != 4 {
+		t.Fatalf("four creations were expected, got %#v", activities)
+	}
+	if a := activities[3]; a.Type != "Create" || a.Kind != manifestKind || a.Identifier != "book" {
+		t.Errorf("the manifest was expected last, got %#v", a)
+	}
+
+	later := time.Now().Add(time.Minute)
+	if err = os.Chtimes(filepath.Join(book, "2.jpg"), later, later); err != nil {
+		log.Fatal(err)
+	}
+	if err = os.Remove(filepath.Join(images, "cover.png")); err != nil {
+		log.Fatal(err)
+	}
+
+	activities = scan(d)
+	expected := []Activity{
+		{Type: "Update", Kind: imageKind, Identifier: "book/2.jpg"},
+		{Type: "Delete", Kind: imageKind, Identifier: "cover.png"},
+		{Type: "Update", Kind: manifestKind, Identifier: "book"},
+	}
+	if len(activities) != len(expected) {
+		t.Fatalf("got %#v want %#v", activities, expected)
+	}
+	for i, a := range activities {
+		if a.Type != expected[i].Type || a.Kind != expected[i].Kind || a.Identifier != expected[i].Identifier {
+			t.Errorf("got %#v want %#v", a, expected[i])
+		}
+	}
+
+	// The log keeps the states.
+	d, err = NewDiscovery(config)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if activities = scan(d); len(activities) != 0 {
+		t.Errorf("no changes were expected, got %#v", activities)
+	}
+
+	ts := httptest.NewServer(WithDiscovery(WithConfig(MakeRouter(), config), d))
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL + "/activity/all-changes")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	var c OrderedCollection
+	if err = json.NewDecoder(resp.Body).Decode(&c); err != nil {
+		log.Fatal(err)
+	}
+	if c.TotalItems != 7 || c.Last.ID != ts.URL+"/activity/page/3" {
+		t.Errorf("unexpected collection %#v", c)
+	}
+
+	resp, err = http.Get(ts.URL + "/activity/page/1")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	var p OrderedCollectionPage
+	if err = json.NewDecoder(resp.Body).Decode(&p); err != nil {
+		log.Fatal(err)
+	}
+	if p.StartIndex != 2 || len(p.OrderedItems) != 2 || p.Prev == nil || p.Next == nil {
+		t.Errorf("unexpected page %#v", p)
+	}
+	if object := p.OrderedItems[1].Object; object.ID != ts.URL+"/book/manifest.json" || object.Type != "Manifest" {
+		t.Errorf("unexpected object %#v", object)
+	}
+
+	resp, err = http.Get(ts.URL + "/activity/page/4")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("a missing page expected a 404, got %v", resp.StatusCode)
+	}
+
+	// The watcher drives the scans.
+	config.Watcher = NewWatcher(config)
+	stop := make(chan struct{})
+	defer close(stop)
+	go d.Watch(stop)
+
+	if err = ioutil.WriteFile(filepath.Join(images, "cover.png"), []byte{}, 0644); err != nil {
+		log.Fatal(err)
+	}
+	if err = config.Watcher.Scan(); err != nil {
+		log.Fatal(err)
+	}
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(50 * time.Millisecond) {
+		if total, _ := d.Activities(0, 0); total == 8 {
+			break
+		} else if time.Now().After(deadline) {
+			t.Fatalf("the creation wasn't found, got %d activities", total)
+		}
+	}
+}
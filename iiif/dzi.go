@@ -0,0 +1,273 @@
+package iiif
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/golang/groupcache"
+	"github.com/gorilla/mux"
+)
+
+// error messages
+var dziTileError = "The Deep Zoom tile %v/%v_%v doesn't exist"
+
+// defaultDZIFormat is the format of the Deep Zoom tiles.
+const defaultDZIFormat = "jpg"
+
+// DZI describes the Deep Zoom image.
+type DZI struct {
+	XMLName  xml.Name `xml:"http://schemas.microsoft.com/deepzoom/2008 Image"`
+	Format   string   `xml:"Format,attr"`
+	Overlap  int      `xml:"Overlap,attr"`
+	TileSize int      `xml:"TileSize,attr"`
+	Size     DZISize  `xml:"Size"`
+}
+
+// DZISize contains the dimensions of the Deep Zoom image.
+type DZISize struct {
+	Width  int `xml:"Width,attr"`
+	Height int `xml:"Height,attr"`
+}
+
+// DZIHandler responds with the Deep Zoom descriptor of the image.
+func DZIHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	identifier, err := url.QueryUnescape(vars["identifier"])
+	if err != nil {
+		log.Printf("Filename is frob %#v", identifier)
+		serveError(w, r, HTTPError{http.StatusNotFound, identifier})
+		return
+	}
+
+	serveDZI(w, r, identifier)
+}
+
+// DZITileHandler responds with a tile of the Deep Zoom image.
+func DZITileHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	identifier, err := url.QueryUnescape(vars["identifier"])
+	if err != nil {
+		log.Printf("Filename is frob %#v", identifier)
+		serveError(w, r, HTTPError{http.StatusNotFound, identifier})
+		return
+	}
+
+	level, _ := strconv.Atoi(vars["level"])
+	col, _ := strconv.Atoi(vars["col"])
+	row, _ := strconv.Atoi(vars["row"])
+
+	serveDZITile(w, r, identifier, level, col, row, vars["format"])
+}
+
+func serveDZI(w http.ResponseWriter, r *http.Request, identifier string) {
+	ctx := r.Context()
+	config, _ := ctx.Value(ContextKey("config")).(*Config)
+	images, _ := ctx.Value(ContextKey("images")).(*groupcache.Group)
+
+	identifier = strings.Replace(identifier, "../", "", -1)
+
+	etag, done := sourceETag(w, r, url.QueryEscape(identifier), config, images)
+	if done {
+		return
+	}
+
+	size, modTime, err := loadImageSize(identifier, config, images)
+	if err != nil {
+		serveError(w, r, err)
+		return
+	}
+
+	tileSize, overlap, format := dziSettings(config)
+	p := DZI{
+		Format:   format,
+		Overlap:  overlap,
+		TileSize: tileSize,
+		Size: DZISize{
+			Width:  size.Width,
+			Height: size.Height,
+		},
+	}
+
+	buffer, err := xml.MarshalIndent(p, "", "  ")
+	if err != nil {
+		serveError(w, r, HTTPError{http.StatusInternalServerError, "Cannot create descriptor"})
+		return
+	}
+	buffer = append([]byte(xml.Header), buffer...)
+
+	header := w.Header()
+	header.Set("Content-Type", "application/xml")
+	header.Set("Access-Control-Allow-Origin", "*")
+	header.Set("ETag", etag)
+	header.Set("Cache-Control", fmt.Sprintf("max-age=%v, public", config.Cache.HTTP))
+	http.ServeContent(w, r, "image.dzi", *modTime, bytes.NewReader(buffer))
+}
+
+func serveDZITile(w http.ResponseWriter, r *http.Request, identifier string, level, col, row int, format string) {
+	ctx := r.Context()
+	config, _ := ctx.Value(ContextKey("config")).(*Config)
+	images, _ := ctx.Value(ContextKey("images")).(*groupcache.Group)
+
+	identifier = strings.Replace(identifier, "../", "", -1)
+
+	size, _, err := loadImageSize(identifier, config, images)
+	if err != nil {
+		serveError(w, r, err)
+		return
+	}
+
+	tileSize, overlap, _ := dziSettings(config)
+	region, tile, ok := dziTile(size.Width, size.Height, tileSize, overlap, level, col, row)
+	if !ok {
+		message := fmt.Sprintf(dziTileError, level, col, row)
+		serveError(w, r, HTTPError{http.StatusNotFound, message})
+		return
+	}
+
+	serveTile(w, r, identifier, region, tile, format, 0)
+}
+
+// serveTile responds with the image of the IIIF request made of the region
+// and size, padded to a square of pad pixels unless it's zero. It's sharing
+// the thumbnails cache with ImageHandler.
+func serveTile(w http.ResponseWriter, r *http.Request, identifier, region, size, format string, pad int) {
+	ctx := r.Context()
+	config, _ := ctx.Value(ContextKey("config")).(*Config)
+	images, _ := ctx.Value(ContextKey("images")).(*groupcache.Group)
+	thumbnails, _ := ctx.Value(ContextKey("thumbnails")).(*groupcache.Group)
+
+	vars := map[string]string{
+		"identifier": identifier,
+		"region":     region,
+		"size":       size,
+		"rotation":   "0",
+		"quality":    "default",
+		"format":     format,
+		"encoding":   "",
+		"watermark":  watermarkRule(r, identifier, config),
+	}
+	if pad > 0 {
+		vars["pad"] = strconv.Itoa(pad)
+	}
+
+	watermarkHeaders(w, r, identifier, config)
+
+	// The cache key is the path of the IIIF request, and the fingerprint of
+	// the source.
+	path := fmt.Sprintf("/%s/%s/%s/0/default.%s", identifier, region, size, format)
+	sURL := (&url.URL{Path: path}).EscapedPath()
+	if vars["watermark"] != "" {
+		sURL += "#watermark=" + vars["watermark"]
+	}
+	if vars["pad"] != "" {
+		sURL += "#pad=" + vars["pad"]
+	}
+	if tag, modTime, err := sourceTag(identifier, config, images); err == nil {
+		sURL += "@" + tag
+		if checkPreconditions(w, r, getETag(sURL), modTime, config) {
+			return
+		}
+	}
+
+	buffer, modTime, err := loadThumbnail(sURL, vars, config, images, thumbnails)
+	if err != nil {
+		if !servePlaceholder(w, r, vars, err) {
+			serveError(w, r, err)
+		}
+		return
+	}
+
+	header := w.Header()
+	header.Set("Access-Control-Allow-Origin", "*")
+	header.Set("ETag", getETag(sURL))
+	if header.Get("Cache-Control") == "" {
+		header.Set("Cache-Control", fmt.Sprintf("max-age=%v, public", config.Cache.HTTP))
+	}
+	http.ServeContent(w, r, "tile."+format, modTime, bytes.NewReader(buffer))
+}
+
+// dziTile gives the IIIF region of the tile, in the full image, and its size.
+// The level 0 is a single pixel, the last one the full image.
+func dziTile(width, height, tileSize, overlap, level, col, row int) (string, string, bool) {
+	maxLevel := int(math.Ceil(math.Log2(math.Max(float64(width), float64(height)))))
+	if level < 0 || level > maxLevel {
+		return "", "", false
+	}
+
+	sf := 1 << uint(maxLevel-level)
+	w, h := scaled(width, sf), scaled(height, sf)
+
+	x, tw, ok := dziSpan(w, tileSize, overlap, col)
+	if !ok {
+		return "", "", false
+	}
+	y, th, ok := dziSpan(h, tileSize, overlap, row)
+	if !ok {
+		return "", "", false
+	}
+
+	region, size := tileRegion(width, height, w, h, sf, x, y, tw, th)
+	return region, size, true
+}
+
+// tileRegion gives the IIIF region and size of the tile at x, y of the given
+// level, sf being its scale factor. The tiles of the last row and column are
+// reaching the edges of the full image.
+func tileRegion(width, height, levelWidth, levelHeight, sf, x, y, tw, th int) (string, string) {
+	rx, ry := x*sf, y*sf
+	rw, rh := tw*sf, th*sf
+	if x+tw >= levelWidth || rx+rw > width {
+		rw = width - rx
+	}
+	if y+th >= levelHeight || ry+rh > height {
+		rh = height - ry
+	}
+
+	region := fmt.Sprintf("%d,%d,%d,%d", rx, ry, rw, rh)
+	if rw == width && rh == height {
+		region = "full"
+	}
+
+	// The canonical size, as used by the IIIF viewers, unless its height
+	// is rounded differently, see handleSizeAndRegion.
+	size := fmt.Sprintf("%d,", tw)
+	if int(float64(tw)/(float64(rw)/float64(rh))) != th {
+		size = fmt.Sprintf("%d,%d", tw, th)
+	}
+	return region, size
+}
+
+// dziSpan gives the position and length of the n-th tile along a side of the
+// given length, the overlap is added on the inner sides.
+func dziSpan(length, tileSize, overlap, n int) (int, int, bool) {
+	start := n * tileSize
+	if n < 0 || start >= length {
+		return 0, 0, false
+	}
+
+	end := int(math.Min(float64(start+tileSize+overlap), float64(length)))
+	if n > 0 {
+		start -= overlap
+	}
+	return start, end - start, true
+}
+
+func dziSettings(config *Config) (int, int, string) {
+	c := config.DZI
+	tileSize := c.TileSize
+	if tileSize == 0 {
+		tileSize = defaultTileSize
+	}
+	format := c.Format
+	if format == "" {
+		format = defaultDZIFormat
+	}
+	return tileSize, c.Overlap, format
+}
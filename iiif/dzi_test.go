@@ -0,0 +1,108 @@
+package iiif
+
+import (
+	"encoding/xml"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"testing"
+
+	"gopkg.in/h2non/bimg.v1"
+)
+
+func TestDZITile(t *testing.T) {
+	var tests = []struct {
+		level  int
+		col    int
+		row    int
+		region string
+		size   string
+		ok     bool
+	}{
+		{12, 0, 0, "0,0,257,257", "257,", true},
+		{12, 4, 9, "1023,2303,61,15", "61,", true},
+		{0, 0, 0, "full", "1,1", true},
+		{13, 0, 0, "", "", false},
+		{12, 5, 0, "", "", false},
+		{12, 0, -1, "", "", false},
+	}
+
+	for _, test := range tests {
+		region, size, ok := dziTile(1084, 2318, 256, 1, test.level, test.col, test.row)
+		if region != test.region || size != test.size || ok != test.ok {
+			t.Errorf("%v/%v_%v: got %#v %#v %v want %#v %#v %v", test.level, test.col, test.row, region, size, ok, test.region, test.size, test.ok)
+		}
+	}
+}
+
+func TestDZI(t *testing.T) {
+	ts := newServer()
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL + "/lena.jpg.dzi")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	var dzi DZI
+	err = xml.NewDecoder(resp.Body).Decode(&dzi)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if dzi.TileSize != 256 || dzi.Overlap != 0 || dzi.Format != "jpg" {
+		t.Errorf("unexpected tiling %#v", dzi)
+	}
+	if dzi.Size.Width != 1084 || dzi.Size.Height != 2318 {
+		t.Errorf("unexpected size %vx%v", dzi.Size.Width, dzi.Size.Height)
+	}
+}
+
+func TestDZITiles(t *testing.T) {
+	ts := newServer()
+	defer ts.Close()
+
+	var tests = []struct {
+		url    string
+		status int
+		width  int
+		height int
+	}{
+		{"/lena.jpg_files/12/0_0.jpg", http.StatusOK, 256, 256},
+		{"/lena.jpg_files/12/4_9.png", http.StatusOK, 60, 14},
+		{"/lena.jpg_files/11/0_0.jpg", http.StatusOK, 256, 256},
+		{"/lena.jpg_files/0/0_0.png", http.StatusOK, 1, 1},
+		{"/lena.jpg_files/13/0_0.jpg", http.StatusNotFound, 0, 0},
+		{"/lena.jpg_files/12/5_0.jpg", http.StatusNotFound, 0, 0},
+	}
+
+	for _, test := range tests {
+		resp, err := http.Get(ts.URL + test.url)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode != test.status {
+			t.Errorf("%v: got the status %v want %v", test.url, resp.StatusCode, test.status)
+			continue
+		}
+		if test.status != http.StatusOK {
+			continue
+		}
+
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		size, err := bimg.NewImage(body).Size()
+		if err != nil {
+			log.Fatal(err)
+		}
+		if size.Width != test.width || size.Height != test.height {
+			t.Errorf("%v: got %vx%v want %vx%v", test.url, size.Width, size.Height, test.width, test.height)
+		}
+	}
+}
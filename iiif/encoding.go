@@ -0,0 +1,230 @@
+package iiif
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"gopkg.in/h2non/bimg.v1"
+)
+
+// error messages
+var encodingError = "The encoding parameter `%s` is not recognized: %#v"
+var encodingRangeError = "The encoding parameter `%s` is out of the limits %v-%v: %v"
+var encoderError = "The %s %s %#v is not supported"
+
+// subsamplingModes are the libvips VipsForeignSubsample values.
+var subsamplingModes = map[string]int{
+	"auto": 0,
+	"on":   1,
+	"off":  2,
+}
+
+// tiffCompressions are the libvips VipsForeignTiffCompression values.
+var tiffCompressions = map[string]int{
+	"none":     0,
+	"jpeg":     1,
+	"deflate":  2,
+	"packbits": 3,
+	"lzw":      5,
+	"webp":     6,
+	"zstd":     7,
+}
+
+// defaults of the TIFF output.
+const (
+	defaultEncoderQuality = bimg.Quality
+	defaultTIFFTileSize   = 256
+)
+
+// vipsEncoder holds the settings bimg doesn't expose, the JPEG chroma
+// subsampling and the TIFF compression and tiling. The output is then saved
+// by libvips directly, see vipsSave.
+type vipsEncoder struct {
+	Type        bimg.ImageType
+	Quality     int
+	Interlace   bool
+	Strip       bool
+	Subsampling int
+	Compression int
+	Tile        bool
+	TileSize    int
+}
+
+// encodingParams are the query parameters that may override the encoder
+// settings when the configuration allows it.
+var encodingParams = []string{"compression", "lossless", "palette", "progressive", "quality"}
+
+// canonicalEncoding keeps only the known encoding parameters of the query
+// string. The result is sorted by key so it can be part of the cache key.
+func canonicalEncoding(query url.Values, config *Config) string {
+	if !config.Encoding.Overrides {
+		return ""
+	}
+
+	values := url.Values{}
+	for _, k := range encodingParams {
+		if v := query.Get(k); v != "" {
+			values.Set(k, v)
+		}
+	}
+	return values.Encode()
+}
+
+// handleEncoding builds the encoder options for the given output type from
+// the configuration, and the canonical overrides (see canonicalEncoding).
+func handleEncoding(encoding string, imageType bimg.ImageType, config *Config) (bimg.Options, error) {
+	c := config.Encoding
+	opts := bimg.Options{
+		Type:          imageType,
+		StripMetadata: c.StripMetadata,
+	}
+
+	minQuality, maxQuality := c.MinQuality, c.MaxQuality
+	if minQuality == 0 {
+		minQuality = 1
+	}
+	if maxQuality == 0 {
+		maxQuality = 100
+	}
+
+	switch imageType {
+	case bimg.JPEG:
+		opts.Quality = c.JPEG.Quality
+		opts.Interlace = c.JPEG.Progressive
+	case bimg.PNG:
+		opts.Compression = c.PNG.Compression
+		opts.Interlace = c.PNG.Interlace
+		opts.Palette = c.PNG.Palette
+	case bimg.WEBP:
+		opts.Quality = c.WebP.Quality
+		opts.Lossless = c.WebP.Lossless
+	case bimg.TIFF:
+		opts.Quality = c.TIFF.Quality
+	}
+
+	query, err := url.ParseQuery(encoding)
+	if err != nil {
+		message := fmt.Sprintf(encodingError, "query", encoding)
+		return opts, ParameterError{HTTPError{http.StatusBadRequest, message}, "query"}
+	}
+
+	for k := range query {
+		v := query.Get(k)
+		switch k {
+		case "quality":
+			q, err := parseRange(k, v, minQuality, maxQuality)
+			if err != nil {
+				return opts, err
+			}
+			opts.Quality = q
+		case "compression":
+			n, err := parseRange(k, v, 1, 9)
+			if err != nil {
+				return opts, err
+			}
+			opts.Compression = n
+		case "progressive":
+			opts.Interlace, err = parseBool(k, v)
+		case "palette":
+			opts.Palette, err = parseBool(k, v)
+		case "lossless":
+			opts.Lossless, err = parseBool(k, v)
+		default:
+			message := fmt.Sprintf(encodingError, k, v)
+			err = ParameterError{HTTPError{http.StatusBadRequest, message}, k}
+		}
+		if err != nil {
+			return opts, err
+		}
+	}
+
+	return opts, nil
+}
+
+// handleEncoder gives the libvips encoder of the options when they need
+// settings bimg doesn't expose, nil otherwise.
+func handleEncoder(opts bimg.Options, config *Config) (*vipsEncoder, error) {
+	c := config.Encoding
+	e := &vipsEncoder{
+		Type:      opts.Type,
+		Quality:   opts.Quality,
+		Interlace: opts.Interlace,
+		Strip:     opts.StripMetadata,
+	}
+	if e.Quality == 0 {
+		e.Quality = defaultEncoderQuality
+	}
+
+	switch opts.Type {
+	case bimg.JPEG:
+		if c.JPEG.Subsampling == "" || c.JPEG.Subsampling == "auto" {
+			return nil, nil
+		}
+		mode, ok := subsamplingModes[c.JPEG.Subsampling]
+		if !ok {
+			message := fmt.Sprintf(encoderError, "JPEG", "subsampling", c.JPEG.Subsampling)
+			return nil, HTTPError{http.StatusInternalServerError, message}
+		}
+		e.Subsampling = mode
+	case bimg.TIFF:
+		if (c.TIFF.Compression == "" || c.TIFF.Compression == "none") && !c.TIFF.Tile {
+			return nil, nil
+		}
+		compression, ok := tiffCompressions[c.TIFF.Compression]
+		if !ok && c.TIFF.Compression != "" {
+			message := fmt.Sprintf(encoderError, "TIFF", "compression", c.TIFF.Compression)
+			return nil, HTTPError{http.StatusInternalServerError, message}
+		}
+		e.Compression = compression
+		e.Tile = c.TIFF.Tile
+		e.TileSize = c.TIFF.TileSize
+		if e.TileSize == 0 {
+			e.TileSize = defaultTIFFTileSize
+		}
+	default:
+		return nil, nil
+	}
+
+	return e, nil
+}
+
+// intermediate turns the encoder options into the ones of a pass followed by
+// others, saving a lossless image (an uncompressed TIFF, or else a PNG) so that
+// the output is only encoded once.
+func intermediate(opts bimg.Options) bimg.Options {
+	opts.Type = bimg.PNG
+	if bimg.IsTypeSupportedSave(bimg.TIFF) {
+		opts.Type = bimg.TIFF
+	}
+	opts.Quality = 0
+	opts.Compression = 1
+	opts.Interlace = false
+	opts.Palette = false
+	opts.Lossless = false
+	opts.StripMetadata = false
+	return opts
+}
+
+func parseRange(key, value string, min, max int) (int, error) {
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		message := fmt.Sprintf(encodingError, key, value)
+		return 0, ParameterError{HTTPError{http.StatusBadRequest, message}, key}
+	}
+	if n < min || n > max {
+		message := fmt.Sprintf(encodingRangeError, key, min, max, n)
+		return 0, ParameterError{HTTPError{http.StatusBadRequest, message}, key}
+	}
+	return n, nil
+}
+
+func parseBool(key, value string) (bool, error) {
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		message := fmt.Sprintf(encodingError, key, value)
+		return false, ParameterError{HTTPError{http.StatusBadRequest, message}, key}
+	}
+	return b, nil
+}
@@ -1,8 +1,17 @@
 package iiif
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
+	"html/template"
+	"io/ioutil"
+	"log"
+	"mime"
 	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
 )
 
 // HTTPError represents a HTTP error to be shown to the user.
@@ -15,3 +24,147 @@ type HTTPError struct {
 func (e HTTPError) Error() string {
 	return fmt.Sprintf("%d (%s) %s", e.StatusCode, http.StatusText(e.StatusCode), e.Message)
 }
+
+// ParameterError represents a HTTP error caused by a parameter of the
+// request, e.g. the size of the image.
+type ParameterError struct {
+	HTTPError
+	Parameter string
+}
+
+// ErrorResponse is the machine-readable error, Code being either the status
+// (e.g. not_found) or telling what's wrong with the parameter (e.g.
+// invalid_size).
+type ErrorResponse struct {
+	Status    int    `json:"status"`
+	Code      string `json:"code"`
+	Parameter string `json:"parameter,omitempty"`
+	Message   string `json:"message"`
+}
+
+// newErrorResponse describes the error, the ones not meant for the user
+// being a not found.
+func newErrorResponse(err error) *ErrorResponse {
+	var e HTTPError
+	parameter := ""
+	switch t := err.(type) {
+	case ParameterError:
+		e, parameter = t.HTTPError, t.Parameter
+	case HTTPError:
+		e = t
+	default:
+		e = HTTPError{http.StatusNotFound, err.Error()}
+	}
+
+	code := strings.ToLower(strings.Replace(http.StatusText(e.StatusCode), " ", "_", -1))
+	if parameter != "" {
+		if e.StatusCode == http.StatusNotImplemented {
+			code = "unsupported_" + parameter
+		} else {
+			code = "invalid_" + parameter
+		}
+	} else if code == "" {
+		code = "error"
+	}
+
+	return &ErrorResponse{
+		Status:    e.StatusCode,
+		Code:      code,
+		Parameter: parameter,
+		Message:   e.Message,
+	}
+}
+
+// StatusText gives the text of the status, e.g. Not Found.
+func (e *ErrorResponse) StatusText() string {
+	return http.StatusText(e.Status)
+}
+
+// serveError responds with the error as the client accepts it: JSON, the
+// error.html template, the placeholder image or, by default, plain text.
+func serveError(w http.ResponseWriter, r *http.Request, err error) {
+	e := newErrorResponse(err)
+	config, _ := r.Context().Value(ContextKey("config")).(*Config)
+
+	header := w.Header()
+	header.Del("ETag")
+	header.Del("Last-Modified")
+	header.Del("Cache-Control")
+	header.Add("Vary", "Accept")
+
+	offers := []string{"application/json", "application/ld+json", "text/html"}
+	if config != nil && config.Errors.Placeholder != "" {
+		offers = append(offers, "image/*")
+	}
+
+	switch negotiate(r.Header.Get("Accept"), offers...) {
+	case "application/json", "application/ld+json":
+		buffer, err := json.MarshalIndent(e, "", "  ")
+		if err != nil {
+			break
+		}
+		header.Set("Content-Type", "application/json")
+		header.Set("Access-Control-Allow-Origin", "*")
+		header.Set("X-Content-Type-Options", "nosniff")
+		w.WriteHeader(e.Status)
+		w.Write(buffer)
+		return
+	case "text/html":
+		if config == nil {
+			break
+		}
+		var buffer bytes.Buffer
+		tpl := filepath.Join(config.Templates, "error.html")
+		t, err := template.ParseFiles(tpl)
+		if err == nil {
+			err = t.Execute(&buffer, e)
+		}
+		if err != nil {
+			log.Printf("Cannot render the error page: %s", err)
+			break
+		}
+		header.Set("Content-Type", "text/html; charset=utf-8")
+		w.WriteHeader(e.Status)
+		w.Write(buffer.Bytes())
+		return
+	case "image/*":
+		buffer, err := ioutil.ReadFile(config.Errors.Placeholder)
+		if err != nil {
+			log.Printf("Cannot read the placeholder: %s", err)
+			break
+		}
+		header.Set("Content-Type", http.DetectContentType(buffer))
+		w.WriteHeader(e.Status)
+		w.Write(buffer)
+		return
+	}
+
+	http.Error(w, HTTPError{e.Status, e.Message}.Error(), e.Status)
+}
+
+// negotiate gives the offer preferred by the Accept header, if any. The
+// wildcards aren't considered, while the image/* offer matches any image
+// type.
+func negotiate(accept string, offers ...string) string {
+	best, bestQ := "", 0.
+	for _, offer := range offers {
+		for _, part := range strings.Split(accept, ",") {
+			mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+			if err != nil || mediaType == "*/*" {
+				continue
+			}
+			if mediaType != offer && !(offer == "image/*" && strings.HasPrefix(mediaType, "image/")) {
+				continue
+			}
+
+			q := 1.
+			if value, ok := params["q"]; ok {
+				q, _ = strconv.ParseFloat(value, 64)
+			}
+			if q > bestQ {
+				best, bestQ = offer, q
+			}
+		}
+	}
+	return best
+}
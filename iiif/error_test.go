@@ -0,0 +1,114 @@
+package iiif
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestNegotiate(t *testing.T) {
+	offers := []string{"application/json", "text/html", "image/*"}
+
+	var tests = []struct {
+		accept string
+		offer  string
+	}{
+		{"", ""},
+		{"*/*", ""},
+		{"application/json", "application/json"},
+		{"text/html,application/xhtml+xml,application/xml;q=0.9,image/webp,*/*;q=0.8", "text/html"},
+		{"image/webp,image/apng,image/*,*/*;q=0.8", "image/*"},
+		{"text/html;q=0.5, application/json", "application/json"},
+		{"application/json;q=0", ""},
+	}
+
+	for _, test := range tests {
+		if offer := negotiate(test.accept, offers...); offer != test.offer {
+			t.Errorf("%#v: got %#v want %#v", test.accept, offer, test.offer)
+		}
+	}
+}
+
+func TestErrorResponses(t *testing.T) {
+	ts := newServerWithConfig(&Config{
+		Errors: ErrorsConfig{
+			Placeholder: "../fixtures/lena.jpg",
+		},
+	})
+	defer ts.Close()
+
+	var tests = []struct {
+		url         string
+		accept      string
+		status      int
+		contentType string
+	}{
+		{"/lena.jpg/full/10/0/default.png", "", http.StatusBadRequest, "text/plain"},
+		{"/lena.jpg/full/10/0/default.png", "application/json", http.StatusBadRequest, "application/json"},
+		{"/lena.jpg/full/10/0/default.png", "text/html", http.StatusBadRequest, "text/html"},
+		{"/lena.jpg/full/10/0/default.png", "image/webp,image/*", http.StatusBadRequest, "image/jpeg"},
+		{"/missing.jpg/info.json", "application/ld+json", http.StatusNotFound, "application/json"},
+		{"/missing.jpg/openseadragon.html", "text/html", http.StatusNotFound, "text/html"},
+		{"/lena.jpg/missing.html", "text/html", http.StatusNotFound, "text/html"},
+		{"/missing.jpg/manifest.json", "application/json", http.StatusNotFound, "application/json"},
+		{"/missing.jpg/tiles.json", "application/json", http.StatusNotFound, "application/json"},
+		{"/missing.jpg.dzi", "text/html", http.StatusNotFound, "text/html"},
+		{"/collection/missing", "application/json", http.StatusNotFound, "application/json"},
+		{"/missing.jpg/tiles/0/0/0.png", "image/png", http.StatusNotFound, "image/jpeg"},
+		{"/missing.jpg/metadata.json", "", http.StatusNotFound, "text/plain"},
+	}
+
+	for _, test := range tests {
+		req, err := http.NewRequest("GET", ts.URL+test.url, nil)
+		if err != nil {
+			log.Fatal(err)
+		}
+		req.Header.Set("Accept", test.accept)
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode != test.status {
+			t.Errorf("%s (%s): got %v want %v", test.url, test.accept, resp.StatusCode, test.status)
+		}
+		if contentType := resp.Header.Get("Content-Type"); !strings.HasPrefix(contentType, test.contentType) {
+			t.Errorf("%s (%s): got %v want %v", test.url, test.accept, contentType, test.contentType)
+		}
+	}
+}
+
+func TestErrorResponse(t *testing.T) {
+	ts := newServer()
+	defer ts.Close()
+
+	req, err := http.NewRequest("GET", ts.URL+"/lena.jpg/full/10/0/default.png", nil)
+	if err != nil {
+		log.Fatal(err)
+	}
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var e ErrorResponse
+	if err = json.Unmarshal(body, &e); err != nil {
+		t.Fatalf("a JSON error was expected, got %s", body)
+	}
+	if e.Status != http.StatusBadRequest || e.Code != "invalid_size" || e.Parameter != "size" || e.Message == "" {
+		t.Errorf("unexpected error %#v", e)
+	}
+}
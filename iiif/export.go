@@ -0,0 +1,200 @@
+package iiif
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+)
+
+// defaultExportFormat is the format of the exported images.
+const defaultExportFormat = "jpg"
+
+// Export writes info.json, and every tile and size it advertises, of the
+// identifiers below the output directory, following the paths of MakeRouter.
+// The images are the ones the server gives, see resizeImage. The progress is
+// called for each identifier, one at a time.
+func Export(config *Config, identifiers []string, progress func(identifier string, files int, err error)) error {
+	c := config.Export
+	if c.Output == "" {
+		return fmt.Errorf("the output directory is not configured")
+	}
+
+	format := c.Format
+	if format == "" {
+		format = defaultExportFormat
+	}
+	tileSize := c.TileSize
+	if tileSize == 0 {
+		tileSize = defaultTileSize
+	}
+
+	for _, identifier := range identifiers {
+		identifier = strings.Replace(identifier, "../", "", -1)
+		files, err := exportImage(identifier, format, tileSize, config)
+		if progress != nil {
+			progress(identifier, files, err)
+		}
+	}
+	return nil
+}
+
+// exportImage writes the info.json and images of the identifier, it returns
+// the number of files written.
+func exportImage(identifier, format string, tileSize int, config *Config) (int, error) {
+	base := strings.TrimRight(config.Export.BaseURL, "/")
+	image, _, err := newImage(identifier, base+"/"+identifier, config, nil)
+	if err != nil {
+		return 0, err
+	}
+
+	level0(image, format, tileSize)
+
+	dir := filepath.Join(config.Export.Output, filepath.FromSlash(identifier))
+	if err = os.MkdirAll(dir, 0755); err != nil {
+		return 0, err
+	}
+
+	buffer, err := json.MarshalIndent(image, "", "  ")
+	if err != nil {
+		return 0, err
+	}
+	if err = ioutil.WriteFile(filepath.Join(dir, "info.json"), buffer, 0644); err != nil {
+		return 0, err
+	}
+
+	requests := level0Requests(image)
+
+	jobs := make(chan [2]string)
+	errs := make(chan error, len(requests))
+
+	var wg sync.WaitGroup
+	for i := 0; i < runtime.NumCPU(); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for r := range jobs {
+				errs <- exportFile(identifier, r[0], r[1], format, dir, config)
+			}
+		}()
+	}
+
+	for _, r := range requests {
+		jobs <- r
+	}
+	close(jobs)
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			return 0, err
+		}
+	}
+	return len(requests) + 1, nil
+}
+
+// exportFile writes the image of the given region and size.
+func exportFile(identifier, region, size, format, dir string, config *Config) error {
+	vars := map[string]string{
+		"identifier": identifier,
+		"region":     region,
+		"size":       size,
+		"rotation":   "0",
+		"quality":    "default",
+		"format":     format,
+		"encoding":   "",
+		"watermark":  matchWatermark(identifier, config),
+		"focus":      canonicalFocus(identifier, region, config),
+	}
+
+	image, err := resizeImage(config, vars, nil)
+	if err != nil {
+		return fmt.Errorf("%s/%s: %s", region, size, err)
+	}
+
+	path := filepath.Join(dir, region, size, "0")
+	if err = os.MkdirAll(path, 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(path, "default."+format), image.Buffer, 0644)
+}
+
+// level0 turns the description into the static one, only the tiles and
+// sizes are available.
+func level0(image *Image, format string, tileSize int) {
+	image.Profile = []interface{}{
+		"http://iiif.io/api/image/2/level0.json",
+		&ImageProfile{
+			Context:   "http://iiif.io/api/image/2/context.json",
+			Type:      "iiif:ImageProfile",
+			Formats:   []string{format},
+			Qualities: []string{"default"},
+		},
+	}
+
+	var scaleFactors []int
+	image.Sizes = nil
+	for sf := 1; ; sf *= 2 {
+		scaleFactors = append(scaleFactors, sf)
+		w, h := scaled(image.Width, sf), scaled(image.Height, sf)
+		image.Sizes = append([]Size{{Width: w, Height: h}}, image.Sizes...)
+		if w <= tileSize && h <= tileSize {
+			break
+		}
+	}
+
+	image.Tiles = []Tile{{
+		ScaleFactors: scaleFactors,
+		Width:        tileSize,
+		Height:       tileSize,
+	}}
+}
+
+// level0Requests lists the canonical region and size of the sizes and tiles
+// of the description, see level0.
+func level0Requests(image *Image) [][2]string {
+	seen := make(map[[2]string]bool)
+	var requests [][2]string
+	add := func(region, size string) {
+		r := [2]string{region, size}
+		if !seen[r] {
+			seen[r] = true
+			requests = append(requests, r)
+		}
+	}
+
+	for _, s := range image.Sizes {
+		add("full", fmt.Sprintf("%d,", s.Width))
+	}
+
+	for _, tile := range image.Tiles {
+		for _, sf := range tile.ScaleFactors {
+			w, h := tile.Width*sf, tile.Height*sf
+			for y := 0; y < image.Height; y += h {
+				for x := 0; x < image.Width; x += w {
+					rw := int(math.Min(float64(w), float64(image.Width-x)))
+					rh := int(math.Min(float64(h), float64(image.Height-y)))
+
+					region := fmt.Sprintf("%d,%d,%d,%d", x, y, rw, rh)
+					if rw == image.Width && rh == image.Height {
+						region = "full"
+					}
+					add(region, fmt.Sprintf("%d,", scaled(rw, sf)))
+				}
+			}
+		}
+	}
+
+	return requests
+}
+
+// scaled divides the length by the scale factor, rounding up.
+func scaled(n, sf int) int {
+	return int(math.Ceil(float64(n) / float64(sf)))
+}
@@ -0,0 +1,111 @@
+package iiif
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestLevel0(t *testing.T) {
+	image := &Image{Width: 300, Height: 200}
+	level0(image, "jpg", 256)
+
+	sizes := []Size{{Width: 150, Height: 100}, {Width: 300, Height: 200}}
+	if !reflect.DeepEqual(image.Sizes, sizes) {
+		t.Errorf("got the sizes %v want %v", image.Sizes, sizes)
+	}
+	if len(image.Tiles) != 1 || !reflect.DeepEqual(image.Tiles[0].ScaleFactors, []int{1, 2}) {
+		t.Errorf("unexpected tiles %#v", image.Tiles)
+	}
+
+	requests := [][2]string{
+		{"full", "150,"},
+		{"full", "300,"},
+		{"0,0,256,200", "256,"},
+		{"256,0,44,200", "44,"},
+	}
+	if r := level0Requests(image); !reflect.DeepEqual(r, requests) {
+		t.Errorf("got the requests %v want %v", r, requests)
+	}
+}
+
+func TestExport(t *testing.T) {
+	output, err := ioutil.TempDir("", "iiif-export")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(output)
+
+	config := &Config{
+		Images: "../fixtures",
+		Export: ExportConfig{
+			BaseURL:  "https://example.org/iiif/",
+			Output:   output,
+			TileSize: 256,
+		},
+		// The exports are watermarked like the served images.
+		Watermark: WatermarkConfig{
+			Rules: []WatermarkRule{
+				{Pattern: "lena.jpg", Image: "../fixtures/images/test.png", MinSize: 500},
+			},
+		},
+	}
+
+	err = Export(config, []string{"lena.jpg"}, func(identifier string, files int, err error) {
+		if err != nil {
+			t.Errorf("%v couldn't be exported: %v", identifier, err)
+		}
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	buffer, err := ioutil.ReadFile(filepath.Join(output, "lena.jpg", "info.json"))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var m Image
+	if err = json.Unmarshal(buffer, &m); err != nil {
+		log.Fatal(err)
+	}
+	if m.ID != "https://example.org/iiif/lena.jpg" {
+		t.Errorf("unexpected @id %#v", m.ID)
+	}
+	if m.Profile[0] != "http://iiif.io/api/image/2/level0.json" {
+		t.Errorf("unexpected profile %#v", m.Profile[0])
+	}
+
+	// The tiles are the ones of the server.
+	ts := newServerWithConfig(config)
+	defer ts.Close()
+
+	for _, r := range level0Requests(&m) {
+		path := "/lena.jpg/" + r[0] + "/" + r[1] + "/0/default.jpg"
+		exported, err := ioutil.ReadFile(filepath.Join(output, filepath.FromSlash(path)))
+		if err != nil {
+			t.Errorf("%v is missing", path)
+			continue
+		}
+
+		resp, err := http.Get(ts.URL + path)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer resp.Body.Close()
+		served, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		if !bytes.Equal(exported, served) {
+			t.Errorf("%v differs from the served one", path)
+		}
+	}
+}
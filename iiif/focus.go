@@ -0,0 +1,407 @@
+package iiif
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/color"
+	// The previews are read as PNG, or JPEG when bimg gives them as is.
+	_ "image/jpeg"
+	_ "image/png"
+	"io/ioutil"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/gorilla/mux"
+	"gopkg.in/h2non/bimg.v1"
+)
+
+// error messages
+var focusInvalidError = "Invalid focus: %s"
+
+// focusPreviewSize is the size of the previews given to the detectors.
+const focusPreviewSize = 256
+
+// the default detector, which leaves the smart crops to libvips.
+const defaultDetector = "attention"
+
+// Focus is the focal point of an image, or its box when W and H are set, in
+// percents of its size.
+type Focus struct {
+	X float64 `json:"x"`
+	Y float64 `json:"y"`
+	W float64 `json:"w,omitempty"`
+	H float64 `json:"h,omitempty"`
+}
+
+// validate checks that the focus is within the image.
+func (f *Focus) validate() error {
+	if f.X < 0 || f.Y < 0 || f.W < 0 || f.H < 0 || f.X+f.W > 100 || f.Y+f.H > 100 {
+		message := fmt.Sprintf(focusInvalidError, "not within the image")
+		return HTTPError{http.StatusBadRequest, message}
+	}
+	return nil
+}
+
+// String gives the focus as a percent region, e.g. pct:40,10,20,30.
+func (f *Focus) String() string {
+	return fmt.Sprintf("pct:%g,%g,%g,%g", f.X, f.Y, f.W, f.H)
+}
+
+// Detector finds the focus of an image, e.g. a face, for the smart crops
+// when none is stored. The preview is at most focusPreviewSize pixels wide
+// or high. A nil focus leaves the crop to libvips.
+type Detector interface {
+	Detect(preview image.Image) (*Focus, error)
+}
+
+// detectors are the registered detectors, by name.
+var detectors = struct {
+	sync.RWMutex
+	m map[string]Detector
+}{m: map[string]Detector{
+	defaultDetector: attentionDetector{},
+	"entropy":       entropyDetector{},
+}}
+
+// RegisterDetector makes the detector available to the configuration, under
+// the name.
+func RegisterDetector(name string, detector Detector) {
+	detectors.Lock()
+	defer detectors.Unlock()
+	detectors.m[name] = detector
+}
+
+// findDetector gives the detector of the name, if any.
+func findDetector(name string) (Detector, bool) {
+	detectors.RLock()
+	defer detectors.RUnlock()
+	detector, ok := detectors.m[name]
+	return detector, ok
+}
+
+// attentionDetector relies on the smart crop of libvips, which looks for the
+// skin tones, the saturated colours and the edges.
+type attentionDetector struct{}
+
+// Detect gives no focus, bimg.GravitySmart being used.
+func (attentionDetector) Detect(preview image.Image) (*Focus, error) {
+	return nil, nil
+}
+
+// entropyDetector focuses on the busiest part of the image, i.e. whose
+// luminance has the highest entropy.
+type entropyDetector struct{}
+
+// Detect gives the center of the cell, and its neighbours, having the highest
+// entropy.
+func (entropyDetector) Detect(preview image.Image) (*Focus, error) {
+	bounds := preview.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	cell := maxInt(1, minInt(width, height)/16)
+	cols, rows := (width+cell-1)/cell, (height+cell-1)/cell
+	if cols == 0 || rows == 0 {
+		return nil, nil
+	}
+
+	histograms := make([][16]int, cols*rows)
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			gray := color.GrayModel.Convert(preview.At(bounds.Min.X+x, bounds.Min.Y+y)).(color.Gray)
+			histograms[(y/cell)*cols+x/cell][gray.Y>>4]++
+		}
+	}
+
+	entropies := make([]float64, len(histograms))
+	for i, histogram := range histograms {
+		total := 0
+		for _, n := range histogram {
+			total += n
+		}
+		for _, n := range histogram {
+			if n > 0 {
+				p := float64(n) / float64(total)
+				entropies[i] -= p * math.Log2(p)
+			}
+		}
+	}
+
+	best, bestX, bestY := -1., 0, 0
+	for row := 0; row < rows; row++ {
+		for col := 0; col < cols; col++ {
+			sum := 0.
+			for j := maxInt(0, row-1); j <= minInt(rows-1, row+1); j++ {
+				for i := maxInt(0, col-1); i <= minInt(cols-1, col+1); i++ {
+					sum += entropies[j*cols+i]
+				}
+			}
+			if sum > best {
+				best, bestX, bestY = sum, col, row
+			}
+		}
+	}
+
+	return &Focus{
+		X: math.Min(100, (float64(bestX)+.5)*float64(cell)/float64(width)*100),
+		Y: math.Min(100, (float64(bestY)+.5)*float64(cell)/float64(height)*100),
+	}, nil
+}
+
+// canonicalFocus gives what steers the square and smart crops of the
+// identifier, for the request vars: the stored focus, or the detector of the
+// smart crops. It's empty when libvips decides.
+func canonicalFocus(identifier, region string, config *Config) string {
+	if region != "square" && region != "smart" {
+		return ""
+	}
+
+	if unescaped, err := url.QueryUnescape(identifier); err == nil {
+		identifier = unescaped
+	}
+	identifier = strings.Replace(identifier, "../", "", -1)
+
+	sidecar, err := readSidecar(identifier, config.Images)
+	if err != nil {
+		log.Printf("Cannot read the sidecar of %#v: %s", identifier, err)
+	}
+	if sidecar.Focus != nil {
+		return sidecar.Focus.String()
+	}
+
+	if region == "smart" && config.Focus.Detector != "" && config.Focus.Detector != defaultDetector {
+		return config.Focus.Detector
+	}
+	return ""
+}
+
+// handleFocus rewrites the square or smart region as the pixel region around
+// the focus, when there is one. The width and height are the ones of the
+// oriented image.
+func handleFocus(img *bimg.Image, vars map[string]string, width, height int, config *Config) (string, error) {
+	region, focus := vars["region"], vars["focus"]
+	if focus == "" || (region != "square" && region != "smart") {
+		return region, nil
+	}
+
+	var f *Focus
+	if strings.HasPrefix(focus, "pct:") {
+		box := strings.Split(focus[4:], ",")
+		if len(box) != 4 {
+			return region, nil
+		}
+		f = &Focus{}
+		for i, p := range []*float64{&f.X, &f.Y, &f.W, &f.H} {
+			*p, _ = strconv.ParseFloat(box[i], 64)
+		}
+	} else {
+		detector, ok := findDetector(focus)
+		if !ok {
+			log.Printf("Unknown detector %#v", focus)
+			return region, nil
+		}
+
+		options := bimg.Options{
+			Type:         bimg.PNG,
+			NoAutoRotate: !autoOrient(config),
+		}
+		if width > height {
+			options.Width = focusPreviewSize
+		} else {
+			options.Height = focusPreviewSize
+		}
+		buffer, err := bimg.NewImage(img.Image()).Process(options)
+		if err != nil {
+			return region, err
+		}
+		preview, _, err := image.Decode(bytes.NewReader(buffer))
+		if err != nil {
+			return region, err
+		}
+		f, err = detector.Detect(preview)
+		if err != nil || f == nil {
+			return region, err
+		}
+	}
+
+	return focusRegion(f, region, vars["size"], width, height), nil
+}
+
+// focusRegion gives the largest pixel region of the image centered on the
+// focus, squared or of the ratio of the size. A smart region of another size
+// isn't cropped.
+func focusRegion(f *Focus, region, size string, width, height int) string {
+	ratio := 1.
+	if region == "smart" {
+		sizes := strings.Split(strings.TrimPrefix(size, "!"), ",")
+		if len(sizes) != 2 {
+			return region
+		}
+		w, errW := strconv.Atoi(sizes[0])
+		h, errH := strconv.Atoi(sizes[1])
+		if errW != nil || errH != nil || w <= 0 || h <= 0 {
+			return region
+		}
+		ratio = float64(w) / float64(h)
+	}
+
+	w, h := width, height
+	if float64(width)/float64(height) > ratio {
+		w = maxInt(1, int(math.Round(float64(height)*ratio)))
+	} else {
+		h = maxInt(1, int(math.Round(float64(width)/ratio)))
+	}
+
+	x := (f.X + f.W/2) / 100 * float64(width)
+	y := (f.Y + f.H/2) / 100 * float64(height)
+	left := maxInt(0, minInt(width-w, int(math.Round(x-float64(w)/2))))
+	top := maxInt(0, minInt(height-h, int(math.Round(y-float64(h)/2))))
+
+	return fmt.Sprintf("%d,%d,%d,%d", left, top, w, h)
+}
+
+// FocusHandler reads (GET), sets (PUT) or removes (DELETE) the focus of a
+// local image, stored in its sidecar. The changes are an administration
+// interface to be protected, e.g. by a proxy, and only enabled by the
+// configuration.
+func FocusHandler(w http.ResponseWriter, r *http.Request) {
+	config, _ := r.Context().Value(ContextKey("config")).(*Config)
+	identifier, err := url.QueryUnescape(mux.Vars(r)["identifier"])
+	if err != nil {
+		serveError(w, r, HTTPError{http.StatusNotFound, identifier})
+		return
+	}
+	identifier = strings.Replace(identifier, "../", "", -1)
+	if _, _, ok := localPage(identifier, config); !ok {
+		serveError(w, r, HTTPError{http.StatusNotFound, identifier})
+		return
+	}
+
+	if !config.Focus.Admin {
+		w.Header().Set("Allow", "GET, HEAD")
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			serveError(w, r, HTTPError{http.StatusMethodNotAllowed, http.StatusText(http.StatusMethodNotAllowed)})
+			return
+		}
+	} else {
+		w.Header().Set("Allow", "GET, HEAD, PUT, DELETE")
+	}
+
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		sidecar, err := readSidecar(identifier, config.Images)
+		if err != nil {
+			log.Printf("Cannot read the sidecar of %#v: %s", identifier, err)
+		}
+		if sidecar.Focus == nil {
+			serveError(w, r, HTTPError{http.StatusNotFound, identifier})
+			return
+		}
+		serveFocus(w, r, sidecar.Focus)
+	case http.MethodPut:
+		focus := &Focus{}
+		body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, 1<<10))
+		if err == nil {
+			err = json.Unmarshal(body, focus)
+		}
+		if err != nil {
+			serveError(w, r, HTTPError{http.StatusBadRequest, fmt.Sprintf(focusInvalidError, err)})
+			return
+		}
+		if err = focus.validate(); err != nil {
+			serveError(w, r, HTTPError{http.StatusBadRequest, err.Error()})
+			return
+		}
+		if err = writeFocus(identifier, config.Images, focus); err != nil {
+			log.Printf("Cannot write the sidecar of %#v: %s", identifier, err)
+			serveError(w, r, HTTPError{http.StatusInternalServerError, "Cannot store the focus"})
+			return
+		}
+		serveFocus(w, r, focus)
+	case http.MethodDelete:
+		if err := writeFocus(identifier, config.Images, nil); err != nil {
+			log.Printf("Cannot write the sidecar of %#v: %s", identifier, err)
+			serveError(w, r, HTTPError{http.StatusInternalServerError, "Cannot remove the focus"})
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		serveError(w, r, HTTPError{http.StatusMethodNotAllowed, http.StatusText(http.StatusMethodNotAllowed)})
+	}
+}
+
+// serveFocus responds with the focus as JSON.
+func serveFocus(w http.ResponseWriter, r *http.Request, focus *Focus) {
+	buffer, err := json.MarshalIndent(focus, "", "  ")
+	if err != nil {
+		serveError(w, r, HTTPError{http.StatusInternalServerError, "Cannot create the focus"})
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Write(buffer)
+}
+
+// focusLock serializes the changes of the sidecars.
+var focusLock sync.Mutex
+
+// writeFocus sets, or removes when nil, the focus of the sidecar of the
+// image, its other properties being kept. An empty sidecar is removed.
+func writeFocus(identifier string, root string, focus *Focus) error {
+	focusLock.Lock()
+	defer focusLock.Unlock()
+
+	filename := filepath.Join(root, identifier) + ".json"
+	properties := make(map[string]json.RawMessage)
+	data, err := ioutil.ReadFile(filename)
+	if err == nil {
+		err = json.Unmarshal(data, &properties)
+	}
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	if focus == nil {
+		delete(properties, "focus")
+	} else {
+		properties["focus"], err = json.Marshal(focus)
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(properties) == 0 {
+		err = os.Remove(filename)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	data, err = json.MarshalIndent(properties, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(filename), ".iiif-*.json")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	if e := tmp.Close(); err == nil {
+		err = e
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), filename)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
@@ -0,0 +1,176 @@
+package iiif
+
+import (
+	"encoding/json"
+	"image"
+	"image/color"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestFocusRegion(t *testing.T) {
+	var tests = []struct {
+		focus  Focus
+		region string
+		size   string
+		result string
+	}{
+		{Focus{X: 50, Y: 50}, "square", "max", "250,0,500,500"},
+		{Focus{X: 0, Y: 0}, "square", "max", "0,0,500,500"},
+		{Focus{X: 90, Y: 10}, "square", "200,", "500,0,500,500"},
+		{Focus{X: 20, Y: 10, W: 10, H: 20}, "square", "max", "0,0,500,500"},
+		{Focus{X: 50, Y: 50}, "smart", "100,100", "250,0,500,500"},
+		{Focus{X: 70, Y: 50}, "smart", "!200,100", "0,0,1000,500"},
+		{Focus{X: 70, Y: 50}, "smart", "100,200", "575,0,250,500"},
+		{Focus{X: 70, Y: 50}, "smart", "100,", "smart"},
+	}
+
+	for _, test := range tests {
+		if result := focusRegion(&test.focus, test.region, test.size, 1000, 500); result != test.result {
+			t.Errorf("%v %s %s: got %#v want %#v", test.focus, test.region, test.size, result, test.result)
+		}
+	}
+}
+
+func TestEntropyDetector(t *testing.T) {
+	// A flat image with some noise in its bottom-right corner.
+	img := image.NewGray(image.Rect(0, 0, 160, 80))
+	for y := 60; y < 80; y++ {
+		for x := 130; x < 160; x++ {
+			img.SetGray(x, y, color.Gray{uint8((x * 37) ^ (y * 91))})
+		}
+	}
+
+	focus, err := entropyDetector{}.Detect(img)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if focus == nil || focus.X < 75 || focus.Y < 65 {
+		t.Errorf("got %v, want the bottom-right corner", focus)
+	}
+}
+
+func TestCanonicalFocus(t *testing.T) {
+	images, err := ioutil.TempDir("", "iiif-images")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(images)
+
+	if err = ioutil.WriteFile(filepath.Join(images, "portrait.jpg.json"), []byte(`{"focus": {"x": 40, "y": 10, "w": 20, "h": 30}}`), 0644); err != nil {
+		log.Fatal(err)
+	}
+
+	config := &Config{Images: images, Focus: FocusConfig{Detector: "entropy"}}
+
+	var tests = []struct {
+		identifier string
+		region     string
+		focus      string
+	}{
+		{"portrait.jpg", "full", ""},
+		{"portrait.jpg", "square", "pct:40,10,20,30"},
+		{"portrait.jpg", "smart", "pct:40,10,20,30"},
+		{"landscape.jpg", "square", ""},
+		{"landscape.jpg", "smart", "entropy"},
+	}
+
+	for _, test := range tests {
+		if focus := canonicalFocus(test.identifier, test.region, config); focus != test.focus {
+			t.Errorf("%s %s: got %#v want %#v", test.identifier, test.region, focus, test.focus)
+		}
+	}
+}
+
+func TestFocusHandler(t *testing.T) {
+	images, err := ioutil.TempDir("", "iiif-images")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(images)
+
+	sidecar := filepath.Join(images, "portrait.jpg.json")
+	if err = ioutil.WriteFile(filepath.Join(images, "portrait.jpg"), []byte{}, 0644); err != nil {
+		log.Fatal(err)
+	}
+	if err = ioutil.WriteFile(sidecar, []byte(`{"license": "CC0"}`), 0644); err != nil {
+		log.Fatal(err)
+	}
+
+	config := &Config{Images: images, Focus: FocusConfig{Admin: true}}
+	ts := httptest.NewServer(WithConfig(MakeRouter(), config))
+	defer ts.Close()
+
+	do := func(method, identifier, body string) int {
+		req, err := http.NewRequest(method, ts.URL+"/"+identifier+"/focus.json", strings.NewReader(body))
+		if err != nil {
+			log.Fatal(err)
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			log.Fatal(err)
+		}
+		res.Body.Close()
+		return res.StatusCode
+	}
+
+	var tests = []struct {
+		method     string
+		identifier string
+		body       string
+		status     int
+	}{
+		{"GET", "portrait.jpg", "", http.StatusNotFound},
+		{"PUT", "missing.jpg", `{"x": 50, "y": 20}`, http.StatusNotFound},
+		{"PUT", "portrait.jpg", `{"x": 90, "y": 20, "w": 20}`, http.StatusBadRequest},
+		{"PUT", "portrait.jpg", `{"x": 50, "y": 20}`, http.StatusOK},
+		{"GET", "portrait.jpg", "", http.StatusOK},
+		{"POST", "portrait.jpg", "", http.StatusMethodNotAllowed},
+	}
+
+	for _, test := range tests {
+		if status := do(test.method, test.identifier, test.body); status != test.status {
+			t.Errorf("%s %s: got %d want %d", test.method, test.identifier, status, test.status)
+		}
+	}
+
+	s, err := readSidecar("portrait.jpg", images)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.License != "CC0" || s.Focus == nil || s.Focus.X != 50 || s.Focus.Y != 20 {
+		t.Errorf("The sidecar wasn't kept: %#v", s)
+	}
+
+	if status := do("DELETE", "portrait.jpg", ""); status != http.StatusNoContent {
+		t.Errorf("DELETE: got %d", status)
+	}
+	data, err := ioutil.ReadFile(sidecar)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var properties map[string]interface{}
+	if err = json.Unmarshal(data, &properties); err != nil || len(properties) != 1 {
+		t.Errorf("The focus wasn't removed: %s", data)
+	}
+
+	config.Focus.Admin = false
+	if status := do("PUT", "portrait.jpg", `{"x": 10, "y": 20}`); status != http.StatusMethodNotAllowed {
+		t.Errorf("disabled PUT: got %d", status)
+	}
+	if status := do("DELETE", "portrait.jpg", ""); status != http.StatusMethodNotAllowed {
+		t.Errorf("disabled DELETE: got %d", status)
+	}
+	if err := writeFocus("portrait.jpg", images, &Focus{X: 10, Y: 20}); err != nil {
+		t.Fatal(err)
+	}
+	if status := do("GET", "portrait.jpg", ""); status != http.StatusOK {
+		t.Errorf("disabled GET: got %d", status)
+	}
+}
@@ -9,7 +9,6 @@ import (
 	"net/http"
 	"net/url"
 	"os"
-	"path/filepath"
 	"strconv"
 	"strings"
 	"time"
@@ -29,6 +28,7 @@ var rotationMissing = "libvips cannot rotate angle that isn't a multiple of 90:
 var formatError = "IIIF 2.1 `format` argument is not yet recognized: %#v"
 var formatMissing = "libvips cannot output this format %#v as of yet"
 var formatReadMissing = "libvips cannot read this format %#v as of yet"
+var remoteError = "%#v is not a remote image"
 
 func resizeImage(config *Config, vars map[string]string, cache *groupcache.Group) (*CroppedImage, error) {
 	identifier := vars["identifier"]
@@ -55,53 +55,76 @@ func resizeImage(config *Config, vars map[string]string, cache *groupcache.Group
 
 	if !bimg.IsTypeSupportedSave(bimgType) {
 		message := fmt.Sprintf(formatMissing, format)
-		return nil, HTTPError{http.StatusNotImplemented, message}
+		return nil, ParameterError{HTTPError{http.StatusNotImplemented, message}, "format"}
 	}
 
 	// Open image
-	loadedImage, err := openImage(identifier, config.Images, cache)
+	// ----------
+	// The documents and pyramids are read at the resolution matching the
+	// requested size, the request is then rewritten to apply to it.
+	loadedImage, err := openImage(identifier, config, cache, vars)
 	if err != nil {
-		e, ok := err.(HTTPError)
-		if ok {
-			return nil, e
+		switch err.(type) {
+		case HTTPError, ParameterError:
+			return nil, err
 		}
 		return nil, HTTPError{http.StatusNotFound, identifier}
 	}
+	if loadedImage.Vars != nil {
+		vars = loadedImage.Vars
+	}
 
 	image := loadedImage.Image
-	size, err := image.Size()
+	size, oriented, err := orientedSize(image, config)
 	if err != nil {
 		message := fmt.Sprintf(openError, err.Error())
 		return nil, HTTPError{http.StatusBadRequest, message}
 	}
 
-	options := bimg.Options{
-		Width:  size.Width,
-		Height: size.Height,
-		Type:   bimgType,
-	}
-
-	// Size & Region
-	// ----
-	// Bimg handles the zooming before the cropping
-	err = handleSizeAndRegion(vars["size"], vars["region"], config, &options)
+	// Encoding
+	// --------
+	encoding, err := handleEncoding(vars["encoding"], bimgType, config)
 	if err != nil {
 		return nil, err
 	}
-
-	// Quality
-	// -------
-	err = handleQuality(vars["quality"], &options)
+	encoder, err := handleEncoder(encoding, config)
 	if err != nil {
 		return nil, err
 	}
 
-	_, err = image.Process(options)
+	options := encoding
+	options.Width = size.Width
+	options.Height = size.Height
+
+	// Orientation
+	// -----------
+	// bimg applies the EXIF orientation before anything else, the region
+	// is thus expressed in the oriented image. The orientation of the output
+	// is reset at the end so that the viewers don't rotate it twice.
+	options.NoAutoRotate = !autoOrient(config)
+
+	// Focus
+	// -----
+	// The square and smart regions are cropped around the focus, if any.
+	region, err := handleFocus(image, vars, size.Width, size.Height, config)
 	if err != nil {
-		message := fmt.Sprintf("bimg couldn't process the image: %#v", err.Error())
+		message := fmt.Sprintf("Cannot find the focus of the image: %#v", err.Error())
 		return nil, HTTPError{http.StatusInternalServerError, message}
 	}
 
+	// Size & Region
+	// ----
+	// Bimg handles the zooming before the cropping
+	err = handleSizeAndRegion(vars["size"], region, config, &options)
+	if err != nil {
+		return nil, err
+	}
+	rendered := renderedSize(options, size)
+
+	// Colour management
+	// -----------------
+	handleColor(config, &options)
+
 	// Rotation
 	// --------
 	// n angle clockwise in degrees
@@ -113,26 +136,115 @@ func resizeImage(config *Config, vars map[string]string, cache *groupcache.Group
 
 	if err != nil {
 		message := fmt.Sprintf(rotationError, rotation)
-		return nil, HTTPError{http.StatusBadRequest, message}
+		return nil, ParameterError{HTTPError{http.StatusBadRequest, message}, "rotation"}
 	} else if angle%90 != 0 {
 		message := fmt.Sprintf(rotationMissing, rotation)
-		return nil, HTTPError{http.StatusNotImplemented, message}
+		return nil, ParameterError{HTTPError{http.StatusNotImplemented, message}, "rotation"}
 	}
 
-	if flip || angle != 0 {
-		options = bimg.Options{
-			Flip:   flip,
-			Rotate: bimg.Angle(angle),
-		}
-		_, err = image.Process(options)
+	// The second pass works on pixels that are already in the output
+	// colour space.
+	final := encoding
+	final.NoAutoRotate = true
+	final.Flip = flip
+	final.Rotate = bimg.Angle(angle)
+
+	// Quality
+	// -------
+	quality := vars["quality"]
+	if quality == adjustQuality && config.Adjustments.Enabled {
+		quality = "default"
+	}
+	err = handleQuality(quality, &final)
+	if err != nil {
+		return nil, err
+	}
+
+	final.NoProfile = config.Color.StripProfile || final.Interpretation == bimg.InterpretationBW
+
+	// The passes followed by others save a lossless intermediate, the output
+	// being encoded once by the last one, or by libvips for the settings
+	// bimg doesn't expose.
+	second := flip || angle != 0 || final.Interpretation != 0 || final.NoProfile
+	overlays := vars["adjust"] != "" || vars["watermark"] != "" || vars["pad"] != ""
+	if second || overlays || encoder != nil {
+		options = intermediate(options)
+	}
+	if overlays || encoder != nil {
+		final = intermediate(final)
+	}
+
+	_, err = image.Process(options)
+	if err != nil {
+		message := fmt.Sprintf("bimg couldn't process the image: %#v", err.Error())
+		return nil, HTTPError{http.StatusInternalServerError, message}
+	}
+
+	if second {
+		_, err = image.Process(final)
 		if err != nil {
 			message := fmt.Sprintf("bimg couldn't process the image: %#v", err.Error())
 			return nil, HTTPError{http.StatusInternalServerError, message}
 		}
 	}
 
+	// The next passes work on the output, as is.
+	encoded := encoding
+	encoded.NoAutoRotate = true
+	encoded.Interpretation = final.Interpretation
+	encoded.NoProfile = final.NoProfile
+	overlay := intermediate(encoded)
+
+	// Adjustments
+	// -----------
+	err = handleAdjustments(image, vars["adjust"], overlay)
+	if err != nil {
+		if _, ok := err.(ParameterError); ok {
+			return nil, err
+		}
+		message := fmt.Sprintf("bimg couldn't adjust the image: %#v", err.Error())
+		return nil, HTTPError{http.StatusInternalServerError, message}
+	}
+
+	// Watermark
+	// ---------
+	// The overlay is composited onto the output.
+	err = handleWatermark(image, vars["watermark"], rendered, config, overlay)
+	if err != nil {
+		message := fmt.Sprintf("bimg couldn't watermark the image: %#v", err.Error())
+		return nil, HTTPError{http.StatusInternalServerError, message}
+	}
+
+	// Padding
+	// -------
+	// The edge tiles are as large as the others, transparent where
+	// possible.
+	image, err = handlePadding(image, vars["pad"], bimgType != bimg.JPEG)
+	if err != nil {
+		return nil, err
+	}
+
+		if overlays && encoder == nil {
+		_, err = image.Process(encoded)
+		if err != nil {
+			message := fmt.Sprintf("bimg couldn't encode the image: %#v", err.Error())
+			return nil, HTTPError{http.StatusInternalServerError, message}
+		}
+	}
+
+	buffer := image.Image()
+	if encoder != nil {
+		buffer, err = vipsSave(buffer, encoder)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if oriented {
+		buffer = clearOrientation(buffer)
+	}
+
 	output := &CroppedImage{
-		Buffer:  image.Image(),
+		Buffer:  buffer,
 		ModTime: loadedImage.ModTime,
 	}
 	return output, nil
@@ -153,7 +265,63 @@ func ImageHandler(w http.ResponseWriter, r *http.Request) {
 	images, _ := r.Context().Value(ContextKey("images")).(*groupcache.Group)
 	thumbnails, _ := r.Context().Value(ContextKey("thumbnails")).(*groupcache.Group)
 
-	sURL := r.URL.String()
+	vars["encoding"] = canonicalEncoding(r.URL.Query(), config)
+	vars["adjust"] = canonicalAdjustments(r.URL.Query(), quality, config)
+	vars["watermark"] = watermarkRule(r, identifier, config)
+	vars["focus"] = canonicalFocus(identifier, region, config)
+	watermarkHeaders(w, r, identifier, config)
+
+	// The cache key only keeps the query parameters altering the output, the
+	// watermark, the focus and the fingerprint of the source.
+	sURL := r.URL.EscapedPath()
+	if query := canonicalQuery(vars); query != "" {
+		sURL += "?" + query
+	}
+	if vars["watermark"] != "" {
+		sURL += "#watermark=" + vars["watermark"]
+	}
+	if vars["focus"] != "" {
+		sURL += "#focus=" + vars["focus"]
+	}
+	if tag, modTime, err := sourceTag(identifier, config, images); err == nil {
+		sURL += "@" + tag
+		if checkPreconditions(w, r, getETag(sURL), modTime, config) {
+			return
+		}
+	}
+
+	buffer, modTime, err := loadThumbnail(sURL, vars, config, images, thumbnails)
+	if err != nil {
+		if !servePlaceholder(w, r, vars, err) {
+			serveError(w, r, err)
+		}
+		return
+	}
+
+	filename := fmt.Sprintf("%v-%v-%v-%v-%v.%v", identifier, region, size, rotation, quality, format)
+	filename = strings.Replace(
+		strings.Replace(
+			strings.Replace(filename, "/", "_", -1),
+			":", "_", -1),
+		",", "", -1)
+
+	disposition := "inline"
+	_, present := r.URL.Query()["dl"]
+	if present {
+		disposition = "attachement"
+	}
+
+	w.Header().Set("Content-Disposition", fmt.Sprintf("%s; filename=%s", disposition, filename))
+	w.Header().Set("ETag", getETag(sURL))
+	if w.Header().Get("Cache-Control") == "" {
+		w.Header().Set("Cache-Control", fmt.Sprintf("max-age=%v, public", config.Cache.HTTP))
+	}
+	http.ServeContent(w, r, filename, modTime, bytes.NewReader(buffer))
+}
+
+// loadThumbnail gives the image from the thumbnails cache, sURL being its key,
+// or makes it when there is none.
+func loadThumbnail(sURL string, vars map[string]string, config *Config, images, thumbnails *groupcache.Group) ([]byte, time.Time, error) {
 	modTime := time.Now()
 
 	// Loading from GroupCache or straight up.
@@ -183,32 +351,12 @@ func ImageHandler(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	if err != nil {
-		e := err.(HTTPError)
-		http.Error(w, e.Error(), e.StatusCode)
-		return
-	}
-
-	filename := fmt.Sprintf("%v-%v-%v-%v-%v.%v", identifier, region, size, rotation, quality, format)
-	filename = strings.Replace(
-		strings.Replace(
-			strings.Replace(filename, "/", "_", -1),
-			":", "_", -1),
-		",", "", -1)
-
-	disposition := "inline"
-	_, present := r.URL.Query()["dl"]
-	if present {
-		disposition = "attachement"
-	}
-
-	w.Header().Set("Content-Disposition", fmt.Sprintf("%s; filename=%s", disposition, filename))
-	w.Header().Set("ETag", getETag(sURL))
-	w.Header().Set("Cache-Control", fmt.Sprintf("max-age=%v, public", config.Cache.HTTP))
-	http.ServeContent(w, r, filename, modTime, bytes.NewReader(buffer))
+	return buffer, modTime, err
 }
 
-func openImage(identifier string, root string, cache *groupcache.Group) (*LoadedImage, error) {
+// openImage reads the image, the request vars (if any) tell which part of it
+// is needed, see LoadedImage.
+func openImage(identifier string, config *Config, cache *groupcache.Group, vars map[string]string) (*LoadedImage, error) {
 	identifier, err := url.QueryUnescape(identifier)
 	if err != nil {
 		return nil, err
@@ -216,38 +364,54 @@ func openImage(identifier string, root string, cache *groupcache.Group) (*Loaded
 
 	identifier = strings.Replace(identifier, "../", "", -1)
 
-	filename := filepath.Join(root, identifier)
+	filename, page, ok := localPage(identifier, config)
 	stat, err := os.Stat(filename)
 	var buffer []byte
-	if err != nil {
-		var sURL string
-		if strings.HasPrefix(identifier, "http:/") || strings.HasPrefix(identifier, "https:/") {
-			sURL = strings.Replace(identifier, ":/", "://", 1)
-		} else {
-			url, err := base64.StdEncoding.DecodeString(identifier)
-			if err != nil {
-				return nil, err
-			}
-			sURL = string(url)
-		}
+	var size *bimg.ImageSize
+	modTime := time.Now()
+	if stat != nil {
+		modTime = stat.ModTime()
+	}
 
-		if cache != nil {
-			err = cache.Get(nil, sURL, groupcache.AllocatingByteSliceSink(&buffer))
-			if err != nil {
-				return nil, err
-			}
-		} else {
-			buffer, err = downloadImage(sURL)
-			if err != nil {
-				return nil, err
-			}
+	// The converted pyramid replaces the image, see Convert.
+	if derivative, found := findDerivative(filename, stat, config); ok && page < 0 && found {
+		filename = derivative
+	}
+	if !ok {
+		sURL, err := remoteURL(identifier)
+		if err != nil {
+			return nil, err
+		}
+		buffer, modTime, err = loadRemote(sURL, cache)
+		if err != nil {
+			return nil, err
+		}
+	} else if isPDF(filename) {
+		buffer, size, vars, err = openPDF(filename, page, vars, config)
+		if err != nil {
+			return nil, err
+		}
+	} else if levels := pyramidLevels(filename); page < 0 && isPyramid(levels) {
+		buffer, size, vars, err = openPyramid(filename, levels, vars, config)
+		if err != nil {
+			return nil, err
+		}
+	} else if isJP2(filename) {
+		// A JPEG 2000 without levels nor tiles is decoded as a whole.
+		buffer, err = vipsLoadFile(filename, nil)
+		if err != nil {
+			return nil, err
+		}
+	} else if page > 0 {
+		buffer, err = openPage(filename, page, 0, config)
+		if err != nil {
+			return nil, err
 		}
 	} else {
 		buffer, err = bimg.Read(filename)
 		if err != nil {
 			return nil, HTTPError{http.StatusBadRequest, err.Error()}
 		}
-
 	}
 
 	imageType := bimg.DetermineImageType(buffer)
@@ -256,29 +420,74 @@ func openImage(identifier string, root string, cache *groupcache.Group) (*Loaded
 		return nil, HTTPError{http.StatusNotImplemented, message}
 	}
 
-	modTime := time.Now()
-	if stat != nil {
-		modTime = stat.ModTime()
-	}
-
 	image := &LoadedImage{
 		Image:   bimg.NewImage(buffer),
 		ModTime: &modTime,
+		Size:    size,
+		Vars:    vars,
 	}
 	return image, nil
 }
 
-func downloadImage(url string) ([]byte, error) {
+// remoteURL gives the URL of the remote identifier, either as is or base64
+// encoded. Only the http and https URLs are remote images, the other keys of
+// the images cache (e.g. ocr:) being made by the server.
+func remoteURL(identifier string) (string, error) {
+	var sURL string
+	if strings.HasPrefix(identifier, "http:/") || strings.HasPrefix(identifier, "https:/") {
+		sURL = strings.Replace(identifier, ":/", "://", 1)
+	} else {
+		decoded, err := base64.StdEncoding.DecodeString(identifier)
+		if err != nil {
+			return "", err
+		}
+		sURL = string(decoded)
+	}
+	if !isRemote(sURL) {
+		return "", fmt.Errorf(remoteError, sURL)
+	}
+	return sURL, nil
+}
+
+// isRemote tells whether the key of the images cache is a http or https URL.
+func isRemote(key string) bool {
+	u, err := url.Parse(key)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
+
+// loadRemote gives the remote image from the images cache, or downloads it,
+// and its modification time.
+func loadRemote(sURL string, cache *groupcache.Group) ([]byte, time.Time, error) {
+	if cache == nil {
+		return downloadImage(sURL)
+	}
+
+	var image = new(CacheableImage)
+	if err := cache.Get(nil, sURL, groupcache.ProtoSink(image)); err != nil {
+		return nil, time.Time{}, err
+	}
+	var modTime time.Time
+	err := modTime.UnmarshalBinary(image.GetModTime())
+	return image.GetBuffer(), modTime, err
+}
+
+// downloadImage fetches the remote image. Its modification time is the one
+// told by the server, or the time of the download.
+func downloadImage(url string) ([]byte, time.Time, error) {
+	modTime := time.Now()
 	resp, err := http.Get(url)
 	if err != nil {
-		return nil, err
+		return nil, modTime, err
 	}
+	defer resp.Body.Close()
 	if resp.StatusCode != 200 {
-		return nil, HTTPError{resp.StatusCode, url}
+		return nil, modTime, HTTPError{resp.StatusCode, url}
+	}
+
+	if lastModified, err := http.ParseTime(resp.Header.Get("Last-Modified")); err == nil {
+		modTime = lastModified
 	}
 
-	defer resp.Body.Close()
-	// XXX deal with last-modified-since...
 	var buf []byte
 	if resp.ContentLength > 0 {
 		b := bytes.NewBuffer(make([]byte, 0, resp.ContentLength))
@@ -288,9 +497,9 @@ func downloadImage(url string) ([]byte, error) {
 		buf, err = ioutil.ReadAll(resp.Body)
 	}
 	if err != nil {
-		return nil, err
+		return nil, modTime, err
 	}
-	return buf, nil
+	return buf, modTime, nil
 }
 
 func handleSizeAndRegion(size string, region string, config *Config, opts *bimg.Options) error {
@@ -319,7 +528,7 @@ func handleSizeAndRegion(size string, region string, config *Config, opts *bimg.
 			pct, err = strconv.ParseFloat(size[4:], 64)
 			if err != nil || pct <= 0 {
 				message := fmt.Sprintf(sizeError, size)
-				return HTTPError{http.StatusBadRequest, message}
+				return ParameterError{HTTPError{http.StatusBadRequest, message}, "size"}
 			}
 		} else {
 			best = strings.HasPrefix(size, "!")
@@ -327,7 +536,7 @@ func handleSizeAndRegion(size string, region string, config *Config, opts *bimg.
 
 			if len(sizes) != 2 {
 				message := fmt.Sprintf(sizeError, size)
-				return HTTPError{http.StatusBadRequest, message}
+				return ParameterError{HTTPError{http.StatusBadRequest, message}, "size"}
 			}
 
 			w, errW := strconv.ParseInt(sizes[0], 10, 64)
@@ -335,7 +544,7 @@ func handleSizeAndRegion(size string, region string, config *Config, opts *bimg.
 
 			if errW != nil && errH != nil || (w == 0 && h == 0) {
 				message := fmt.Sprintf(sizeError, size)
-				return HTTPError{http.StatusBadRequest, message}
+				return ParameterError{HTTPError{http.StatusBadRequest, message}, "size"}
 			} else if errW == nil && errH == nil {
 				width = int(w)
 				height = int(h)
@@ -355,7 +564,7 @@ func handleSizeAndRegion(size string, region string, config *Config, opts *bimg.
 		if (config.MaxWidth != 0 && (config.MaxWidth < width || config.MaxHeight < height)) ||
 			(config.MaxArea != 0 && config.MaxArea < width*height) {
 			message := fmt.Sprintf(maxSizeError, width, height, config.MaxWidth, config.MaxHeight, config.MaxArea)
-			return HTTPError{http.StatusBadRequest, message}
+			return ParameterError{HTTPError{http.StatusBadRequest, message}, "size"}
 		}
 	}
 
@@ -426,7 +635,7 @@ func handleSizeAndRegion(size string, region string, config *Config, opts *bimg.
 
 		if len(sizes) != 4 {
 			message := fmt.Sprintf(regionError, region)
-			return HTTPError{http.StatusBadRequest, message}
+			return ParameterError{HTTPError{http.StatusBadRequest, message}, "region"}
 		}
 
 		var x, y, w, h int64
@@ -455,7 +664,7 @@ func handleSizeAndRegion(size string, region string, config *Config, opts *bimg.
 			x < 0 || y < 0 || w <= 0 || h <= 0 ||
 			int(x+w) > opts.Width || int(y+h) > opts.Height {
 			message := fmt.Sprintf(regionError, region)
-			return HTTPError{http.StatusBadRequest, message}
+			return ParameterError{HTTPError{http.StatusBadRequest, message}, "region"}
 		}
 
 		if width == 0 || height == 0 {
@@ -504,15 +713,16 @@ func handleQuality(quality string, opts *bimg.Options) error {
 		// do nothing.
 		return nil
 	} else if quality == "gray" {
-		opts.Interpretation = bimg.InterpretationGREY16
+		// 8-bit luminance, computed in linear light by libvips.
+		opts.Interpretation = bimg.InterpretationBW
 		return nil
 	} else if quality == "bitonal" {
 		message := fmt.Sprintf(qualityError, quality)
-		return HTTPError{http.StatusNotImplemented, message}
+		return ParameterError{HTTPError{http.StatusNotImplemented, message}, "quality"}
 	}
 
 	message := fmt.Sprintf(qualityError, quality)
-	return HTTPError{http.StatusBadRequest, message}
+	return ParameterError{HTTPError{http.StatusBadRequest, message}, "quality"}
 }
 
 func computeSize(width, height int, config *Config) (int, int) {
@@ -5,6 +5,7 @@ import (
 	"log"
 	"net/http"
 	"net/url"
+	"reflect"
 	"testing"
 
 	"gopkg.in/h2non/bimg.v1"
@@ -229,3 +230,242 @@ func TestFailing(t *testing.T) {
 		}
 	}
 }
+
+func TestEncoding(t *testing.T) {
+	ts := newServerWithConfig(&Config{
+		Encoding: EncodingConfig{
+			Overrides:  true,
+			MinQuality: 10,
+			MaxQuality: 90,
+			JPEG: JPEGConfig{
+				Quality: 90,
+			},
+		},
+	})
+	defer ts.Close()
+
+	var tests = []struct {
+		url    string
+		status int
+	}{
+		{"/lena.jpg/full/max/0/default.jpg", http.StatusOK},
+		{"/lena.jpg/full/max/0/default.jpg?quality=10", http.StatusOK},
+		{"/lena.jpg/full/max/0/default.jpg?quality=10&progressive=true", http.StatusOK},
+		{"/lena.jpg/full/max/0/default.png?compression=9&palette=1", http.StatusOK},
+		{"/lena.jpg/full/max/0/default.webp?lossless=true", http.StatusOK},
+		{"/lena.jpg/full/max/0/default.jpg?quality=5", http.StatusBadRequest},
+		{"/lena.jpg/full/max/0/default.jpg?quality=95", http.StatusBadRequest},
+		{"/lena.jpg/full/max/0/default.jpg?quality=high", http.StatusBadRequest},
+		{"/lena.jpg/full/max/0/default.png?compression=10", http.StatusBadRequest},
+		{"/lena.jpg/full/max/0/default.jpg?progressive=maybe", http.StatusBadRequest},
+	}
+
+	lengths := make(map[string]int)
+	for _, test := range tests {
+		url := ts.URL + test.url
+		resp, err := http.Get(url)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		if status := resp.StatusCode; status != test.status {
+			t.Errorf("handler returned wrong status code: got %v want %v for %v", status, test.status, test.url)
+			return
+		}
+		lengths[test.url] = len(body)
+	}
+
+	if lengths["/lena.jpg/full/max/0/default.jpg"] <= lengths["/lena.jpg/full/max/0/default.jpg?quality=10"] {
+		t.Errorf("a lower quality should produce a smaller JPEG")
+	}
+}
+
+func TestIntermediate(t *testing.T) {
+	options := intermediate(bimg.Options{
+		Type:           bimg.JPEG,
+		Quality:        80,
+		Interlace:      true,
+		StripMetadata:  true,
+		Width:          100,
+		Interpretation: bimg.InterpretationBW,
+	})
+	if options.Type == bimg.JPEG || options.Quality != 0 || options.Interlace || options.StripMetadata {
+		t.Errorf("a lossless intermediate was expected, got %#v", options)
+	}
+	if options.Width != 100 || options.Interpretation != bimg.InterpretationBW {
+		t.Errorf("the processing was expected to be kept, got %#v", options)
+	}
+}
+
+func TestEncoder(t *testing.T) {
+	config := &Config{
+		Encoding: EncodingConfig{
+			JPEG: JPEGConfig{Subsampling: "off"},
+			TIFF: TIFFConfig{Compression: "deflate", Tile: true},
+		},
+	}
+
+	var tests = []struct {
+		imageType bimg.ImageType
+		encoder   *vipsEncoder
+	}{
+		{bimg.JPEG, &vipsEncoder{Type: bimg.JPEG, Quality: defaultEncoderQuality, Subsampling: 2}},
+		{bimg.TIFF, &vipsEncoder{Type: bimg.TIFF, Quality: defaultEncoderQuality, Compression: 2, Tile: true, TileSize: defaultTIFFTileSize}},
+		{bimg.PNG, nil},
+	}
+
+	for _, test := range tests {
+		encoder, err := handleEncoder(bimg.Options{Type: test.imageType}, config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(encoder, test.encoder) {
+			t.Errorf("unexpected encoder for %v: got %#v want %#v", test.imageType, encoder, test.encoder)
+		}
+	}
+
+	// bimg encodes by itself the default settings.
+	encoder, _ := handleEncoder(bimg.Options{Type: bimg.JPEG}, &Config{})
+	if encoder != nil {
+		t.Errorf("no encoder was expected, got %#v", encoder)
+	}
+
+	config.Encoding.TIFF.Compression = "rle"
+	_, err := handleEncoder(bimg.Options{Type: bimg.TIFF}, config)
+	if err == nil {
+		t.Errorf("an unknown compression was expected to fail")
+	}
+}
+
+func TestEncoderOutput(t *testing.T) {
+	ts := newServerWithConfig(&Config{
+		Encoding: EncodingConfig{
+			JPEG: JPEGConfig{Quality: 90, Subsampling: "off"},
+			TIFF: TIFFConfig{Compression: "deflate", Tile: true},
+		},
+	})
+	defer ts.Close()
+
+	var tests = []struct {
+		url       string
+		imageType bimg.ImageType
+	}{
+		{"/lena.jpg/full/max/0/default.jpg", bimg.JPEG},
+		{"/lena.jpg/full/max/90/gray.jpg", bimg.JPEG},
+		{"/lena.jpg/full/max/0/default.tif", bimg.TIFF},
+	}
+
+	for _, test := range tests {
+		resp, err := http.Get(ts.URL + test.url)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		if status := resp.StatusCode; status != http.StatusOK {
+			t.Errorf("handler returned wrong status code: got %v want %v for %v\nmessage: %s", status, http.StatusOK, test.url, string(body))
+			continue
+		}
+		if imageType := bimg.DetermineImageType(body); imageType != test.imageType {
+			t.Errorf("unexpected image type for %v: got %v want %v", test.url, imageType, test.imageType)
+		}
+	}
+}
+
+func TestGrayQuality(t *testing.T) {
+	ts := newServer()
+	defer ts.Close()
+
+	var tests = []string{
+		"/lena.jpg/full/max/0/gray.png",
+		"/lena.jpg/full/max/90/gray.jpg",
+	}
+
+	for _, test := range tests {
+		resp, err := http.Get(ts.URL + test)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		if status := resp.StatusCode; status != http.StatusOK {
+			t.Errorf("handler returned wrong status code: got %v want %v\nmessage: %s", status, http.StatusOK, string(body))
+			return
+		}
+
+		metadata, err := bimg.NewImage(body).Metadata()
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		if metadata.Space != "b-w" || metadata.Profile {
+			t.Errorf("%v expected to be 8-bit gray without a profile: got %v (profile %v)", test, metadata.Space, metadata.Profile)
+		}
+	}
+}
+
+func TestAutoOrient(t *testing.T) {
+	ts := newServerWithConfig(&Config{})
+	defer ts.Close()
+
+	var tests = []struct {
+		url    string
+		status int
+		width  int
+		height int
+	}{
+		{"/orientation.jpg/full/max/0/default.jpg", http.StatusOK, 200, 300},
+		{"/orientation.jpg/full/max/90/default.jpg", http.StatusOK, 300, 200},
+		{"/orientation.jpg/0,0,200,100/max/0/default.jpg", http.StatusOK, 200, 100},
+		{"/orientation.jpg/0,0,300,100/max/0/default.jpg", http.StatusBadRequest, 0, 0},
+	}
+
+	for _, test := range tests {
+		resp, err := http.Get(ts.URL + test.url)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		if status := resp.StatusCode; status != test.status {
+			t.Errorf("handler returned wrong status code: got %v want %v for %v", status, test.status, test.url)
+			return
+		}
+		if test.status != http.StatusOK {
+			continue
+		}
+
+		metadata, err := bimg.NewImage(body).Metadata()
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		if metadata.Size.Width != test.width || metadata.Size.Height != test.height {
+			t.Errorf("sizes do not match for %v: got %vx%v want %vx%v", test.url, metadata.Size.Width, metadata.Size.Height, test.width, test.height)
+		}
+		if metadata.Orientation > 1 {
+			t.Errorf("%v should not hold an orientation, got %v", test.url, metadata.Orientation)
+		}
+	}
+}
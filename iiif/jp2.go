@@ -0,0 +1,152 @@
+package iiif
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+)
+
+// JPEG 2000 markers and boxes describing the resolutions of the image.
+const (
+	jp2SOC = 0xff4f
+	jp2SIZ = 0xff51
+	jp2COD = 0xff52
+	jp2SOT = 0xff90
+	jp2SOD = 0xff93
+)
+
+// maxJP2Boxes bounds the boxes that are read before the codestream.
+const maxJP2Boxes = 64
+
+// jp2Levels reads the resolutions of a JPEG 2000 file, without decoding it.
+// The levels are loaded using the libvips page option, page=1 being half the
+// size of the full resolution. The image is tiled when its codestream is.
+func jp2Levels(filename string) []tiffLevel {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+
+	offset, ok := jp2Codestream(f)
+	if !ok {
+		return nil
+	}
+
+	var width, height, x, y int64
+	var tiled bool
+	var decompositions int
+	found := false
+
+	marker := make([]byte, 4)
+	if _, err := f.ReadAt(marker[:2], offset); err != nil || binary.BigEndian.Uint16(marker) != jp2SOC {
+		return nil
+	}
+	offset += 2
+
+	for !found {
+		if _, err := f.ReadAt(marker, offset); err != nil {
+			return nil
+		}
+		code, length := binary.BigEndian.Uint16(marker), int64(binary.BigEndian.Uint16(marker[2:]))
+		if code == jp2SOT || code == jp2SOD || length < 2 {
+			return nil
+		}
+
+		segment := make([]byte, length-2)
+		if _, err := f.ReadAt(segment, offset+4); err != nil {
+			return nil
+		}
+
+		switch code {
+		case jp2SIZ:
+			// Rsiz, Xsiz, Ysiz, XOsiz, YOsiz, XTsiz, YTsiz, ...
+			if len(segment) < 26 {
+				return nil
+			}
+			width = int64(binary.BigEndian.Uint32(segment[2:]))
+			height = int64(binary.BigEndian.Uint32(segment[6:]))
+			x = int64(binary.BigEndian.Uint32(segment[10:]))
+			y = int64(binary.BigEndian.Uint32(segment[14:]))
+			tw := int64(binary.BigEndian.Uint32(segment[18:]))
+			th := int64(binary.BigEndian.Uint32(segment[22:]))
+			tiled = tw < width-x || th < height-y
+		case jp2COD:
+			// Scod, progression order, layers, MCT, decompositions, ...
+			if len(segment) < 6 {
+				return nil
+			}
+			decompositions = int(segment[5])
+			found = true
+		}
+		offset += 2 + length
+	}
+
+	if width <= x || height <= y {
+		return nil
+	}
+
+	levels := make([]tiffLevel, 0, decompositions+1)
+	for r := 0; r <= decompositions; r++ {
+		levels = append(levels, tiffLevel{
+			Width:  int(ceilShift(width, r) - ceilShift(x, r)),
+			Height: int(ceilShift(height, r) - ceilShift(y, r)),
+			Tiled:  tiled,
+			Option: fmt.Sprintf("page=%d", r),
+		})
+	}
+	return levels
+}
+
+// jp2Codestream finds the contiguous codestream box of a JP2 file. A raw
+// codestream (.j2k) starts at the beginning of the file.
+func jp2Codestream(f io.ReaderAt) (int64, bool) {
+	header := make([]byte, 16)
+	if _, err := f.ReadAt(header[:2], 0); err != nil {
+		return 0, false
+	}
+	if binary.BigEndian.Uint16(header) == jp2SOC {
+		return 0, true
+	}
+
+	var offset int64
+	for i := 0; i < maxJP2Boxes; i++ {
+		if _, err := f.ReadAt(header[:8], offset); err != nil {
+			return 0, false
+		}
+		length := int64(binary.BigEndian.Uint32(header))
+		box := string(header[4:8])
+		size := int64(8)
+		if length == 1 {
+			if _, err := f.ReadAt(header[8:], offset+8); err != nil {
+				return 0, false
+			}
+			length = int64(binary.BigEndian.Uint64(header[8:]))
+			size = 16
+		}
+
+		if box == "jp2c" {
+			return offset + size, true
+		}
+		if length < size {
+			// The last box, running to the end of the file.
+			return 0, false
+		}
+		offset += length
+	}
+	return 0, false
+}
+
+// ceilShift divides by 2^r, rounding up.
+func ceilShift(n int64, r int) int64 {
+	return (n + (1 << uint(r)) - 1) >> uint(r)
+}
+
+// pyramidLevels reads the levels of a TIFF or JPEG 2000 file.
+func pyramidLevels(filename string) []tiffLevel {
+	if isJP2(filename) {
+		return jp2Levels(filename)
+	}
+	return tiffLevels(filename)
+}
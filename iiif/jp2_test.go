@@ -0,0 +1,82 @@
+package iiif
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// jp2Header builds the boxes and the main header of a JPEG 2000 file.
+func jp2Header(width, height, tile uint32, decompositions byte) []byte {
+	var codestream bytes.Buffer
+	binary.Write(&codestream, binary.BigEndian, uint16(jp2SOC))
+
+	binary.Write(&codestream, binary.BigEndian, uint16(jp2SIZ))
+	binary.Write(&codestream, binary.BigEndian, uint16(2+36+3))
+	binary.Write(&codestream, binary.BigEndian, uint16(0))
+	binary.Write(&codestream, binary.BigEndian, []uint32{width, height, 0, 0, tile, tile, 0, 0})
+	binary.Write(&codestream, binary.BigEndian, uint16(1))
+	codestream.Write([]byte{7, 1, 1})
+
+	binary.Write(&codestream, binary.BigEndian, uint16(jp2COD))
+	binary.Write(&codestream, binary.BigEndian, uint16(12))
+	codestream.Write([]byte{0, 0, 0, 1, 0, decompositions, 4, 4, 0, 0})
+
+	binary.Write(&codestream, binary.BigEndian, uint16(jp2SOT))
+
+	var file bytes.Buffer
+	box := func(name string, content []byte) {
+		binary.Write(&file, binary.BigEndian, uint32(8+len(content)))
+		file.WriteString(name)
+		file.Write(content)
+	}
+	box("jP  ", []byte{0x0d, 0x0a, 0x87, 0x0a})
+	box("ftyp", []byte("jp2 \x00\x00\x00\x00jp2 "))
+	box("jp2c", codestream.Bytes())
+	return file.Bytes()
+}
+
+func TestJP2Levels(t *testing.T) {
+	dir, err := ioutil.TempDir("", "iiif-jp2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	filename := filepath.Join(dir, "tiled.jp2")
+	if err = ioutil.WriteFile(filename, jp2Header(1000, 750, 256, 2), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	levels := jp2Levels(filename)
+	expected := []tiffLevel{
+		{1000, 750, true, "page=0"},
+		{500, 375, true, "page=1"},
+		{250, 188, true, "page=2"},
+	}
+	if !reflect.DeepEqual(levels, expected) {
+		t.Errorf("got %v want %v", levels, expected)
+	}
+	if !isPyramid(levels) {
+		t.Errorf("%v is expected to be a pyramid", filename)
+	}
+
+	// A single tile isn't read by regions.
+	if err = ioutil.WriteFile(filename, jp2Header(1000, 750, 1000, 2), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if isPyramid(jp2Levels(filename)) {
+		t.Errorf("%v isn't expected to be a pyramid", filename)
+	}
+
+	if err = ioutil.WriteFile(filename, []byte("not a jpeg 2000"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if levels := jp2Levels(filename); levels != nil {
+		t.Errorf("no levels were expected, got %v", levels)
+	}
+}
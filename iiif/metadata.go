@@ -0,0 +1,359 @@
+package iiif
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"path"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/golang/groupcache"
+	"github.com/gorilla/mux"
+	"gopkg.in/h2non/bimg.v1"
+)
+
+// error messages
+var metadataError = "Cannot extract the metadata: %#v"
+
+// metadataPrefix distinguishes the metadata keys from the URLs in the
+// images cache.
+const metadataPrefix = "metadata:"
+
+// defaultMetadataFields is the whitelist used when none is configured. It
+// leaves out the location of the shot.
+var defaultMetadataFields = []string{
+	"exif.Make",
+	"exif.Model",
+	"exif.Datetime",
+	"exif.DateTimeOriginal",
+	"exif.Software",
+	"iptc.*",
+	"xmp.*",
+}
+
+// iptcDatasets names the datasets of the IPTC-IIM application record.
+var iptcDatasets = map[byte]string{
+	5:   "ObjectName",
+	25:  "Keywords",
+	55:  "DateCreated",
+	80:  "By-line",
+	85:  "By-lineTitle",
+	90:  "City",
+	95:  "Province-State",
+	101: "Country",
+	105: "Headline",
+	110: "Credit",
+	115: "Source",
+	116: "CopyrightNotice",
+	120: "Caption-Abstract",
+	122: "Writer-Editor",
+}
+
+// xmpNamespaces maps the known XMP namespaces to their usual prefix.
+var xmpNamespaces = map[string]string{
+	"http://purl.org/dc/elements/1.1/":            "dc",
+	"http://ns.adobe.com/xap/1.0/":                "xmp",
+	"http://ns.adobe.com/xap/1.0/rights/":         "xmpRights",
+	"http://ns.adobe.com/photoshop/1.0/":          "photoshop",
+	"http://iptc.org/std/Iptc4xmpCore/1.0/xmlns/": "Iptc4xmpCore",
+	"http://iptc.org/std/Iptc4xmpExt/2008-02-29/": "Iptc4xmpExt",
+	"http://ns.useplus.org/ldf/xmp/1.0/":          "plus",
+	"http://creativecommons.org/ns#":              "cc",
+	"http://www.w3.org/1999/02/22-rdf-syntax-ns#": "rdf",
+	"http://www.w3.org/XML/1998/namespace":        "xml",
+}
+
+// Metadata contains the embedded metadata of an image, the keys are
+// prefixed by their origin: exif., iptc. or xmp.
+type Metadata map[string]string
+
+// MetadataHandler responds with the embedded metadata of the image.
+func MetadataHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	identifier, err := url.QueryUnescape(vars["identifier"])
+	if err != nil {
+		log.Printf("Filename is frob %#v", identifier)
+		serveError(w, r, HTTPError{http.StatusNotFound, identifier})
+		return
+	}
+
+	ctx := r.Context()
+	config, _ := ctx.Value(ContextKey("config")).(*Config)
+	images, _ := ctx.Value(ContextKey("images")).(*groupcache.Group)
+
+	identifier = strings.Replace(identifier, "../", "", -1)
+
+	etag, done := sourceETag(w, r, url.QueryEscape(identifier), config, images)
+	if done {
+		return
+	}
+
+	metadata, err := loadMetadata(identifier, config, images)
+	if err != nil {
+		serveError(w, r, err)
+		return
+	}
+
+	fields := config.Metadata.Fields
+	if len(fields) == 0 {
+		fields = defaultMetadataFields
+	}
+
+	buffer, err := json.MarshalIndent(metadata.filter(fields), "", "  ")
+	if err != nil {
+		serveError(w, r, HTTPError{http.StatusInternalServerError, "Cannot create metadata"})
+		return
+	}
+
+	header := w.Header()
+	header.Set("Content-Type", "application/json")
+	header.Set("Access-Control-Allow-Origin", "*")
+	header.Set("ETag", etag)
+	header.Set("Cache-Control", fmt.Sprintf("max-age=%v, public", config.Cache.HTTP))
+	w.Write(buffer)
+}
+
+// metadataKey gives the identifier of a metadata cache key.
+func metadataKey(key string) string {
+	key = strings.TrimPrefix(key, metadataPrefix)
+	return key[strings.Index(key, ":")+1:]
+}
+
+// loadMetadata reads the metadata from the images cache, if any.
+func loadMetadata(identifier string, config *Config, cache *groupcache.Group) (Metadata, error) {
+	var buffer []byte
+	var err error
+	if cache != nil {
+		// The generation of the image is part of the key.
+		key := fmt.Sprintf("%s%d:%s", metadataPrefix, config.Watcher.Generation(identifier), identifier)
+		err = cache.Get(nil, key, groupcache.AllocatingByteSliceSink(&buffer))
+	} else {
+		buffer, err = readMetadata(identifier, config, nil)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var metadata Metadata
+	err = json.Unmarshal(buffer, &metadata)
+	return metadata, err
+}
+
+// readMetadata extracts the metadata of the image as JSON.
+func readMetadata(identifier string, config *Config, cache *groupcache.Group) ([]byte, error) {
+	loadedImage, err := openImage(identifier, config, cache, nil)
+	if err != nil {
+		e, ok := err.(HTTPError)
+		if ok {
+			return nil, e
+		}
+		return nil, HTTPError{http.StatusNotFound, identifier}
+	}
+
+	metadata, err := extractMetadata(loadedImage.Image.Image())
+	if err != nil {
+		message := fmt.Sprintf(metadataError, err.Error())
+		return nil, HTTPError{http.StatusBadRequest, message}
+	}
+
+	return json.Marshal(metadata)
+}
+
+// extractMetadata reads the EXIF, IPTC and XMP fields of the image.
+func extractMetadata(buffer []byte) (Metadata, error) {
+	m, err := bimg.Metadata(buffer)
+	if err != nil {
+		return nil, err
+	}
+
+	metadata := Metadata{}
+
+	exif := reflect.ValueOf(m.EXIF)
+	for i := 0; i < exif.NumField(); i++ {
+		var value string
+		switch f := exif.Field(i); f.Kind() {
+		case reflect.String:
+			value = f.String()
+		case reflect.Int:
+			if f.Int() != 0 {
+				value = strconv.FormatInt(f.Int(), 10)
+			}
+		}
+		if value != "" {
+			metadata["exif."+exif.Type().Field(i).Name] = value
+		}
+	}
+
+	for k, v := range iptcMetadata(buffer) {
+		metadata["iptc."+k] = v
+	}
+
+	for k, v := range xmpMetadata(buffer) {
+		metadata["xmp."+k] = v
+	}
+
+	return metadata, nil
+}
+
+// iptcMetadata reads the IPTC-IIM datasets hidden in the Photoshop
+// resources of a JPEG (APP13).
+func iptcMetadata(buffer []byte) map[string]string {
+	values := make(map[string][]string)
+
+	segment := jpegSegment(buffer, 0xed, []byte("Photoshop 3.0\x00"))
+	for len(segment) >= 12 && bytes.HasPrefix(segment, []byte("8BIM")) {
+		id := binary.BigEndian.Uint16(segment[4:6])
+		// Pascal string, padded to an even size.
+		n := 6 + 1 + int(segment[6])
+		n += n % 2
+		if len(segment) < n+4 {
+			break
+		}
+		size := int(binary.BigEndian.Uint32(segment[n : n+4]))
+		data := segment[n+4:]
+		if len(data) < size {
+			break
+		}
+		data = data[:size]
+		segment = segment[n+4+size+size%2:]
+
+		if id != 0x0404 {
+			continue
+		}
+
+		for len(data) >= 5 && data[0] == 0x1c {
+			record, dataset := data[1], data[2]
+			length := int(binary.BigEndian.Uint16(data[3:5]))
+			if len(data) < 5+length {
+				break
+			}
+			name, ok := iptcDatasets[dataset]
+			if record == 2 && ok {
+				values[name] = append(values[name], string(data[5:5+length]))
+			}
+			data = data[5+length:]
+		}
+	}
+
+	return joinValues(values)
+}
+
+// xmpMetadata reads the properties of the XMP packet, if any.
+func xmpMetadata(buffer []byte) map[string]string {
+	start := bytes.Index(buffer, []byte("<x:xmpmeta"))
+	end := bytes.Index(buffer, []byte("</x:xmpmeta>"))
+	if start < 0 || end < start {
+		return nil
+	}
+
+	values := make(map[string][]string)
+	decoder := xml.NewDecoder(bytes.NewReader(buffer[start : end+len("</x:xmpmeta>")]))
+
+	// The property being read, nested elements such as rdf:Seq/rdf:li
+	// are contributing to it.
+	var property string
+	var depth int
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			break
+		}
+
+		switch t := token.(type) {
+		case xml.StartElement:
+			name := xmpName(t.Name)
+			if name == "rdf:Description" {
+				for _, attr := range t.Attr {
+					if n := xmpName(attr.Name); n != "" && !strings.HasPrefix(n, "rdf:") && !strings.HasPrefix(n, "xml:") {
+						values[n] = append(values[n], attr.Value)
+					}
+				}
+			} else if property == "" && name != "" && !strings.HasPrefix(name, "rdf:") {
+				property = name
+				depth = 0
+			} else if property != "" {
+				depth++
+			}
+		case xml.EndElement:
+			if property != "" {
+				if depth == 0 {
+					property = ""
+				} else {
+					depth--
+				}
+			}
+		case xml.CharData:
+			text := strings.TrimSpace(string(t))
+			if property != "" && text != "" {
+				values[property] = append(values[property], text)
+			}
+		}
+	}
+
+	return joinValues(values)
+}
+
+// filter keeps the fields matching any of the patterns.
+func (m Metadata) filter(patterns []string) Metadata {
+	filtered := Metadata{}
+	for k, v := range m {
+		for _, pattern := range patterns {
+			if ok, _ := path.Match(pattern, k); ok {
+				filtered[k] = v
+				break
+			}
+		}
+	}
+	return filtered
+}
+
+// xmpName gives the prefixed name of an element or an attribute, or nothing
+// if the namespace is unknown.
+func xmpName(name xml.Name) string {
+	prefix, ok := xmpNamespaces[name.Space]
+	if !ok {
+		return ""
+	}
+	return prefix + ":" + name.Local
+}
+
+// jpegSegment returns the content of the first marker segment starting with
+// the given signature (the signature excluded).
+func jpegSegment(buffer []byte, marker byte, signature []byte) []byte {
+	if len(buffer) < 4 || buffer[0] != 0xff || buffer[1] != 0xd8 {
+		return nil
+	}
+
+	for i := 2; i+4 <= len(buffer) && buffer[i] == 0xff; {
+		m := buffer[i+1]
+		// Start of scan, the metadata are all before.
+		if m == 0xda {
+			break
+		}
+		length := int(binary.BigEndian.Uint16(buffer[i+2 : i+4]))
+		if length < 2 || i+2+length > len(buffer) {
+			break
+		}
+		data := buffer[i+4 : i+2+length]
+		if m == marker && bytes.HasPrefix(data, signature) {
+			return data[len(signature):]
+		}
+		i += 2 + length
+	}
+	return nil
+}
+
+func joinValues(values map[string][]string) map[string]string {
+	joined := make(map[string]string, len(values))
+	for k, v := range values {
+		joined[k] = strings.Join(v, "; ")
+	}
+	return joined
+}
@@ -0,0 +1,111 @@
+package iiif
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"testing"
+)
+
+func TestIptcMetadata(t *testing.T) {
+	buffer, err := ioutil.ReadFile("../fixtures/metadata.jpg")
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	metadata := iptcMetadata(buffer)
+	if by := metadata["By-line"]; by != "Jane Doe" {
+		t.Errorf("IPTC By-line expected to be %#v, got %#v", "Jane Doe", by)
+	}
+	if keywords := metadata["Keywords"]; keywords != "test; fixture" {
+		t.Errorf("IPTC Keywords expected to be %#v, got %#v", "test; fixture", keywords)
+	}
+}
+
+func TestXmpMetadata(t *testing.T) {
+	buffer, err := ioutil.ReadFile("../fixtures/metadata.jpg")
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var tests = []struct {
+		key   string
+		value string
+	}{
+		{"dc:creator", "Jane Doe"},
+		{"dc:rights", "CC BY 4.0 Jane Doe"},
+		{"dc:subject", "test; fixture"},
+		{"photoshop:DateCreated", "2020-05-01"},
+		{"xmpRights:WebStatement", "https://creativecommons.org/licenses/by/4.0/"},
+	}
+
+	metadata := xmpMetadata(buffer)
+	for _, test := range tests {
+		if value := metadata[test.key]; value != test.value {
+			t.Errorf("XMP %v expected to be %#v, got %#v", test.key, test.value, value)
+		}
+	}
+}
+
+func TestMetadata(t *testing.T) {
+	ts := newServer()
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL + "/metadata.jpg/metadata.json")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if status := resp.StatusCode; status != http.StatusOK {
+		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusOK)
+	}
+
+	var m Metadata
+	err = json.NewDecoder(resp.Body).Decode(&m)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if model := m["exif.Model"]; model != "Camera 1" {
+		t.Errorf("exif.Model expected to be %#v, got %#v", "Camera 1", model)
+	}
+	if copyright := m["iptc.CopyrightNotice"]; copyright != "(c) Jane Doe" {
+		t.Errorf("iptc.CopyrightNotice expected to be %#v, got %#v", "(c) Jane Doe", copyright)
+	}
+	if latitude, ok := m["exif.GPSLatitude"]; ok {
+		t.Errorf("exif.GPSLatitude expected to be withheld, got %#v", latitude)
+	}
+}
+
+func TestInfoMetadata(t *testing.T) {
+	ts := newServerWithConfig(&Config{
+		Metadata: MetadataConfig{
+			Info: map[string]string{
+				"attribution": "xmp.dc:rights",
+				"license":     "xmp.xmpRights:WebStatement",
+			},
+		},
+	})
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL + "/metadata.jpg/info.json")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	var m Image
+	err = json.NewDecoder(resp.Body).Decode(&m)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if m.Attribution != "CC BY 4.0 Jane Doe" {
+		t.Errorf("attribution expected to come from the metadata, got %#v", m.Attribution)
+	}
+	if m.License != "https://creativecommons.org/licenses/by/4.0/" {
+		t.Errorf("license expected to come from the metadata, got %#v", m.License)
+	}
+}
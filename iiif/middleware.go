@@ -31,3 +31,24 @@ func WithConfig(h http.Handler, config *Config) http.Handler {
 		h.ServeHTTP(w, r)
 	})
 }
+
+// WithAnnotationStore sets the store of the annotations, replacing the local
+// one.
+func WithAnnotationStore(h http.Handler, store AnnotationStore) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		ctx = context.WithValue(ctx, ContextKey("annotations"), store)
+		r = r.WithContext(ctx)
+		h.ServeHTTP(w, r)
+	})
+}
+
+// WithDiscovery sets the activities of the Change Discovery feed.
+func WithDiscovery(h http.Handler, discovery *Discovery) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		ctx = context.WithValue(ctx, ContextKey("discovery"), discovery)
+		r = r.WithContext(ctx)
+		h.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,266 @@
+package iiif
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/golang/groupcache"
+)
+
+// ocrPrefix distinguishes the OCR keys from the URLs in the images cache.
+const ocrPrefix = "ocr:"
+
+// ocrSidecars are the extensions of the OCR files, replacing the one of the
+// image (e.g. page1.jpg and page1.xml).
+var ocrSidecars = []string{".alto.xml", ".xml", ".hocr", ".hocr.html"}
+
+// ocrWord is a word of the text, and its box in pixels.
+type ocrWord struct {
+	Text string `json:"text"`
+	Term string `json:"term"`
+	Line int    `json:"line"`
+	X    int    `json:"x"`
+	Y    int    `json:"y"`
+	W    int    `json:"w"`
+	H    int    `json:"h"`
+}
+
+// ocrPage is the text of an image. The size of the page is only known when
+// the boxes are not in pixels, they're then scaled to the image.
+type ocrPage struct {
+	Words  []ocrWord `json:"words"`
+	Width  float64   `json:"width,omitempty"`
+	Height float64   `json:"height,omitempty"`
+}
+
+// findOCR gives the OCR file of the image, if any.
+func findOCR(filename string) (string, os.FileInfo, bool) {
+	stem := strings.TrimSuffix(filename, filepath.Ext(filename))
+	for _, ext := range ocrSidecars {
+		stat, err := os.Stat(stem + ext)
+		if err == nil && !stat.IsDir() {
+			return stem + ext, stat, true
+		}
+	}
+	return "", nil, false
+}
+
+// loadOCR gives the text of the OCR file from the cache, its modification
+// time being part of the key.
+func loadOCR(filename string, stat os.FileInfo, cache *groupcache.Group) (*ocrPage, error) {
+	var buffer []byte
+	var err error
+	if cache != nil {
+		key := fmt.Sprintf("%s%d:%s", ocrPrefix, stat.ModTime().UnixNano(), filename)
+		err = cache.Get(nil, key, groupcache.AllocatingByteSliceSink(&buffer))
+	} else {
+		buffer, err = readOCR(filename)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var page ocrPage
+	err = json.Unmarshal(buffer, &page)
+	return &page, err
+}
+
+// readOCR reads the ALTO or hOCR file as JSON.
+func readOCR(filename string) ([]byte, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var page *ocrPage
+	if strings.Contains(filepath.Base(filename), ".hocr") {
+		page, err = parseHOCR(f)
+	} else {
+		page, err = parseALTO(f)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(page)
+}
+
+// ocrKey gives the filename of an OCR cache key.
+func ocrKey(key string) string {
+	key = strings.TrimPrefix(key, ocrPrefix)
+	return key[strings.Index(key, ":")+1:]
+}
+
+// parseALTO reads the strings of the ALTO file. The boxes are kept as is when
+// measured in pixels, the size of the page being given otherwise.
+func parseALTO(r io.Reader) (*ocrPage, error) {
+	page := &ocrPage{}
+	unit := ""
+	line := 0
+	var width, height float64
+
+	decoder := xml.NewDecoder(r)
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+
+		element, ok := token.(xml.StartElement)
+		if !ok {
+			continue
+		}
+
+		switch element.Name.Local {
+		case "MeasurementUnit":
+			var value string
+			if err = decoder.DecodeElement(&value, &element); err != nil {
+				return nil, err
+			}
+			unit = strings.TrimSpace(value)
+		case "Page":
+			width = xmlFloat(element, "WIDTH")
+			height = xmlFloat(element, "HEIGHT")
+		case "TextLine":
+			line++
+		case "String":
+			word := newWord(xmlAttr(element, "CONTENT"), line)
+			if word.Term == "" {
+				continue
+			}
+			word.X = int(xmlFloat(element, "HPOS"))
+			word.Y = int(xmlFloat(element, "VPOS"))
+			word.W = int(xmlFloat(element, "WIDTH"))
+			word.H = int(xmlFloat(element, "HEIGHT"))
+			page.Words = append(page.Words, word)
+		}
+	}
+
+	if unit != "" && unit != "pixel" {
+		page.Width, page.Height = width, height
+	}
+	return page, nil
+}
+
+// parseHOCR reads the ocrx_word elements of the hOCR file, their boxes being
+// in pixels.
+func parseHOCR(r io.Reader) (*ocrPage, error) {
+	page := &ocrPage{}
+	line := 0
+
+	decoder := xml.NewDecoder(r)
+	decoder.Strict = false
+	decoder.AutoClose = xml.HTMLAutoClose
+	decoder.Entity = xml.HTMLEntity
+
+	var word *ocrWord
+	var text strings.Builder
+	depth := 0
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+
+		switch t := token.(type) {
+		case xml.StartElement:
+			if word != nil {
+				depth++
+				continue
+			}
+			classes := strings.Fields(xmlAttr(t, "class"))
+			for _, class := range classes {
+				switch class {
+				case "ocr_line", "ocrx_line", "ocr_caption", "ocr_header", "ocr_textfloat":
+					line++
+				case "ocrx_word":
+					word = &ocrWord{Line: line}
+					bbox := hocrBox(xmlAttr(t, "title"))
+					if len(bbox) == 4 {
+						word.X, word.Y = bbox[0], bbox[1]
+						word.W, word.H = bbox[2]-bbox[0], bbox[3]-bbox[1]
+					}
+					text.Reset()
+					depth = 0
+				}
+			}
+		case xml.CharData:
+			if word != nil {
+				text.Write(t)
+			}
+		case xml.EndElement:
+			if word == nil {
+				continue
+			}
+			if depth > 0 {
+				depth--
+				continue
+			}
+			w := newWord(text.String(), word.Line)
+			if w.Term != "" {
+				w.X, w.Y, w.W, w.H = word.X, word.Y, word.W, word.H
+				page.Words = append(page.Words, w)
+			}
+			word = nil
+		}
+	}
+	return page, nil
+}
+
+// hocrBox gives the bbox property of the title.
+func hocrBox(title string) []int {
+	for _, property := range strings.Split(title, ";") {
+		fields := strings.Fields(property)
+		if len(fields) != 5 || fields[0] != "bbox" {
+			continue
+		}
+		box := make([]int, 4)
+		for i, field := range fields[1:] {
+			box[i], _ = strconv.Atoi(field)
+		}
+		return box
+	}
+	return nil
+}
+
+func newWord(text string, line int) ocrWord {
+	text = strings.TrimSpace(text)
+	return ocrWord{
+		Text: text,
+		Term: normalizeTerm(text),
+		Line: line,
+	}
+}
+
+// normalizeTerm gives the searchable form of the word, in lower case and
+// without its surrounding punctuation.
+func normalizeTerm(word string) string {
+	return strings.ToLower(strings.TrimFunc(word, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	}))
+}
+
+func xmlAttr(element xml.StartElement, name string) string {
+	for _, attr := range element.Attr {
+		if attr.Name.Local == name {
+			return attr.Value
+		}
+	}
+	return ""
+}
+
+func xmlFloat(element xml.StartElement, name string) float64 {
+	n, _ := strconv.ParseFloat(xmlAttr(element, name), 64)
+	return n
+}
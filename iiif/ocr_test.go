@@ -0,0 +1,85 @@
+package iiif
+
+import (
+	"strings"
+	"testing"
+)
+
+const testALTO = `<?xml version="1.0" encoding="UTF-8"?>
+<alto xmlns="http://www.loc.gov/standards/alto/ns-v3#">
+  <Description><MeasurementUnit>pixel</MeasurementUnit></Description>
+  <Layout>
+    <Page WIDTH="1000" HEIGHT="2000">
+      <PrintSpace>
+        <TextBlock>
+          <TextLine>
+            <String CONTENT="The" HPOS="10" VPOS="20" WIDTH="30" HEIGHT="15"/>
+            <SP/>
+            <String CONTENT="Northern" HPOS="50" VPOS="20" WIDTH="80" HEIGHT="15"/>
+          </TextLine>
+          <TextLine>
+            <String CONTENT="Cardinal," HPOS="10" VPOS="40" WIDTH="70" HEIGHT="15"/>
+            <String CONTENT="—" HPOS="90" VPOS="40" WIDTH="10" HEIGHT="15"/>
+            <String CONTENT="bird" HPOS="110" VPOS="40" WIDTH="40" HEIGHT="15"/>
+          </TextLine>
+        </TextBlock>
+      </PrintSpace>
+    </Page>
+  </Layout>
+</alto>`
+
+const testHOCR = `<!DOCTYPE html>
+<html>
+<body>
+<div class="ocr_page" title="image page.jpg; bbox 0 0 1000 2000">
+  <span class="ocr_line" title="bbox 10 20 130 35">
+    <span class="ocrx_word" title="bbox 10 20 40 35; x_wconf 95">The</span>
+    <span class="ocrx_word" title="bbox 50 20 130 35; x_wconf 90"><strong>Northern</strong></span>
+  </span>
+  <span class="ocr_line" title="bbox 10 40 150 55">
+    <span class="ocrx_word" title="bbox 10 40 80 55">Cardinal&amp;</span>
+  </span>
+</div>
+</body>
+</html>`
+
+func TestParseALTO(t *testing.T) {
+	page, err := parseALTO(strings.NewReader(testALTO))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(page.Words) != 4 || page.Width != 0 {
+		t.Fatalf("unexpected page %#v", page)
+	}
+	word := page.Words[2]
+	if word.Text != "Cardinal," || word.Term != "cardinal" || word.Line != 2 || word.X != 10 || word.Y != 40 || word.W != 70 {
+		t.Errorf("unexpected word %#v", word)
+	}
+
+	page, err = parseALTO(strings.NewReader(strings.Replace(testALTO, ">pixel<", ">mm10<", 1)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if page.Width != 1000 || page.Height != 2000 {
+		t.Errorf("the page size was expected, got %vx%v", page.Width, page.Height)
+	}
+}
+
+func TestParseHOCR(t *testing.T) {
+	page, err := parseHOCR(strings.NewReader(testHOCR))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(page.Words) != 3 {
+		t.Fatalf("unexpected page %#v", page)
+	}
+	word := page.Words[1]
+	if word.Text != "Northern" || word.Line != 1 || word.X != 50 || word.W != 80 || word.H != 15 {
+		t.Errorf("unexpected word %#v", word)
+	}
+	if word = page.Words[2]; word.Term != "cardinal" || word.Line != 2 {
+		t.Errorf("unexpected word %#v", word)
+	}
+}
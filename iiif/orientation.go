@@ -0,0 +1,123 @@
+package iiif
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+
+	"gopkg.in/h2non/bimg.v1"
+)
+
+// orientedSize returns the dimensions of the image as it is meant to be
+// seen, i.e. once its EXIF orientation is applied, and whether the pixels
+// have to be rotated or flipped to get there.
+func orientedSize(image *bimg.Image, config *Config) (bimg.ImageSize, bool, error) {
+	metadata, err := image.Metadata()
+	if err != nil {
+		return bimg.ImageSize{}, false, err
+	}
+
+	size := metadata.Size
+	if !autoOrient(config) || metadata.Orientation <= 1 {
+		return size, false, nil
+	}
+
+	// 5 to 8 are transposing the image.
+	if metadata.Orientation >= 5 {
+		size.Width, size.Height = size.Height, size.Width
+	}
+	return size, true, nil
+}
+
+// autoOrient tells whether the EXIF orientation is applied, being the default
+// unless disabled.
+func autoOrient(config *Config) bool {
+	return config.AutoOrient == nil || *config.AutoOrient
+}
+
+// clearOrientation resets the EXIF orientation of the encoded image (JPEG,
+// PNG, WebP or TIFF) once its pixels were rotated, so that the viewers don't
+// rotate it twice. The other metadata, e.g. the ICC profile, are kept.
+func clearOrientation(buf []byte) []byte {
+	buf = append([]byte(nil), buf...)
+
+	switch {
+	case bytes.HasPrefix(buf, []byte("\xff\xd8")):
+		for i := 2; i+4 <= len(buf) && buf[i] == 0xff; {
+			marker := buf[i+1]
+			length := int(binary.BigEndian.Uint16(buf[i+2:]))
+			if marker == 0xda || i+2+length > len(buf) {
+				break
+			}
+			if segment := buf[i+4 : i+2+length]; marker == 0xe1 && bytes.HasPrefix(segment, exifHeader) {
+				clearTIFFOrientation(segment[len(exifHeader):])
+			}
+			i += 2 + length
+		}
+
+	case bytes.HasPrefix(buf, []byte("\x89PNG\r\n\x1a\n")):
+		for i := 8; i+12 <= len(buf); {
+			length := int(binary.BigEndian.Uint32(buf[i:]))
+			if i+12+length > len(buf) {
+				break
+			}
+			if chunk := buf[i+4 : i+8+length]; string(chunk[:4]) == "eXIf" && clearTIFFOrientation(chunk[4:]) {
+				binary.BigEndian.PutUint32(buf[i+8+length:], crc32.ChecksumIEEE(chunk))
+			}
+			i += 12 + length
+		}
+
+	case len(buf) >= 12 && string(buf[:4]) == "RIFF" && string(buf[8:12]) == "WEBP":
+		for i := 12; i+8 <= len(buf); {
+			size := int(binary.LittleEndian.Uint32(buf[i+4:]))
+			if i+8+size > len(buf) {
+				break
+			}
+			if string(buf[i:i+4]) == "EXIF" {
+				clearTIFFOrientation(bytes.TrimPrefix(buf[i+8:i+8+size], exifHeader))
+			}
+			i += 8 + size + size%2
+		}
+
+	default:
+		clearTIFFOrientation(buf)
+	}
+	return buf
+}
+
+// exifHeader starts the EXIF data of a JPEG file, and maybe of a WebP file.
+var exifHeader = []byte("Exif\x00\x00")
+
+// clearTIFFOrientation sets the orientation of the first IFD of the TIFF
+// structure to 1, telling whether it was found.
+func clearTIFFOrientation(tiff []byte) bool {
+	if len(tiff) < 8 {
+		return false
+	}
+
+	var order binary.ByteOrder
+	switch string(tiff[:4]) {
+	case "II*\x00":
+		order = binary.LittleEndian
+	case "MM\x00*":
+		order = binary.BigEndian
+	default:
+		return false
+	}
+
+	ifd := int(order.Uint32(tiff[4:]))
+	if ifd < 8 || ifd+2 > len(tiff) {
+		return false
+	}
+	for i, n := 0, int(order.Uint16(tiff[ifd:])); i < n; i++ {
+		entry := ifd + 2 + 12*i
+		if entry+12 > len(tiff) {
+			break
+		}
+		if order.Uint16(tiff[entry:]) == 0x0112 {
+			order.PutUint16(tiff[entry+8:], 1)
+			return true
+		}
+	}
+	return false
+}
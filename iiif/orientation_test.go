@@ -0,0 +1,42 @@
+package iiif
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"testing"
+)
+
+// testEXIF is a little-endian TIFF structure with an orientation of 6.
+var testEXIF = []byte("II*\x00\x08\x00\x00\x00\x01\x00\x12\x01\x03\x00\x01\x00\x00\x00\x06\x00\x00\x00\x00\x00\x00\x00")
+
+func TestClearOrientation(t *testing.T) {
+	jpeg := []byte("\xff\xd8\xff\xe1\x00\x00")
+	jpeg = append(jpeg, exifHeader...)
+	jpeg = append(jpeg, testEXIF...)
+	binary.BigEndian.PutUint16(jpeg[4:], uint16(len(jpeg)-4))
+	jpeg = append(jpeg, "\xff\xe2\x00\x04ICC\xff\xda"...)
+
+	chunk := append([]byte("eXIf"), testEXIF...)
+	png := []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\x00")
+	binary.BigEndian.PutUint32(png[8:], uint32(len(testEXIF)))
+	png = append(png, chunk...)
+	png = append(png, 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(png[len(png)-4:], crc32.ChecksumIEEE(chunk))
+
+	for _, buf := range [][]byte{jpeg, png, append([]byte(nil), testEXIF...)} {
+		cleared := clearOrientation(buf)
+		i := bytes.Index(cleared, []byte("\x12\x01\x03\x00"))
+		if i < 0 || cleared[i+8] != 1 {
+			t.Errorf("the orientation wasn't cleared: %q", cleared)
+		}
+		if len(cleared) != len(buf) || bytes.Equal(cleared, buf) {
+			t.Errorf("only the orientation was expected to change: %q", cleared)
+		}
+	}
+
+	cleared := clearOrientation(png)
+	if crc := binary.BigEndian.Uint32(cleared[len(cleared)-4:]); crc != crc32.ChecksumIEEE(cleared[12:len(cleared)-4]) {
+		t.Errorf("the checksum of the chunk wasn't updated")
+	}
+}
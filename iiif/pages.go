@@ -0,0 +1,254 @@
+package iiif
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/golang/groupcache"
+	"github.com/gorilla/mux"
+	"gopkg.in/h2non/bimg.v1"
+)
+
+// error messages
+var pageError = "The page %v of %#v doesn't exist"
+var vipsError = "vips couldn't load the page: %#v"
+
+// defaults of the multi-page documents.
+const (
+	defaultPageSeparator = ";"
+	defaultDPI           = 300
+	previewDPI           = 72
+)
+
+// PagesInfo contains the pages of a document.
+type PagesInfo struct {
+	Count       int      `json:"count"`
+	Identifiers []string `json:"identifiers"`
+}
+
+// PagesHandler responds with the number of pages of a document.
+func PagesHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	identifier, err := url.QueryUnescape(vars["identifier"])
+	if err != nil {
+		log.Printf("Filename is frob %#v", identifier)
+		serveError(w, r, HTTPError{http.StatusNotFound, identifier})
+		return
+	}
+
+	ctx := r.Context()
+	config, _ := ctx.Value(ContextKey("config")).(*Config)
+	images, _ := ctx.Value(ContextKey("images")).(*groupcache.Group)
+
+	identifier = strings.Replace(identifier, "../", "", -1)
+
+	filename, _, ok := localPage(identifier, config)
+	if !ok {
+		serveError(w, r, HTTPError{http.StatusNotFound, identifier})
+		return
+	}
+
+	etag, done := sourceETag(w, r, url.QueryEscape(identifier), config, images)
+	if done {
+		return
+	}
+
+	count, err := pageCount(filename, config)
+	if err != nil {
+		serveError(w, r, err)
+		return
+	}
+
+	p := PagesInfo{
+		Count:       count,
+		Identifiers: make([]string, count),
+	}
+	for i := range p.Identifiers {
+		p.Identifiers[i] = fmt.Sprintf("%s%s%d", identifier, pageSeparator(config), i)
+	}
+
+	buffer, err := json.MarshalIndent(p, "", "  ")
+	if err != nil {
+		serveError(w, r, HTTPError{http.StatusInternalServerError, "Cannot create pages"})
+		return
+	}
+
+	header := w.Header()
+	header.Set("Content-Type", "application/json")
+	header.Set("Access-Control-Allow-Origin", "*")
+	header.Set("ETag", etag)
+	header.Set("Cache-Control", fmt.Sprintf("max-age=%v, public", config.Cache.HTTP))
+	w.Write(buffer)
+}
+
+// splitPage extracts the page, starting at zero, from an identifier such as
+// book.pdf;3. It returns -1 when no page is given.
+func splitPage(identifier string, config *Config) (string, int) {
+	i := strings.LastIndex(identifier, pageSeparator(config))
+	if i < 0 {
+		return identifier, -1
+	}
+
+	page, err := strconv.Atoi(identifier[i+len(pageSeparator(config)):])
+	if err != nil || page < 0 {
+		return identifier, -1
+	}
+	return identifier[:i], page
+}
+
+// localPage resolves the file of the identifier and its page, if any. The
+// page separator is ignored when the identifier is an existing file.
+func localPage(identifier string, config *Config) (string, int, bool) {
+	filename := filepath.Join(config.Images, identifier)
+	if _, err := os.Stat(filename); err == nil {
+		return filename, -1, true
+	}
+
+	name, page := splitPage(identifier, config)
+	if page < 0 {
+		return filename, -1, false
+	}
+
+	filename = filepath.Join(config.Images, name)
+	_, err := os.Stat(filename)
+	return filename, page, err == nil
+}
+
+// isPDF tells whether the file needs to be rasterised.
+func isPDF(filename string) bool {
+	return strings.EqualFold(filepath.Ext(filename), ".pdf")
+}
+
+// openPage renders the page of the document using libvips directly, bimg
+// only reads the first one. The PDF are rendered at the given
+// resolution, or the configured one.
+func openPage(filename string, page int, dpi int, config *Config) ([]byte, error) {
+	if dpi == 0 {
+		dpi = pagesDPI(config)
+	}
+
+	count, err := pageCount(filename, config)
+	if err != nil {
+		return nil, err
+	}
+	if page < 0 {
+		page = 0
+	} else if page >= count {
+		message := fmt.Sprintf(pageError, page, filepath.Base(filename))
+		return nil, HTTPError{http.StatusNotFound, message}
+	}
+
+	return vipsLoadFile(loadString(filename, page, dpi), nil)
+}
+
+// pageCount reads the number of pages of the document, single page formats
+// count one. The levels of a pyramid are a single page.
+func pageCount(filename string, config *Config) (int, error) {
+	if isPyramid(pyramidLevels(filename)) {
+		return 1, nil
+	}
+
+	_, _, count, err := vipsHeaderFile(filename)
+	return count, err
+}
+
+// pageSize reads the size of the page without rendering it.
+func pageSize(filename string, page int, dpi int, config *Config) (int, int, error) {
+	width, height, _, err := vipsHeaderFile(loadString(filename, page, dpi))
+	return width, height, err
+}
+
+// openPDF renders the page at the lowest resolution at which the requested
+// region and size can be produced, see pdfResolution. Without any request, a
+// preview is rendered. The size of the page at the configured resolution is
+// returned as well.
+func openPDF(filename string, page int, vars map[string]string, config *Config) ([]byte, *bimg.ImageSize, map[string]string, error) {
+	dpi := pagesDPI(config)
+	width, height, err := pageSize(filename, page, dpi, config)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	size := &bimg.ImageSize{Width: width, Height: height}
+
+	if vars == nil {
+		buffer, err := openPage(filename, page, previewDPI, config)
+		return buffer, size, nil, err
+	}
+
+	dpi, vars, err = pdfResolution(width, height, dpi, vars, config)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	buffer, err := openPage(filename, page, dpi, config)
+	return buffer, size, vars, err
+}
+
+// pdfResolution picks the lowest resolution at which the page can be
+// rendered for the requested region and size. The region and size are
+// rewritten to be independent of the resolution.
+func pdfResolution(width, height, dpi int, vars map[string]string, config *Config) (int, map[string]string, error) {
+	scale, rewritten, err := scaleRequest(width, height, vars, config)
+	if err != nil {
+		return 0, nil, err
+	}
+	if scale >= 1 {
+		return dpi, vars, nil
+	}
+
+	region := vars["region"]
+	if box := regionBox(region, width, height); box != nil && !strings.HasPrefix(region, "pct:") {
+		pct := make([]string, 4)
+		for i, n := range box {
+			total := float64(width)
+			if i%2 == 1 {
+				total = float64(height)
+			}
+			pct[i] = strconv.FormatFloat(float64(n)*100/total, 'f', -1, 64)
+		}
+		rewritten["region"] = "pct:" + strings.Join(pct, ",")
+	}
+
+	return int(math.Ceil(float64(dpi) * scale)), rewritten, nil
+}
+
+// loadString gives the libvips load options, e.g. book.pdf[page=3,dpi=150].
+func loadString(filename string, page int, dpi int) string {
+	if page < 0 {
+		page = 0
+	}
+	options := []string{fmt.Sprintf("page=%d", page)}
+	if isPDF(filename) && dpi > 0 {
+		options = append(options, fmt.Sprintf("dpi=%d", dpi))
+	}
+	return fmt.Sprintf("%s[%s]", filename, strings.Join(options, ","))
+}
+
+func pagesDPI(config *Config) int {
+	if config.Pages.DPI == 0 {
+		return defaultDPI
+	}
+	return config.Pages.DPI
+}
+
+func vipsCommand(config *Config) string {
+	if config.Pages.Vips == "" {
+		return "vips"
+	}
+	return config.Pages.Vips
+}
+
+func pageSeparator(config *Config) string {
+	if config.Pages.Separator == "" {
+		return defaultPageSeparator
+	}
+	return config.Pages.Separator
+}
@@ -0,0 +1,188 @@
+package iiif
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"testing"
+
+	"gopkg.in/h2non/bimg.v1"
+)
+
+func TestSplitPage(t *testing.T) {
+	config := &Config{}
+
+	var tests = []struct {
+		identifier string
+		name       string
+		page       int
+	}{
+		{"book.pdf;3", "book.pdf", 3},
+		{"book.pdf;0", "book.pdf", 0},
+		{"book.pdf", "book.pdf", -1},
+		{"book.pdf;", "book.pdf;", -1},
+		{"book.pdf;-1", "book.pdf;-1", -1},
+		{"a;b.tif;12", "a;b.tif", 12},
+	}
+
+	for _, test := range tests {
+		name, page := splitPage(test.identifier, config)
+		if name != test.name || page != test.page {
+			t.Errorf("%v: got %#v, %v want %#v, %v", test.identifier, name, page, test.name, test.page)
+		}
+	}
+
+	name, page := splitPage("book.pdf@2", &Config{Pages: PagesConfig{Separator: "@"}})
+	if name != "book.pdf" || page != 2 {
+		t.Errorf("the separator is configurable, got %#v, %v", name, page)
+	}
+}
+
+func TestLoadString(t *testing.T) {
+	var tests = []struct {
+		filename string
+		page     int
+		dpi      int
+		load     string
+	}{
+		{"book.pdf", 3, 150, "book.pdf[page=3,dpi=150]"},
+		{"book.PDF", -1, 72, "book.PDF[page=0,dpi=72]"},
+		{"scan.tif", 2, 150, "scan.tif[page=2]"},
+	}
+
+	for _, test := range tests {
+		if load := loadString(test.filename, test.page, test.dpi); load != test.load {
+			t.Errorf("got %#v want %#v", load, test.load)
+		}
+	}
+}
+
+func TestPageCount(t *testing.T) {
+	var tests = []struct {
+		filename string
+		count    int
+		failed   bool
+	}{
+		{"../fixtures/pages.tif", 2, false},
+		{"../fixtures/lena.jpg", 1, false},
+		{"../fixtures/pyramid.tif", 1, false},
+		{"../fixtures/test.txt", 0, true},
+	}
+
+	for _, test := range tests {
+		count, err := pageCount(test.filename, &Config{})
+		if count != test.count || (err != nil) != test.failed {
+			t.Errorf("%s: got %d (%v) want %d", test.filename, count, err, test.count)
+		}
+	}
+}
+
+func TestPages(t *testing.T) {
+	ts := newServer()
+	defer ts.Close()
+
+	var tests = []struct {
+		url   string
+		count int
+	}{
+		{"/pages.tif/pages.json", 2},
+		{"/pages.pdf/pages.json", 2},
+		{"/lena.jpg/pages.json", 1},
+		{"/pyramid.tif/pages.json", 1},
+	}
+
+	for _, test := range tests {
+		resp, err := http.Get(ts.URL + test.url)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer resp.Body.Close()
+
+		var p PagesInfo
+		err = json.NewDecoder(resp.Body).Decode(&p)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		if p.Count != test.count || len(p.Identifiers) != test.count {
+			t.Errorf("%v expected %v pages, got %v", test.url, test.count, p.Count)
+		}
+	}
+}
+
+func TestPageSizes(t *testing.T) {
+	ts := newServerWithConfig(&Config{
+		Pages: PagesConfig{
+			DPI: 144,
+		},
+	})
+	defer ts.Close()
+
+	var tests = []struct {
+		url    string
+		status int
+		width  int
+		height int
+	}{
+		{"/pages.tif/full/max/0/default.png", http.StatusOK, 120, 80},
+		{"/pages.tif;1/full/max/0/default.png", http.StatusOK, 60, 90},
+		{"/pages.tif;2/full/max/0/default.png", http.StatusNotFound, 0, 0},
+		{"/pages.pdf;0/full/max/0/default.png", http.StatusOK, 1224, 1584},
+		{"/pages.pdf;1/full/max/0/default.png", http.StatusOK, 1584, 1224},
+		{"/pages.pdf;1/full/396,/0/default.png", http.StatusOK, 396, 306},
+		{"/pages.pdf;1/full/!396,396/0/default.png", http.StatusOK, 396, 306},
+		{"/pages.pdf;1/0,0,792,612/198,153/0/default.png", http.StatusOK, 198, 153},
+	}
+
+	for _, test := range tests {
+		resp, err := http.Get(ts.URL + test.url)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		if status := resp.StatusCode; status != test.status {
+			t.Errorf("handler returned wrong status code: got %v want %v for %v", status, test.status, test.url)
+			continue
+		}
+		if test.status != http.StatusOK {
+			continue
+		}
+
+		size, err := bimg.NewImage(body).Size()
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		if size.Width != test.width || size.Height != test.height {
+			t.Errorf("sizes do not match for %v: got %vx%v want %vx%v", test.url, size.Width, size.Height, test.width, test.height)
+		}
+	}
+}
+
+func TestPageInfo(t *testing.T) {
+	ts := newServer()
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL + "/pages.tif;1/info.json")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	var m Image
+	err = json.NewDecoder(resp.Body).Decode(&m)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if m.Width != 60 || m.Height != 90 {
+		t.Errorf("the second page expected to be 60x90, got %vx%v", m.Width, m.Height)
+	}
+}
@@ -0,0 +1,115 @@
+package iiif
+
+import (
+	"fmt"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/golang/groupcache"
+)
+
+// findPlaceholder gives the placeholder of the identifier for the error, if
+// any, from the rule of the longest matching prefix. The errors of the
+// parameters have none, the request being wrong whatever the image.
+func findPlaceholder(identifier string, err error, config *Config) (string, bool, bool) {
+	e := newErrorResponse(err)
+	if e.Parameter != "" {
+		return "", false, false
+	}
+
+	var rule *PlaceholderConfig
+	for i, p := range config.Placeholders {
+		if strings.HasPrefix(identifier, p.Prefix) && (rule == nil || len(p.Prefix) > len(rule.Prefix)) {
+			rule = &config.Placeholders[i]
+		}
+	}
+	if rule == nil {
+		return "", false, false
+	}
+
+	var placeholder string
+	switch e.Status {
+	case http.StatusNotFound:
+		placeholder = rule.NotFound
+	case http.StatusUnauthorized, http.StatusForbidden:
+		placeholder = rule.Forbidden
+	default:
+		placeholder = rule.Failed
+	}
+	return placeholder, rule.OK, placeholder != ""
+}
+
+// servePlaceholder responds with the placeholder of the image that failed,
+// made from the same request. The regions in pixels don't apply to the
+// placeholder, it's given in full. It tells whether it did respond.
+func servePlaceholder(w http.ResponseWriter, r *http.Request, vars map[string]string, err error) bool {
+	ctx := r.Context()
+	config, _ := ctx.Value(ContextKey("config")).(*Config)
+	images, _ := ctx.Value(ContextKey("images")).(*groupcache.Group)
+	thumbnails, _ := ctx.Value(ContextKey("thumbnails")).(*groupcache.Group)
+
+	identifier, e := url.QueryUnescape(vars["identifier"])
+	if e != nil {
+		identifier = vars["identifier"]
+	}
+	placeholder, ok, found := findPlaceholder(identifier, err, config)
+	if !found {
+		return false
+	}
+
+	p := make(map[string]string, len(vars))
+	for k, v := range vars {
+		p[k] = v
+	}
+	p["identifier"] = url.QueryEscape(placeholder)
+	if region := p["region"]; region != "full" && region != "square" && !strings.HasPrefix(region, "pct:") {
+		p["region"] = "full"
+	}
+	p["focus"] = canonicalFocus(p["identifier"], p["region"], config)
+
+	path := fmt.Sprintf("/%s/%s/%s/%s/%s.%s", placeholder, p["region"], p["size"], p["rotation"], p["quality"], p["format"])
+	sURL := (&url.URL{Path: path}).EscapedPath()
+	if query := canonicalQuery(p); query != "" {
+		sURL += "?" + query
+	}
+	if p["watermark"] != "" {
+		sURL += "#watermark=" + p["watermark"]
+	}
+	if p["focus"] != "" {
+		sURL += "#focus=" + p["focus"]
+	}
+	if tag, _, e := sourceTag(p["identifier"], config, images); e == nil {
+		sURL += "@" + tag
+	}
+
+	buffer, _, e := loadThumbnail(sURL, p, config, images, thumbnails)
+	if e != nil {
+		log.Printf("Cannot make the placeholder %#v: %s", placeholder, e)
+		return false
+	}
+
+	status := newErrorResponse(err).Status
+	if ok {
+		status = http.StatusOK
+	}
+
+	header := w.Header()
+	header.Del("ETag")
+	header.Del("Last-Modified")
+	contentType := mime.TypeByExtension("." + p["format"])
+	if contentType == "" {
+		contentType = http.DetectContentType(buffer)
+	}
+	header.Set("Content-Type", contentType)
+	header.Set("Access-Control-Allow-Origin", "*")
+	// The image may show up anytime.
+	header.Set("Cache-Control", "no-cache")
+	w.WriteHeader(status)
+	if r.Method != "HEAD" {
+		w.Write(buffer)
+	}
+	return true
+}
@@ -0,0 +1,70 @@
+package iiif
+
+import (
+	"log"
+	"net/http"
+	"testing"
+)
+
+func TestFindPlaceholder(t *testing.T) {
+	config := &Config{
+		Placeholders: []PlaceholderConfig{
+			{Prefix: "", NotFound: "missing.png", Failed: "broken.png"},
+			{Prefix: "private/", NotFound: "private.png", Forbidden: "forbidden.png", OK: true},
+		},
+	}
+
+	var tests = []struct {
+		identifier  string
+		err         error
+		placeholder string
+		ok          bool
+	}{
+		{"lena.jpg", HTTPError{http.StatusNotFound, "lena.jpg"}, "missing.png", false},
+		{"lena.jpg", HTTPError{http.StatusBadRequest, "lena.jpg"}, "broken.png", false},
+		{"lena.jpg", HTTPError{http.StatusForbidden, "lena.jpg"}, "", false},
+		{"private/lena.jpg", HTTPError{http.StatusForbidden, "lena.jpg"}, "forbidden.png", true},
+		{"private/lena.jpg", HTTPError{http.StatusNotFound, "lena.jpg"}, "private.png", true},
+		{"lena.jpg", ParameterError{HTTPError{http.StatusBadRequest, "size"}, "size"}, "", false},
+	}
+
+	for _, test := range tests {
+		placeholder, ok, found := findPlaceholder(test.identifier, test.err, config)
+		if placeholder != test.placeholder || ok != test.ok || found != (test.placeholder != "") {
+			t.Errorf("%s %v: got %#v %v %v", test.identifier, test.err, placeholder, ok, found)
+		}
+	}
+}
+
+func TestPlaceholder(t *testing.T) {
+	ts := newServerWithConfig(&Config{
+		Placeholders: []PlaceholderConfig{
+			{NotFound: "lena.jpg"},
+			{Prefix: "images/", NotFound: "lena.jpg", OK: true},
+		},
+	})
+	defer ts.Close()
+
+	var tests = []struct {
+		url         string
+		status      int
+		contentType string
+	}{
+		{"/missing.jpg/full/max/0/default.png", http.StatusNotFound, "image/png"},
+		{"/missing.jpg/10,10,50,50/100,/0/default.jpg", http.StatusNotFound, "image/jpeg"},
+		{"/images/missing.jpg/full/max/0/default.png", http.StatusOK, "image/png"},
+		{"/lena.jpg/full/10/0/default.png", http.StatusBadRequest, "text/plain; charset=utf-8"},
+	}
+
+	for _, test := range tests {
+		resp, err := http.Get(ts.URL + test.url)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode != test.status || resp.Header.Get("Content-Type") != test.contentType {
+			t.Errorf("%s: got %v %v want %v %v", test.url, resp.StatusCode, resp.Header.Get("Content-Type"), test.status, test.contentType)
+		}
+	}
+}
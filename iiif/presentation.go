@@ -0,0 +1,539 @@
+package iiif
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/golang/groupcache"
+	"github.com/gorilla/mux"
+	"gopkg.in/yaml.v2"
+)
+
+// error messages
+var manifestError = "%#v is not a directory of images"
+
+// manifestSidecars are the files describing the manifest of a directory, the
+// first one found is used.
+var manifestSidecars = []string{"_manifest.json", "_manifest.yaml", "_manifest.yml"}
+
+// the profiles of the Presentation API versions.
+const (
+	presentation2Context = "http://iiif.io/api/presentation/2/context.json"
+	presentation3Context = "http://iiif.io/api/presentation/3/context.json"
+)
+
+// LanguageMap contains the values of a property per language, none being the
+// values without any known language.
+type LanguageMap map[string][]string
+
+// MetadataEntry is a label and value pair shown to the user.
+type MetadataEntry struct {
+	Label LanguageMap `json:"label"`
+	Value LanguageMap `json:"value"`
+}
+
+// Manifest describes a directory of images following the IIIF Presentation
+// API 3.0, see https://iiif.io/api/presentation/3.0/
+type Manifest struct {
+	Context           string          `json:"@context"`
+	ID                string          `json:"id"`
+	Type              string          `json:"type"`
+	Label             LanguageMap     `json:"label"`
+	Summary           LanguageMap     `json:"summary,omitempty"`
+	Metadata          []MetadataEntry `json:"metadata,omitempty"`
+	RequiredStatement *MetadataEntry  `json:"requiredStatement,omitempty"`
+	Rights            string          `json:"rights,omitempty"`
+	Service           []SearchService `json:"service,omitempty"`
+	Items             []Canvas        `json:"items"`
+	Structures        []Range         `json:"structures,omitempty"`
+}
+
+// Canvas is a page of the manifest, painted by a single image.
+type Canvas struct {
+	ID     string           `json:"id"`
+	Type   string           `json:"type"`
+	Label  LanguageMap      `json:"label,omitempty"`
+	Width  int              `json:"width"`
+	Height int              `json:"height"`
+	Items  []AnnotationPage `json:"items"`
+}
+
+// AnnotationPage contains the annotations of a canvas.
+type AnnotationPage struct {
+	ID    string       `json:"id"`
+	Type  string       `json:"type"`
+	Items []Annotation `json:"items"`
+}
+
+// Annotation paints the image onto its target canvas.
+type Annotation struct {
+	ID         string    `json:"id"`
+	Type       string    `json:"type"`
+	Motivation string    `json:"motivation"`
+	Body       ImageBody `json:"body"`
+	Target     string    `json:"target"`
+}
+
+// ImageBody is the image painted onto a canvas, served by this server.
+type ImageBody struct {
+	ID      string         `json:"id"`
+	Type    string         `json:"type"`
+	Format  string         `json:"format"`
+	Width   int            `json:"width"`
+	Height  int            `json:"height"`
+	Service []ImageService `json:"service"`
+}
+
+// ImageService points at the info.json of an image.
+type ImageService struct {
+	ID      string `json:"@id"`
+	Type    string `json:"@type"`
+	Profile string `json:"profile"`
+}
+
+// Range groups canvases, or other ranges, e.g. the chapters of a book.
+type Range struct {
+	ID    string        `json:"id"`
+	Type  string        `json:"type"`
+	Label LanguageMap   `json:"label,omitempty"`
+	Items []interface{} `json:"items"`
+}
+
+// Reference points at a resource described elsewhere.
+type Reference struct {
+	ID   string `json:"id"`
+	Type string `json:"type"`
+}
+
+// ManifestSidecar contains the descriptive properties of a manifest. Canvases
+// maps the filenames to their labels.
+type ManifestSidecar struct {
+	Label             string            `json:"label" yaml:"label"`
+	Summary           string            `json:"summary" yaml:"summary"`
+	Metadata          []MetadataSidecar `json:"metadata" yaml:"metadata"`
+	RequiredStatement *MetadataSidecar  `json:"requiredStatement" yaml:"requiredStatement"`
+	Rights            string            `json:"rights" yaml:"rights"`
+	Canvases          map[string]string `json:"canvases" yaml:"canvases"`
+	Ranges            []RangeSidecar    `json:"ranges" yaml:"ranges"`
+}
+
+// MetadataSidecar is a label and value pair.
+type MetadataSidecar struct {
+	Label string `json:"label" yaml:"label"`
+	Value string `json:"value" yaml:"value"`
+}
+
+// RangeSidecar groups the canvases, by filename, and the sub-ranges.
+type RangeSidecar struct {
+	Label    string         `json:"label" yaml:"label"`
+	Canvases []string       `json:"canvases" yaml:"canvases"`
+	Ranges   []RangeSidecar `json:"ranges" yaml:"ranges"`
+}
+
+// ManifestHandler responds with the Presentation manifest of a directory.
+func ManifestHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	identifier, err := url.QueryUnescape(vars["identifier"])
+	if err != nil {
+		log.Printf("Filename is frob %#v", identifier)
+		serveError(w, r, HTTPError{http.StatusNotFound, identifier})
+		return
+	}
+
+	ctx := r.Context()
+	config, _ := ctx.Value(ContextKey("config")).(*Config)
+	images, _ := ctx.Value(ContextKey("images")).(*groupcache.Group)
+
+	identifier = strings.Trim(strings.Replace(identifier, "../", "", -1), "/")
+
+	accept := r.Header.Get("Accept")
+	profile := presentationProfile(accept)
+	contentType := "application/json"
+	if strings.Contains(accept, "application/ld+json") {
+		contentType = fmt.Sprintf("application/ld+json;profile=%q", profile)
+	}
+
+	// The ETag covers the request, its representation, the version of the
+	// API and the state of the directory, so that the manifest is only made
+	// when it changed.
+	state, stateTime, err := manifestState(identifier, config)
+	if err != nil {
+		serveError(w, r, HTTPError{http.StatusNotFound, fmt.Sprintf(manifestError, identifier)})
+		return
+	}
+	etag := getETag(fmt.Sprintf("%s %s %s@%s", r.URL, contentType, profile, state))
+	if checkPreconditions(w, r, etag, stateTime, config) {
+		return
+	}
+
+	p, modTime, err := newManifest(identifier, baseURL(r), config, images)
+	if err != nil {
+		serveError(w, r, err)
+		return
+	}
+
+	var manifest interface{} = p
+	if profile == presentation2Context {
+		manifest = newManifest2(p)
+	}
+
+	buffer, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		serveError(w, r, HTTPError{http.StatusInternalServerError, "Cannot create manifest"})
+		return
+	}
+
+	header := w.Header()
+	header.Set("Content-Type", contentType)
+	header.Set("Access-Control-Allow-Origin", "*")
+	header.Set("Vary", "Accept")
+	header.Set("ETag", etag)
+	header.Set("Cache-Control", fmt.Sprintf("max-age=%v, public", config.Cache.HTTP))
+	http.ServeContent(w, r, "manifest.json", modTime, bytes.NewReader(buffer))
+}
+
+// newManifest describes the images of the directory as canvases, in their
+// natural order. The images unreadable by libvips are left out. The latest
+// modification time of the directory, its sidecar and images is returned as
+// well.
+func newManifest(identifier, base string, config *Config, images *groupcache.Group) (*Manifest, time.Time, error) {
+	dir := filepath.Join(config.Images, identifier)
+
+	modTime, err := manifestModTime(dir)
+	if err != nil {
+		return nil, modTime, HTTPError{http.StatusNotFound, fmt.Sprintf(manifestError, identifier)}
+	}
+
+	names, err := listImages(dir, config)
+	if err != nil {
+		return nil, modTime, HTTPError{http.StatusNotFound, fmt.Sprintf(manifestError, identifier)}
+	}
+
+	sidecar, sidecarTime, err := readManifestSidecar(dir)
+	if err != nil {
+		log.Printf("Cannot read the manifest sidecar of %#v: %s", identifier, err)
+	}
+	if sidecarTime.After(modTime) {
+		modTime = sidecarTime
+	}
+
+	id := fmt.Sprintf("%s/%s", base, identifier)
+
+	label := sidecar.Label
+	if label == "" {
+		label = filepath.Base(dir)
+	}
+
+	p := &Manifest{
+		Context: presentation3Context,
+		ID:      id + "/manifest.json",
+		Type:    "Manifest",
+		Label:   newLanguageMap(label),
+		Summary: newLanguageMap(sidecar.Summary),
+		Rights:  sidecar.Rights,
+		Items:   []Canvas{},
+	}
+
+	for _, m := range sidecar.Metadata {
+		p.Metadata = append(p.Metadata, newMetadataEntry(m))
+	}
+	if sidecar.RequiredStatement != nil {
+		entry := newMetadataEntry(*sidecar.RequiredStatement)
+		p.RequiredStatement = &entry
+	}
+
+	canvases := make(map[string]string)
+	searchable := false
+	for i, name := range names {
+		imageIdentifier := identifier + "/" + name
+
+		size, imageTime, err := loadImageSize(imageIdentifier, config, images)
+		if err != nil {
+			log.Printf("Cannot add %#v to the manifest: %s", imageIdentifier, err)
+			continue
+		}
+		if imageTime != nil && imageTime.After(modTime) {
+			modTime = *imageTime
+		}
+
+		label, ok := sidecar.Canvases[name]
+		if !ok {
+			label = strings.TrimSuffix(name, filepath.Ext(name))
+		}
+
+		if _, _, ok := findOCR(filepath.Join(dir, name)); ok {
+			searchable = true
+		}
+
+		canvas := canvasID(id, i)
+		canvases[name] = canvas
+		p.Items = append(p.Items, newCanvas(canvas, base+"/"+imageIdentifier, label, size.Width, size.Height))
+	}
+
+	p.Structures = newRanges(sidecar.Ranges, id+"/range/r", canvases)
+
+	if searchable {
+		p.Service = []SearchService{
+			{
+				ID:   id + "/search/2",
+				Type: "SearchService2",
+				Service: []SearchService{
+					{ID: id + "/autocomplete/2", Type: "AutoCompleteService2"},
+				},
+			},
+		}
+	}
+
+	return p, modTime, nil
+}
+
+// canvasID gives the canvas of the image at the given position within the
+// directory of the manifest. An image being left out doesn't shift the
+// others, their search results pointing at them.
+func canvasID(manifest string, position int) string {
+	return fmt.Sprintf("%s/canvas/p%d", manifest, position+1)
+}
+
+// newCanvas creates the canvas painted by the whole image, served by image.
+func newCanvas(id, image, label string, width, height int) Canvas {
+	return Canvas{
+		ID:     id,
+		Type:   "Canvas",
+		Label:  newLanguageMap(label),
+		Width:  width,
+		Height: height,
+		Items: []AnnotationPage{
+			{
+				ID:   id + "/page",
+				Type: "AnnotationPage",
+				Items: []Annotation{
+					{
+						ID:         id + "/page/image",
+						Type:       "Annotation",
+						Motivation: "painting",
+						Body: ImageBody{
+							ID:     image + "/full/full/0/default.jpg",
+							Type:   "Image",
+							Format: "image/jpeg",
+							Width:  width,
+							Height: height,
+							Service: []ImageService{
+								{
+									ID:      image,
+									Type:    "ImageService2",
+									Profile: "level2",
+								},
+							},
+						},
+						Target: id,
+					},
+				},
+			},
+		},
+	}
+}
+
+// newRanges creates the ranges, numbered after prefix, pointing at the
+// canvases by filename. Unknown filenames are ignored.
+func newRanges(ranges []RangeSidecar, prefix string, canvases map[string]string) []Range {
+	var structures []Range
+	for i, r := range ranges {
+		id := fmt.Sprintf("%s%d", prefix, i+1)
+		items := []interface{}{}
+		for _, name := range r.Canvases {
+			if canvas, ok := canvases[name]; ok {
+				items = append(items, Reference{canvas, "Canvas"})
+			}
+		}
+		for _, sub := range newRanges(r.Ranges, id+"-", canvases) {
+			items = append(items, sub)
+		}
+
+		structures = append(structures, Range{
+			ID:    id,
+			Type:  "Range",
+			Label: newLanguageMap(r.Label),
+			Items: items,
+		})
+	}
+	return structures
+}
+
+func newLanguageMap(value string) LanguageMap {
+	if value == "" {
+		return nil
+	}
+	return LanguageMap{"none": {value}}
+}
+
+func newMetadataEntry(m MetadataSidecar) MetadataEntry {
+	return MetadataEntry{
+		Label: LanguageMap{"none": {m.Label}},
+		Value: LanguageMap{"none": {m.Value}},
+	}
+}
+
+// readManifestSidecar reads the JSON or YAML sidecar of the directory, and
+// gives its modification time. A missing file is simply ignored.
+func readManifestSidecar(dir string) (*ManifestSidecar, time.Time, error) {
+	sidecar := &ManifestSidecar{}
+	for _, name := range manifestSidecars {
+		filename := filepath.Join(dir, name)
+		stat, err := os.Stat(filename)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return sidecar, time.Time{}, err
+		}
+
+		data, err := ioutil.ReadFile(filename)
+		if err != nil {
+			return sidecar, time.Time{}, err
+		}
+
+		if filepath.Ext(name) == ".json" {
+			err = json.Unmarshal(data, sidecar)
+		} else {
+			err = yaml.Unmarshal(data, sidecar)
+		}
+		return sidecar, stat.ModTime(), err
+	}
+	return sidecar, time.Time{}, nil
+}
+
+// manifestState fingerprints the directory from its images, their texts and
+// its sidecar, without reading them, and gives their latest modification
+// time.
+func manifestState(identifier string, config *Config) (string, time.Time, error) {
+	dir := filepath.Join(config.Images, identifier)
+
+	modTime, err := manifestModTime(dir)
+	if err != nil {
+		return "", modTime, err
+	}
+
+	names, err := listImages(dir, config)
+	if err != nil {
+		return "", modTime, err
+	}
+
+	hash := sha1.New()
+	stat := func(filename string) {
+		info, err := os.Stat(filename)
+		if err != nil {
+			return
+		}
+		fmt.Fprintf(hash, "%s %d %d\n", filepath.Base(filename), info.Size(), info.ModTime().UnixNano())
+		if info.ModTime().After(modTime) {
+			modTime = info.ModTime()
+		}
+	}
+
+	for _, name := range names {
+		filename := filepath.Join(dir, name)
+		stat(filename)
+		fmt.Fprintf(hash, "%d\n", config.Watcher.Generation(identifier+"/"+name))
+		if ocr, _, ok := findOCR(filename); ok {
+			fmt.Fprintln(hash, filepath.Base(ocr))
+		}
+	}
+	for _, name := range manifestSidecars {
+		stat(filepath.Join(dir, name))
+	}
+	return fmt.Sprintf("%x", hash.Sum(nil)), modTime, nil
+}
+
+// manifestModTime gives the modification time of the directory.
+func manifestModTime(dir string) (time.Time, error) {
+	stat, err := os.Stat(dir)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if !stat.IsDir() {
+		return time.Time{}, fmt.Errorf(manifestError, dir)
+	}
+	return stat.ModTime(), nil
+}
+
+// listImages gives the filenames of the images of the directory, in their
+// natural order. The derivatives are left out.
+func listImages(dir string, config *Config) ([]string, error) {
+	if config.Derivatives.Path != "" && isWithin(dir, config.Derivatives.Path) {
+		return nil, fmt.Errorf(manifestError, dir)
+	}
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, file := range files {
+		name := file.Name()
+		if file.IsDir() || strings.HasPrefix(name, ".") {
+			continue
+		}
+		if !isImageFile(name) {
+			continue
+		}
+		names = append(names, name)
+	}
+
+	sort.Slice(names, func(i, j int) bool {
+		return naturalLess(names[i], names[j])
+	})
+	return names, nil
+}
+
+// isImageFile tells whether the file is an image of the manifests.
+func isImageFile(name string) bool {
+	return convertExtensions[strings.ToLower(filepath.Ext(name))] || isJP2(name)
+}
+
+// naturalLess compares the strings, their runs of digits by numerical value
+// (e.g. page2 comes before page10).
+func naturalLess(a, b string) bool {
+	for a != "" && b != "" {
+		ca, cb := naturalChunk(a), naturalChunk(b)
+		if ca != cb {
+			if isDigit(ca[0]) && isDigit(cb[0]) {
+				na, nb := strings.TrimLeft(ca, "0"), strings.TrimLeft(cb, "0")
+				if len(na) != len(nb) {
+					return len(na) < len(nb)
+				}
+				if na != nb {
+					return na < nb
+				}
+				return len(ca) < len(cb)
+			}
+			return ca < cb
+		}
+		a, b = a[len(ca):], b[len(cb):]
+	}
+	return len(a) < len(b)
+}
+
+// naturalChunk gives the leading run of digits, or of other characters.
+func naturalChunk(s string) string {
+	digit := isDigit(s[0])
+	i := 1
+	for i < len(s) && isDigit(s[i]) == digit {
+		i++
+	}
+	return s[:i]
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
@@ -0,0 +1,218 @@
+package iiif
+
+import (
+	"mime"
+	"strings"
+)
+
+// Manifest2 describes a directory of images following the IIIF Presentation
+// API 2.1, see https://iiif.io/api/presentation/2.1/
+type Manifest2 struct {
+	Context     string           `json:"@context"`
+	ID          string           `json:"@id"`
+	Type        string           `json:"@type"`
+	Label       string           `json:"label"`
+	Description string           `json:"description,omitempty"`
+	Metadata    []MetadataEntry2 `json:"metadata,omitempty"`
+	Attribution string           `json:"attribution,omitempty"`
+	License     string           `json:"license,omitempty"`
+	Service     *SearchService1  `json:"service,omitempty"`
+	Sequences   []Sequence2      `json:"sequences"`
+	Structures  []Range2         `json:"structures,omitempty"`
+}
+
+// MetadataEntry2 is a label and value pair shown to the user.
+type MetadataEntry2 struct {
+	Label string `json:"label"`
+	Value string `json:"value"`
+}
+
+// Sequence2 is the order of the canvases.
+type Sequence2 struct {
+	ID       string    `json:"@id"`
+	Type     string    `json:"@type"`
+	Canvases []Canvas2 `json:"canvases"`
+}
+
+// Canvas2 is a page of the manifest, painted by a single image.
+type Canvas2 struct {
+	ID     string        `json:"@id"`
+	Type   string        `json:"@type"`
+	Label  string        `json:"label"`
+	Width  int           `json:"width"`
+	Height int           `json:"height"`
+	Images []Annotation2 `json:"images"`
+}
+
+// Annotation2 paints the image onto the canvas.
+type Annotation2 struct {
+	ID         string    `json:"@id"`
+	Type       string    `json:"@type"`
+	Motivation string    `json:"motivation"`
+	Resource   Resource2 `json:"resource"`
+	On         string    `json:"on"`
+}
+
+// Resource2 is the image painted onto a canvas, served by this server.
+type Resource2 struct {
+	ID      string   `json:"@id"`
+	Type    string   `json:"@type"`
+	Format  string   `json:"format"`
+	Width   int      `json:"width"`
+	Height  int      `json:"height"`
+	Service Service2 `json:"service"`
+}
+
+// Service2 points at the info.json of an image.
+type Service2 struct {
+	Context string `json:"@context"`
+	ID      string `json:"@id"`
+	Profile string `json:"profile"`
+}
+
+// Range2 groups canvases, and other ranges by identifier.
+type Range2 struct {
+	ID       string   `json:"@id"`
+	Type     string   `json:"@type"`
+	Label    string   `json:"label"`
+	Canvases []string `json:"canvases,omitempty"`
+	Ranges   []string `json:"ranges,omitempty"`
+}
+
+// newManifest2 gives the Presentation 2.1 version of the manifest.
+func newManifest2(m *Manifest) *Manifest2 {
+	p := &Manifest2{
+		Context:     presentation2Context,
+		ID:          m.ID,
+		Type:        "sc:Manifest",
+		Label:       firstValue(m.Label),
+		Description: firstValue(m.Summary),
+		License:     m.Rights,
+		Sequences: []Sequence2{
+			{
+				ID:       strings.TrimSuffix(m.ID, "/manifest.json") + "/sequence/normal",
+				Type:     "sc:Sequence",
+				Canvases: []Canvas2{},
+			},
+		},
+	}
+
+	for _, entry := range m.Metadata {
+		p.Metadata = append(p.Metadata, MetadataEntry2{firstValue(entry.Label), firstValue(entry.Value)})
+	}
+	if m.RequiredStatement != nil {
+		p.Attribution = firstValue(m.RequiredStatement.Value)
+	}
+
+	for _, canvas := range m.Items {
+		c := Canvas2{
+			ID:     canvas.ID,
+			Type:   "sc:Canvas",
+			Label:  firstValue(canvas.Label),
+			Width:  canvas.Width,
+			Height: canvas.Height,
+			Images: []Annotation2{},
+		}
+		for _, page := range canvas.Items {
+			for _, annotation := range page.Items {
+				body := annotation.Body
+				c.Images = append(c.Images, Annotation2{
+					ID:         annotation.ID,
+					Type:       "oa:Annotation",
+					Motivation: "sc:painting",
+					Resource: Resource2{
+						ID:     body.ID,
+						Type:   "dctypes:Image",
+						Format: body.Format,
+						Width:  body.Width,
+						Height: body.Height,
+						Service: Service2{
+							Context: "http://iiif.io/api/image/2/context.json",
+							ID:      body.Service[0].ID,
+							Profile: "http://iiif.io/api/image/2/level2.json",
+						},
+					},
+					On: annotation.Target,
+				})
+			}
+		}
+		p.Sequences[0].Canvases = append(p.Sequences[0].Canvases, c)
+	}
+
+	p.Structures = newRanges2(m.Structures)
+
+	for _, service := range m.Service {
+		if service.Type != "SearchService2" {
+			continue
+		}
+		base := strings.TrimSuffix(service.ID, "/search/2")
+		p.Service = &SearchService1{
+			Context: search1Context,
+			ID:      base + "/search/1",
+			Profile: "http://iiif.io/api/search/1/search",
+			Service: &SearchService1{
+				ID:      base + "/autocomplete/1",
+				Profile: "http://iiif.io/api/search/1/autocomplete",
+			},
+		}
+	}
+	return p
+}
+
+// newRanges2 flattens the ranges, the nested ones being referenced by their
+// parent.
+func newRanges2(ranges []Range) []Range2 {
+	var structures []Range2
+	for _, r := range ranges {
+		var sub []Range
+		r2 := Range2{
+			ID:    r.ID,
+			Type:  "sc:Range",
+			Label: firstValue(r.Label),
+		}
+		for _, item := range r.Items {
+			switch i := item.(type) {
+			case Reference:
+				r2.Canvases = append(r2.Canvases, i.ID)
+			case Range:
+				r2.Ranges = append(r2.Ranges, i.ID)
+				sub = append(sub, i)
+			}
+		}
+		structures = append(structures, r2)
+		structures = append(structures, newRanges2(sub)...)
+	}
+	return structures
+}
+
+// firstValue gives the first value of the map, preferably without any
+// language.
+func firstValue(m LanguageMap) string {
+	if values := m["none"]; len(values) > 0 {
+		return values[0]
+	}
+	for _, values := range m {
+		if len(values) > 0 {
+			return values[0]
+		}
+	}
+	return ""
+}
+
+// presentationProfile gives the Presentation API context requested by the
+// profile parameter of the Accept header, the 3.0 one by default.
+func presentationProfile(accept string) string {
+	for _, mediaRange := range strings.Split(accept, ",") {
+		_, params, err := mime.ParseMediaType(mediaRange)
+		if err != nil {
+			continue
+		}
+		switch params["profile"] {
+		case presentation2Context:
+			return presentation2Context
+		case presentation3Context:
+			return presentation3Context
+		}
+	}
+	return presentation3Context
+}
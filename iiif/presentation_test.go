@@ -0,0 +1,224 @@
+package iiif
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestNaturalLess(t *testing.T) {
+	names := []string{"page10.jpg", "page2.jpg", "cover.jpg", "page1.jpg", "page02b.jpg", "10.jpg", "9.jpg"}
+	expected := []string{"9.jpg", "10.jpg", "cover.jpg", "page1.jpg", "page2.jpg", "page02b.jpg", "page10.jpg"}
+
+	sort.Slice(names, func(i, j int) bool {
+		return naturalLess(names[i], names[j])
+	})
+
+	if !reflect.DeepEqual(names, expected) {
+		t.Errorf("got %v want %v", names, expected)
+	}
+}
+
+func TestReadManifestSidecar(t *testing.T) {
+	dir, err := ioutil.TempDir("", "iiif-manifest")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	sidecar, _, err := readManifestSidecar(dir)
+	if err != nil || sidecar.Label != "" {
+		t.Errorf("an empty sidecar was expected, got %#v %v", sidecar, err)
+	}
+
+	data := []byte(`label: A book
+metadata:
+  - label: Author
+    value: Someone
+canvases:
+  1.jpg: Cover
+ranges:
+  - label: Chapter 1
+    canvases: [1.jpg, 2.jpg]
+`)
+	if err = ioutil.WriteFile(filepath.Join(dir, "_manifest.yml"), data, 0644); err != nil {
+		log.Fatal(err)
+	}
+
+	sidecar, _, err = readManifestSidecar(dir)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if sidecar.Label != "A book" || len(sidecar.Metadata) != 1 || sidecar.Canvases["1.jpg"] != "Cover" || len(sidecar.Ranges[0].Canvases) != 2 {
+		t.Errorf("unexpected sidecar %#v", sidecar)
+	}
+}
+
+func TestManifest(t *testing.T) {
+	images, err := ioutil.TempDir("", "iiif-images")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(images)
+
+	buffer, err := ioutil.ReadFile("../fixtures/lena.jpg")
+	if err != nil {
+		log.Fatal(err)
+	}
+	book := filepath.Join(images, "book")
+	if err = os.Mkdir(book, 0755); err != nil {
+		log.Fatal(err)
+	}
+	for _, name := range []string{"10.jpg", "2.jpg", "1.jpg"} {
+		if err = ioutil.WriteFile(filepath.Join(book, name), buffer, 0644); err != nil {
+			log.Fatal(err)
+		}
+	}
+	sidecar := []byte(`{"label": "A book", "canvases": {"1.jpg": "Cover"}, "ranges": [{"label": "Chapter 1", "canvases": ["2.jpg", "10.jpg"]}]}`)
+	if err = ioutil.WriteFile(filepath.Join(book, "_manifest.json"), sidecar, 0644); err != nil {
+		log.Fatal(err)
+	}
+
+	ts := httptest.NewServer(WithConfig(MakeRouter(), &Config{Images: images}))
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL + "/book/manifest.json")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	var m Manifest
+	if err = json.NewDecoder(resp.Body).Decode(&m); err != nil {
+		log.Fatal(err)
+	}
+
+	if m.ID != ts.URL+"/book/manifest.json" || m.Label["none"][0] != "A book" {
+		t.Errorf("unexpected manifest %#v", m)
+	}
+	if len(m.Items) != 3 {
+		t.Fatalf("three canvases were expected, got %v", len(m.Items))
+	}
+
+	canvas := m.Items[0]
+	if canvas.Label["none"][0] != "Cover" || canvas.Width != 1084 || canvas.Height != 2318 {
+		t.Errorf("unexpected canvas %#v", canvas)
+	}
+	if service := canvas.Items[0].Items[0].Body.Service[0]; service.ID != ts.URL+"/book/1.jpg" {
+		t.Errorf("unexpected image service %#v", service)
+	}
+	if m.Items[2].Label["none"][0] != "10" || m.Items[2].ID != ts.URL+"/book/canvas/p3" {
+		t.Errorf("10.jpg was expected last, got %#v %#v", m.Items[2].ID, m.Items[2].Label)
+	}
+
+	if len(m.Structures) != 1 || len(m.Structures[0].Items) != 2 {
+		t.Errorf("unexpected ranges %#v", m.Structures)
+	}
+
+	// The ETag follows the directory, a new page changing it.
+	etag := resp.Header.Get("ETag")
+	req, err := http.NewRequest("GET", ts.URL+"/book/manifest.json", nil)
+	if err != nil {
+		log.Fatal(err)
+	}
+	req.Header.Set("If-None-Match", etag)
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		log.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotModified {
+		t.Errorf("an unchanged manifest expected a 304, got %v", resp.StatusCode)
+	}
+
+	// The version of the API is part of it, whatever the media type.
+	req.Header.Set("Accept", `application/json;profile="http://iiif.io/api/presentation/2/context.json"`)
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		log.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("ETag") == etag {
+		t.Errorf("the 2.1 manifest expected its own ETag, got %v %v", resp.StatusCode, resp.Header.Get("ETag"))
+	}
+	req.Header.Del("Accept")
+
+	if err = ioutil.WriteFile(filepath.Join(book, "11.jpg"), buffer, 0644); err != nil {
+		log.Fatal(err)
+	}
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		log.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("ETag") == etag {
+		t.Errorf("a changed manifest expected a new ETag, got %v %v", resp.StatusCode, resp.Header.Get("ETag"))
+	}
+
+	resp, err = http.Get(ts.URL + "/nothing/manifest.json")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("a missing directory expected a 404, got %v", resp.StatusCode)
+	}
+}
+
+func TestPresentationProfile(t *testing.T) {
+	var tests = []struct {
+		accept  string
+		profile string
+	}{
+		{"", presentation3Context},
+		{"application/json", presentation3Context},
+		{`application/ld+json;profile="http://iiif.io/api/presentation/2/context.json"`, presentation2Context},
+		{`text/html, application/ld+json; profile="http://iiif.io/api/presentation/3/context.json"`, presentation3Context},
+		{`application/ld+json;profile="http://iiif.io/api/presentation/2/context.json", application/json;q=0.9`, presentation2Context},
+	}
+
+	for _, test := range tests {
+		if profile := presentationProfile(test.accept); profile != test.profile {
+			t.Errorf("%v: got %v want %v", test.accept, profile, test.profile)
+		}
+	}
+}
+
+func TestManifest2(t *testing.T) {
+	canvas := newCanvas("http://server/book/canvas/p1", "http://server/book/1.jpg", "Cover", 100, 200)
+	m := &Manifest{
+		ID:                "http://server/book/manifest.json",
+		Label:             newLanguageMap("A book"),
+		RequiredStatement: &MetadataEntry{newLanguageMap("Attribution"), newLanguageMap("Someone")},
+		Items:             []Canvas{canvas},
+		Structures: newRanges([]RangeSidecar{
+			{
+				Label:    "Part 1",
+				Canvases: []string{"1.jpg"},
+				Ranges:   []RangeSidecar{{Label: "Chapter 1", Canvases: []string{"1.jpg"}}},
+			},
+		}, "http://server/book/range/r", map[string]string{"1.jpg": canvas.ID}),
+	}
+
+	p := newManifest2(m)
+	if p.Type != "sc:Manifest" || p.Label != "A book" || p.Attribution != "Someone" {
+		t.Errorf("unexpected manifest %#v", p)
+	}
+
+	c := p.Sequences[0].Canvases[0]
+	if c.Label != "Cover" || c.Images[0].On != c.ID || c.Images[0].Resource.Service.ID != "http://server/book/1.jpg" {
+		t.Errorf("unexpected canvas %#v", c)
+	}
+
+	if len(p.Structures) != 2 || p.Structures[0].Ranges[0] != p.Structures[1].ID || p.Structures[1].Canvases[0] != c.ID {
+		t.Errorf("unexpected ranges %#v", p.Structures)
+	}
+}
@@ -0,0 +1,304 @@
+package iiif
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+
+	"gopkg.in/h2non/bimg.v1"
+)
+
+// TIFF tags describing the levels of a pyramid.
+const (
+	tiffImageWidth  = 256
+	tiffImageLength = 257
+	tiffTileWidth   = 322
+	tiffSubIFDs     = 330
+)
+
+// maxTIFFLevels bounds the IFDs that are read, the chain may be looping.
+const maxTIFFLevels = 64
+
+// tiffLevel is one resolution of a TIFF file. It's loaded using the libvips
+// option, e.g. page=2 or subifd=1.
+type tiffLevel struct {
+	Width  int
+	Height int
+	Tiled  bool
+	Option string
+}
+
+// tiffLevels reads the size of the images of a TIFF file, without decoding
+// them. The levels stored as sub IFDs of the first image follow it.
+func tiffLevels(filename string) []tiffLevel {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+
+	header := make([]byte, 8)
+	if _, err := f.ReadAt(header, 0); err != nil {
+		return nil
+	}
+
+	var order binary.ByteOrder
+	switch string(header[:4]) {
+	case "II*\x00":
+		order = binary.LittleEndian
+	case "MM\x00*":
+		order = binary.BigEndian
+	default:
+		// Not a TIFF, or a BigTIFF.
+		return nil
+	}
+
+	var levels []tiffLevel
+	offset := int64(order.Uint32(header[4:]))
+	for page := 0; offset != 0 && page < maxTIFFLevels; page++ {
+		level, subIFDs, next, err := readIFD(f, order, offset)
+		if err != nil {
+			break
+		}
+		level.Option = fmt.Sprintf("page=%d", page)
+		levels = append(levels, level)
+
+		if page == 0 && len(subIFDs) > 0 {
+			for i, o := range subIFDs {
+				sub, _, _, err := readIFD(f, order, o)
+				if err != nil {
+					break
+				}
+				sub.Option = fmt.Sprintf("subifd=%d", i)
+				levels = append(levels, sub)
+			}
+			break
+		}
+		offset = next
+	}
+	return levels
+}
+
+// readIFD reads the size of the image described by the IFD at offset, the
+// offsets of its sub IFDs and of the next IFD.
+func readIFD(f *os.File, order binary.ByteOrder, offset int64) (tiffLevel, []int64, int64, error) {
+	var level tiffLevel
+
+	count := make([]byte, 2)
+	if _, err := f.ReadAt(count, offset); err != nil {
+		return level, nil, 0, err
+	}
+	n := int(order.Uint16(count))
+	entries := make([]byte, n*12+4)
+	if _, err := f.ReadAt(entries, offset+2); err != nil {
+		return level, nil, 0, err
+	}
+
+	var subIFDs []int64
+	for i := 0; i < n; i++ {
+		entry := entries[i*12 : (i+1)*12]
+		tag, typ := order.Uint16(entry), order.Uint16(entry[2:])
+		values := int(order.Uint32(entry[4:]))
+
+		// SHORT values are left-justified in the LONG field.
+		value := int64(order.Uint32(entry[8:]))
+		if typ == 3 {
+			value = int64(order.Uint16(entry[8:]))
+		}
+
+		switch tag {
+		case tiffImageWidth:
+			level.Width = int(value)
+		case tiffImageLength:
+			level.Height = int(value)
+		case tiffTileWidth:
+			level.Tiled = true
+		case tiffSubIFDs:
+			if values == 1 {
+				subIFDs = append(subIFDs, value)
+				continue
+			}
+			if values > maxTIFFLevels {
+				values = maxTIFFLevels
+			}
+			buffer := make([]byte, values*4)
+			if _, err := f.ReadAt(buffer, value); err != nil {
+				return level, nil, 0, err
+			}
+			for j := 0; j < values; j++ {
+				subIFDs = append(subIFDs, int64(order.Uint32(buffer[j*4:])))
+			}
+		}
+	}
+
+	next := int64(order.Uint32(entries[n*12:]))
+	return level, subIFDs, next, nil
+}
+
+// isPyramid tells whether the levels are the reduced versions of the first,
+// tiled, one rather than the pages of a document.
+func isPyramid(levels []tiffLevel) bool {
+	if len(levels) < 2 || !levels[0].Tiled {
+		return false
+	}
+	for i := 1; i < len(levels); i++ {
+		if levels[i].Width >= levels[i-1].Width || levels[i].Height >= levels[i-1].Height {
+			return false
+		}
+	}
+	return true
+}
+
+// openPyramid decodes the region of the smallest level that is large enough
+// for the requested size. The request is rewritten to apply to that level, it
+// stays nil when none is given. The size of the full resolution is returned
+// as well.
+func openPyramid(filename string, levels []tiffLevel, vars map[string]string, config *Config) ([]byte, *bimg.ImageSize, map[string]string, error) {
+	full := levels[0]
+	size := &bimg.ImageSize{Width: full.Width, Height: full.Height}
+
+	if vars == nil {
+		buffer, err := vipsLoad(filename, levels[len(levels)-1], nil)
+		return buffer, size, nil, err
+	}
+
+	scale, rewritten, err := scaleRequest(full.Width, full.Height, vars, config)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	level := full
+	if scale < 1 {
+		for _, l := range levels[1:] {
+			if float64(l.Width) >= math.Ceil(float64(full.Width)*scale) && float64(l.Height) >= math.Ceil(float64(full.Height)*scale) {
+				level = l
+			}
+		}
+	} else {
+		// The size remains relative to the region.
+		rewritten["size"] = vars["size"]
+	}
+
+	box := regionBox(vars["region"], full.Width, full.Height)
+	if box != nil {
+		r := float64(level.Width) / float64(full.Width)
+		left := int(math.Floor(float64(box[0]) * r))
+		top := int(math.Floor(float64(box[1]) * r))
+		right := int(math.Min(math.Ceil(float64(box[0]+box[2])*r), float64(level.Width)))
+		bottom := int(math.Min(math.Ceil(float64(box[1]+box[3])*r), float64(level.Height)))
+		box = []int{left, top, right - left, bottom - top}
+		rewritten["region"] = "full"
+	}
+
+	buffer, err := vipsLoad(filename, level, box)
+	return buffer, size, rewritten, err
+}
+
+// scaleRequest computes the ratio between the requested output and the full
+// resolution of the region. The size is rewritten to the exact output size,
+// so that it doesn't depend on the resolution at which the source is read.
+func scaleRequest(width, height int, vars map[string]string, config *Config) (float64, map[string]string, error) {
+	opts := bimg.Options{
+		Width:  width,
+		Height: height,
+	}
+	size := fitSize(vars["size"], vars["region"], width, height)
+	err := handleSizeAndRegion(size, vars["region"], config, &opts)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	scale := math.Max(float64(opts.Width)/float64(width), float64(opts.Height)/float64(height))
+
+	// The output size, see handleSizeAndRegion.
+	w, h := opts.Width, opts.Height
+	if opts.AreaWidth != 0 {
+		w, h = opts.AreaWidth, opts.AreaHeight
+	}
+
+	rewritten := make(map[string]string, len(vars))
+	for k, v := range vars {
+		rewritten[k] = v
+	}
+	rewritten["size"] = fmt.Sprintf("%d,%d", w, h)
+
+	return scale, rewritten, nil
+}
+
+// fitSize turns a best fit size (!w,h) into the size of the output, the
+// rewritten request being otherwise stretched to the bounding box. Any other
+// size is kept as is.
+func fitSize(size, region string, width, height int) string {
+	if !strings.HasPrefix(size, "!") {
+		return size
+	}
+	sizes := strings.Split(size[1:], ",")
+	if len(sizes) != 2 {
+		return size
+	}
+	w, errW := strconv.Atoi(sizes[0])
+	h, errH := strconv.Atoi(sizes[1])
+	if errW != nil || errH != nil || w <= 0 || h <= 0 {
+		return size
+	}
+
+	// The smart regions take the ratio of the size.
+	rw, rh := width, height
+	switch region {
+	case "smart":
+		return size
+	case "square":
+		rw = minInt(width, height)
+		rh = rw
+	default:
+		if box := regionBox(region, width, height); box != nil {
+			rw, rh = box[2], box[3]
+		}
+	}
+	if rw <= 0 || rh <= 0 {
+		return size
+	}
+
+	ratio := math.Min(float64(w)/float64(rw), float64(h)/float64(rh))
+	fw := maxInt(1, int(math.Round(float64(rw)*ratio)))
+	fh := maxInt(1, int(math.Round(float64(rh)*ratio)))
+	return fmt.Sprintf("%d,%d", fw, fh)
+}
+
+// regionBox gives the x, y, w and h of the region in pixels, or nothing when
+// it isn't a fixed area (full, square or smart). The region is expected to
+// be valid, see handleSizeAndRegion.
+func regionBox(region string, width, height int) []int {
+	isPercent := strings.HasPrefix(region, "pct:")
+	sizes := strings.Split(strings.TrimPrefix(region, "pct:"), ",")
+	if len(sizes) != 4 {
+		return nil
+	}
+
+	box := make([]int, 4)
+	for i, s := range sizes {
+		n, _ := strconv.ParseFloat(s, 64)
+		if isPercent {
+			total := float64(width)
+			if i%2 == 1 {
+				total = float64(height)
+			}
+			n = total * n / 100.
+		}
+		box[i] = int(n)
+	}
+	return box
+}
+
+// vipsLoad reads the level, only the tiles covering the box, if any, are
+// decoded.
+func vipsLoad(filename string, level tiffLevel, box []int) ([]byte, error) {
+	load := filename
+	if level.Option != "" {
+		load = fmt.Sprintf("%s[%s]", filename, level.Option)
+	}
+	return vipsLoadFile(load, box)
+}
@@ -0,0 +1,150 @@
+package iiif
+
+import (
+	"encoding/json"
+	"image/png"
+	"log"
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+func TestTIFFLevels(t *testing.T) {
+	var tests = []struct {
+		filename string
+		levels   int
+		pyramid  bool
+	}{
+		{"../fixtures/pyramid.tif", 3, true},
+		{"../fixtures/pages.tif", 2, false},
+		{"../fixtures/lena.jpg", 0, false},
+		{"../fixtures/missing.tif", 0, false},
+	}
+
+	for _, test := range tests {
+		levels := tiffLevels(test.filename)
+		if len(levels) != test.levels {
+			t.Errorf("%v: expected %v levels, got %v", test.filename, test.levels, len(levels))
+		}
+		if isPyramid(levels) != test.pyramid {
+			t.Errorf("%v: expected pyramid to be %v", test.filename, test.pyramid)
+		}
+	}
+
+	levels := tiffLevels("../fixtures/pyramid.tif")
+	expected := tiffLevel{Width: 128, Height: 96, Tiled: true, Option: "page=1"}
+	if len(levels) > 1 && levels[1] != expected {
+		t.Errorf("got %#v want %#v", levels[1], expected)
+	}
+}
+
+func TestRegionBox(t *testing.T) {
+	var tests = []struct {
+		region string
+		box    []int
+	}{
+		{"full", nil},
+		{"square", nil},
+		{"10,20,30,40", []int{10, 20, 30, 40}},
+		{"pct:50,25,50,75", []int{128, 48, 128, 144}},
+	}
+
+	for _, test := range tests {
+		if box := regionBox(test.region, 256, 192); !reflect.DeepEqual(box, test.box) {
+			t.Errorf("%v: got %v want %v", test.region, box, test.box)
+		}
+	}
+}
+
+func TestFitSize(t *testing.T) {
+	var tests = []struct {
+		size   string
+		region string
+		fitted string
+	}{
+		{"!100,100", "full", "100,75"},
+		{"!100,50", "full", "67,50"},
+		{"!100,100", "square", "100,100"},
+		{"!64,64", "0,0,128,64", "64,32"},
+		{"!100,100", "smart", "!100,100"},
+		{"100,100", "full", "100,100"},
+		{"!x,100", "full", "!x,100"},
+	}
+
+	for _, test := range tests {
+		if fitted := fitSize(test.size, test.region, 256, 192); fitted != test.fitted {
+			t.Errorf("%v %v: got %v want %v", test.region, test.size, fitted, test.fitted)
+		}
+	}
+}
+
+func TestPyramid(t *testing.T) {
+	ts := newServer()
+	defer ts.Close()
+
+	var tests = []struct {
+		url    string
+		width  int
+		height int
+		// the blue channel tells the level apart.
+		blue uint32
+		red  uint32
+	}{
+		{"/pyramid.tif/full/max/0/default.png", 256, 192, 0, 0},
+		{"/pyramid.tif/full/100,/0/default.png", 100, 75, 100, 0},
+		{"/pyramid.tif/full/!100,100/0/default.png", 100, 75, 100, 0},
+		{"/pyramid.tif/full/64,/0/default.png", 64, 48, 200, 0},
+		{"/pyramid.tif/full/pct:10/0/default.png", 25, 19, 200, 0},
+		{"/pyramid.tif/square/48,/0/default.png", 48, 48, 200, 32},
+		{"/pyramid.tif/128,96,128,96/64,/0/default.png", 64, 48, 100, 128},
+		{"/pyramid.tif/128,96,128,96/max/0/default.png", 128, 96, 0, 128},
+	}
+
+	for _, test := range tests {
+		resp, err := http.Get(ts.URL + test.url)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("%v: unexpected status %v", test.url, resp.StatusCode)
+			continue
+		}
+
+		img, err := png.Decode(resp.Body)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		if b := img.Bounds(); b.Dx() != test.width || b.Dy() != test.height {
+			t.Errorf("%v: got %vx%v want %vx%v", test.url, b.Dx(), b.Dy(), test.width, test.height)
+		}
+
+		r, _, b, _ := img.At(0, 0).RGBA()
+		if b>>8 != test.blue || r>>8 != test.red {
+			t.Errorf("%v: got the pixel %v,%v want %v,%v", test.url, r>>8, b>>8, test.red, test.blue)
+		}
+	}
+}
+
+func TestPyramidInfo(t *testing.T) {
+	ts := newServer()
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL + "/pyramid.tif/info.json")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	var m Image
+	err = json.NewDecoder(resp.Body).Decode(&m)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if m.Width != 256 || m.Height != 192 {
+		t.Errorf("the full resolution expected to be 256x192, got %vx%v", m.Width, m.Height)
+	}
+}
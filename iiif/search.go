@@ -0,0 +1,433 @@
+package iiif
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/golang/groupcache"
+	"github.com/gorilla/mux"
+)
+
+// error messages
+var searchError = "%#v has no text to search"
+
+// the contexts of the Content Search API versions.
+const (
+	search1Context = "http://iiif.io/api/search/1/context.json"
+	search2Context = "http://iiif.io/api/search/2/context.json"
+)
+
+// the words shown before and after a hit, and the number of terms suggested.
+const (
+	searchContextWords = 5
+	autocompleteTerms  = 20
+)
+
+// search1Ignored are the parameters of Content Search 1.0 which are not
+// supported.
+var search1Ignored = []string{"motivation", "date", "user"}
+
+// SearchService points at the Content Search 2.0 service of a manifest, and
+// its autocomplete service.
+type SearchService struct {
+	ID      string          `json:"id"`
+	Type    string          `json:"type"`
+	Service []SearchService `json:"service,omitempty"`
+}
+
+// SearchService1 points at the Content Search 1.0 service of a manifest, and
+// its autocomplete service.
+type SearchService1 struct {
+	Context string          `json:"@context,omitempty"`
+	ID      string          `json:"@id"`
+	Profile string          `json:"profile"`
+	Service *SearchService1 `json:"service,omitempty"`
+}
+
+// SearchResponse1 is the Content Search 1.0 result list, see
+// https://iiif.io/api/search/1.0/
+type SearchResponse1 struct {
+	Context   []string            `json:"@context"`
+	ID        string              `json:"@id"`
+	Type      string              `json:"@type"`
+	Within    SearchLayer1        `json:"within"`
+	Resources []SearchAnnotation1 `json:"resources"`
+	Hits      []SearchHit1        `json:"hits"`
+}
+
+// SearchLayer1 tells the number of results, and the ignored parameters.
+type SearchLayer1 struct {
+	Type    string   `json:"@type"`
+	Total   int      `json:"total"`
+	Ignored []string `json:"ignored,omitempty"`
+}
+
+// SearchAnnotation1 is the box of a matching text.
+type SearchAnnotation1 struct {
+	ID         string        `json:"@id"`
+	Type       string        `json:"@type"`
+	Motivation string        `json:"motivation"`
+	Resource   TextResource1 `json:"resource"`
+	On         string        `json:"on"`
+}
+
+// TextResource1 is a text.
+type TextResource1 struct {
+	Type  string `json:"@type"`
+	Chars string `json:"chars"`
+}
+
+// SearchHit1 is a match, and the text around it.
+type SearchHit1 struct {
+	Type        string   `json:"@type"`
+	Annotations []string `json:"annotations"`
+	Match       string   `json:"match"`
+	Before      string   `json:"before,omitempty"`
+	After       string   `json:"after,omitempty"`
+}
+
+// SearchResponse2 is the Content Search 2.0 result page, see
+// https://iiif.io/api/search/2.0/
+type SearchResponse2 struct {
+	Context     string                  `json:"@context"`
+	ID          string                  `json:"id"`
+	Type        string                  `json:"type"`
+	Items       []SearchAnnotation2     `json:"items"`
+	Annotations []SearchAnnotationPage2 `json:"annotations,omitempty"`
+}
+
+// SearchAnnotationPage2 contains the annotations giving the context of the
+// hits.
+type SearchAnnotationPage2 struct {
+	Type  string              `json:"type"`
+	Items []SearchAnnotation2 `json:"items"`
+}
+
+// SearchAnnotation2 is either the box of a matching text, or its context.
+type SearchAnnotation2 struct {
+	ID         string      `json:"id"`
+	Type       string      `json:"type"`
+	Motivation string      `json:"motivation"`
+	Body       *TextBody2  `json:"body,omitempty"`
+	Target     interface{} `json:"target"`
+}
+
+// TextBody2 is a text.
+type TextBody2 struct {
+	Type   string `json:"type"`
+	Value  string `json:"value"`
+	Format string `json:"format"`
+}
+
+// TextQuoteTarget2 selects the matching text of an annotation.
+type TextQuoteTarget2 struct {
+	Type     string              `json:"type"`
+	Source   string              `json:"source"`
+	Selector []TextQuoteSelector `json:"selector"`
+}
+
+// TextQuoteSelector is the matching text and the text around it.
+type TextQuoteSelector struct {
+	Type   string `json:"type"`
+	Prefix string `json:"prefix,omitempty"`
+	Exact  string `json:"exact"`
+	Suffix string `json:"suffix,omitempty"`
+}
+
+// TermList1 are the Content Search 1.0 autocomplete suggestions.
+type TermList1 struct {
+	Context string  `json:"@context"`
+	ID      string  `json:"@id"`
+	Type    string  `json:"@type"`
+	Terms   []Term1 `json:"terms"`
+}
+
+// Term1 is a suggestion, and the search giving its hits.
+type Term1 struct {
+	Match string `json:"match"`
+	URL   string `json:"url"`
+	Count int    `json:"count"`
+}
+
+// TermPage2 are the Content Search 2.0 autocomplete suggestions.
+type TermPage2 struct {
+	Context string  `json:"@context"`
+	ID      string  `json:"id"`
+	Type    string  `json:"type"`
+	Items   []Term2 `json:"items"`
+}
+
+// Term2 is a suggestion, and the number of its hits.
+type Term2 struct {
+	Value string `json:"value"`
+	Total int    `json:"total"`
+}
+
+// searchPage is the text of a canvas of the manifest, or of the image itself,
+// and the scale of its boxes. The target is relative to the base URL.
+type searchPage struct {
+	Target string
+	Text   *ocrPage
+	ScaleX float64
+	ScaleY float64
+}
+
+// searchHit are the words of the page matching the terms, and their regions
+// line by line.
+type searchHit struct {
+	Page    int
+	Start   int
+	End     int
+	Regions []string
+}
+
+// SearchHandler responds with the Content Search results of the image or
+// directory, the version being 1 or 2.
+func SearchHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	identifier, index, ok := searchRequest(w, r)
+	if !ok {
+		return
+	}
+
+	q := r.URL.Query().Get("q")
+	var terms []string
+	for _, field := range strings.Fields(q) {
+		if term := normalizeTerm(field); term != "" {
+			terms = append(terms, term)
+		}
+	}
+	hits := index.search(terms)
+
+	id := fmt.Sprintf("%s/%s/search/%s?q=%s", baseURL(r), identifier, vars["version"], url.QueryEscape(q))
+	annotation := func(hit searchHit, i int) string {
+		return fmt.Sprintf("%s/%s/search/annotation/p%d-%d-%d", baseURL(r), identifier, hit.Page+1, hit.Start, i)
+	}
+
+	var p interface{}
+	if vars["version"] == "1" {
+		response := &SearchResponse1{
+			Context:   []string{presentation2Context, search1Context},
+			ID:        id,
+			Type:      "sc:AnnotationList",
+			Within:    SearchLayer1{Type: "sc:Layer", Total: len(hits)},
+			Resources: []SearchAnnotation1{},
+			Hits:      []SearchHit1{},
+		}
+		for _, name := range search1Ignored {
+			if r.URL.Query().Get(name) != "" {
+				response.Within.Ignored = append(response.Within.Ignored, name)
+			}
+		}
+		for _, hit := range hits {
+			page := index.Pages[hit.Page]
+			before, match, after := page.Text.context(hit.Start, hit.End)
+			h := SearchHit1{
+				Type:   "search:Hit",
+				Match:  match,
+				Before: before,
+				After:  after,
+			}
+			for i, region := range hit.Regions {
+				h.Annotations = append(h.Annotations, annotation(hit, i))
+				response.Resources = append(response.Resources, SearchAnnotation1{
+					ID:         annotation(hit, i),
+					Type:       "oa:Annotation",
+					Motivation: "sc:painting",
+					Resource:   TextResource1{"cnt:ContentAsText", match},
+					On:         baseURL(r) + page.Target + "#xywh=" + region,
+				})
+			}
+			response.Hits = append(response.Hits, h)
+		}
+		p = response
+	} else {
+		response := &SearchResponse2{
+			Context: search2Context,
+			ID:      id,
+			Type:    "AnnotationPage",
+			Items:   []SearchAnnotation2{},
+		}
+		context := SearchAnnotationPage2{Type: "AnnotationPage"}
+		for _, hit := range hits {
+			page := index.Pages[hit.Page]
+			before, match, after := page.Text.context(hit.Start, hit.End)
+			for i, region := range hit.Regions {
+				response.Items = append(response.Items, SearchAnnotation2{
+					ID:         annotation(hit, i),
+					Type:       "Annotation",
+					Motivation: "highlighting",
+					Body:       &TextBody2{"TextualBody", match, "text/plain"},
+					Target:     baseURL(r) + page.Target + "#xywh=" + region,
+				})
+				context.Items = append(context.Items, SearchAnnotation2{
+					ID:         annotation(hit, i) + "-context",
+					Type:       "Annotation",
+					Motivation: "contextualizing",
+					Target: TextQuoteTarget2{
+						Type:   "SpecificResource",
+						Source: annotation(hit, i),
+						Selector: []TextQuoteSelector{
+							{"TextQuoteSelector", before, match, after},
+						},
+					},
+				})
+			}
+		}
+		if len(context.Items) > 0 {
+			response.Annotations = []SearchAnnotationPage2{context}
+		}
+		p = response
+	}
+
+	serveSearch(w, r, p)
+}
+
+// AutocompleteHandler responds with the terms of the image or directory
+// starting like the query, the most frequent first.
+func AutocompleteHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	identifier, index, ok := searchRequest(w, r)
+	if !ok {
+		return
+	}
+
+	q := r.URL.Query().Get("q")
+	terms := index.autocomplete(normalizeTerm(q))
+	id := fmt.Sprintf("%s/%s/autocomplete/%s?q=%s", baseURL(r), identifier, vars["version"], url.QueryEscape(q))
+
+	var p interface{}
+	if vars["version"] == "1" {
+		list := &TermList1{
+			Context: search1Context,
+			ID:      id,
+			Type:    "search:TermList",
+			Terms:   []Term1{},
+		}
+		for _, term := range terms {
+			list.Terms = append(list.Terms, Term1{
+				Match: term.Value,
+				URL:   fmt.Sprintf("%s/%s/search/1?q=%s", baseURL(r), identifier, url.QueryEscape(term.Value)),
+				Count: term.Total,
+			})
+		}
+		p = list
+	} else {
+		p = &TermPage2{
+			Context: search2Context,
+			ID:      id,
+			Type:    "TermPage",
+			Items:   terms,
+		}
+	}
+
+	serveSearch(w, r, p)
+}
+
+// searchRequest gives the identifier of the request and the index of its
+// pages, responding with an error when there are none.
+func searchRequest(w http.ResponseWriter, r *http.Request) (string, *searchIndex, bool) {
+	identifier, err := url.QueryUnescape(mux.Vars(r)["identifier"])
+	if err != nil {
+		log.Printf("Filename is frob %#v", identifier)
+		serveError(w, r, HTTPError{http.StatusNotFound, identifier})
+		return "", nil, false
+	}
+
+	ctx := r.Context()
+	config, _ := ctx.Value(ContextKey("config")).(*Config)
+	images, _ := ctx.Value(ContextKey("images")).(*groupcache.Group)
+
+	identifier = strings.Trim(strings.Replace(identifier, "../", "", -1), "/")
+
+	index, err := loadSearchIndex(identifier, config, images)
+	if err != nil {
+		serveError(w, r, err)
+		return "", nil, false
+	}
+	return identifier, index, true
+}
+
+func serveSearch(w http.ResponseWriter, r *http.Request, p interface{}) {
+	buffer, err := json.MarshalIndent(p, "", "  ")
+	if err != nil {
+		serveError(w, r, HTTPError{http.StatusInternalServerError, "Cannot create the search results"})
+		return
+	}
+
+	header := w.Header()
+	if strings.Contains(r.Header.Get("Accept"), "application/ld+json") {
+		header.Set("Content-Type", "application/ld+json")
+	} else {
+		header.Set("Content-Type", "application/json")
+	}
+	header.Set("Access-Control-Allow-Origin", "*")
+	w.Write(buffer)
+}
+
+// regions gives the IIIF regions of the words, one per line.
+func (p searchPage) regions(start, end int) []string {
+	var regions []string
+	words := p.Text.Words[start:end]
+	for i := 0; i < len(words); {
+		x0, y0 := words[i].X, words[i].Y
+		x1, y1 := words[i].X+words[i].W, words[i].Y+words[i].H
+		j := i + 1
+		for ; j < len(words) && words[j].Line == words[i].Line; j++ {
+			x0 = minInt(x0, words[j].X)
+			y0 = minInt(y0, words[j].Y)
+			x1 = maxInt(x1, words[j].X+words[j].W)
+			y1 = maxInt(y1, words[j].Y+words[j].H)
+		}
+
+		x, y := math.Floor(float64(x0)*p.ScaleX), math.Floor(float64(y0)*p.ScaleY)
+		w, h := math.Ceil(float64(x1)*p.ScaleX)-x, math.Ceil(float64(y1)*p.ScaleY)-y
+		regions = append(regions, fmt.Sprintf("%d,%d,%d,%d", int(x), int(y), int(w), int(h)))
+		i = j
+	}
+	return regions
+}
+
+// context gives the words before, of and after the hit.
+func (p *ocrPage) context(start, end int) (string, string, string) {
+	text := func(words []ocrWord) string {
+		var b bytes.Buffer
+		for i, word := range words {
+			if i > 0 {
+				b.WriteString(" ")
+			}
+			b.WriteString(word.Text)
+		}
+		return b.String()
+	}
+
+	before := start - searchContextWords
+	if before < 0 {
+		before = 0
+	}
+	after := end + searchContextWords
+	if after > len(p.Words) {
+		after = len(p.Words)
+	}
+	return text(p.Words[before:start]), text(p.Words[start:end]), text(p.Words[end:after])
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,125 @@
+package iiif
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSearch(t *testing.T) {
+	text, err := parseALTO(strings.NewReader(testALTO))
+	if err != nil {
+		t.Fatal(err)
+	}
+	index := newSearchIndex([]searchPage{{Target: "/page.jpg", Text: text, ScaleX: 1, ScaleY: 1}})
+
+	hits := index.search([]string{"northern", "cardinal"})
+	if len(hits) != 1 || hits[0].Start != 1 || hits[0].End != 3 {
+		t.Fatalf("unexpected hits %#v", hits)
+	}
+	if expected := []string{"50,20,80,15", "10,40,70,15"}; !reflect.DeepEqual(hits[0].Regions, expected) {
+		t.Errorf("got the regions %v want %v", hits[0].Regions, expected)
+	}
+
+	before, match, after := text.context(hits[0].Start, hits[0].End)
+	if before != "The" || match != "Northern Cardinal," || after != "bird" {
+		t.Errorf("unexpected context %#v %#v %#v", before, match, after)
+	}
+
+	if hits = index.search([]string{"cardinal", "northern"}); len(hits) != 0 {
+		t.Errorf("no hits were expected, got %#v", hits)
+	}
+
+	index.Pages[0].ScaleX, index.Pages[0].ScaleY = 0.5, 0.5
+	if regions := index.Pages[0].regions(3, 4); regions[0] != "55,20,20,8" {
+		t.Errorf("unexpected scaled region %v", regions)
+	}
+
+	terms := index.autocomplete("n")
+	if len(terms) != 1 || terms[0].Value != "northern" || terms[0].Total != 1 {
+		t.Errorf("unexpected terms %#v", terms)
+	}
+}
+
+func TestSearchHandler(t *testing.T) {
+	images, err := ioutil.TempDir("", "iiif-images")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(images)
+
+	book := filepath.Join(images, "book")
+	if err = os.Mkdir(book, 0755); err != nil {
+		log.Fatal(err)
+	}
+	for name, data := range map[string]string{"1.jpg": "", "2.jpg": "", "2.xml": testALTO} {
+		if err = ioutil.WriteFile(filepath.Join(book, name), []byte(data), 0644); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	ts := httptest.NewServer(WithConfig(MakeRouter(), &Config{Images: images}))
+	defer ts.Close()
+
+	get := func(u string, p interface{}) int {
+		resp, err := http.Get(ts.URL + u)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode == http.StatusOK {
+			if err = json.NewDecoder(resp.Body).Decode(p); err != nil {
+				log.Fatal(err)
+			}
+		}
+		return resp.StatusCode
+	}
+
+	var r1 SearchResponse1
+	get("/book/search/1?q=cardinal&motivation=painting", &r1)
+	if len(r1.Hits) != 1 || r1.Within.Total != 1 || r1.Within.Ignored[0] != "motivation" {
+		t.Fatalf("unexpected results %#v", r1)
+	}
+	if on := r1.Resources[0].On; on != ts.URL+"/book/canvas/p2#xywh=10,40,70,15" {
+		t.Errorf("unexpected target %v", on)
+	}
+
+	var r2 SearchResponse2
+	get("/book/2.jpg/search/2?q=Northern+Cardinal", &r2)
+	if len(r2.Items) != 2 || r2.Items[0].Target != ts.URL+"/book/2.jpg#xywh=50,20,80,15" || len(r2.Annotations[0].Items) != 2 {
+		t.Errorf("unexpected results %#v", r2)
+	}
+
+	var terms TermList1
+	get("/book/autocomplete/1?q=car", &terms)
+	if len(terms.Terms) != 1 || terms.Terms[0].Match != "cardinal" || terms.Terms[0].URL != ts.URL+"/book/search/1?q=cardinal" {
+		t.Errorf("unexpected terms %#v", terms)
+	}
+
+	// The index is built again once the text changes.
+	alto := filepath.Join(book, "2.xml")
+	if err = ioutil.WriteFile(alto, []byte(strings.Replace(testALTO, "Cardinal", "Robin", -1)), 0644); err != nil {
+		log.Fatal(err)
+	}
+	later := time.Now().Add(time.Minute)
+	if err = os.Chtimes(alto, later, later); err != nil {
+		log.Fatal(err)
+	}
+	get("/book/autocomplete/1?q=car", &terms)
+	if len(terms.Terms) != 0 {
+		t.Errorf("the index wasn't updated %#v", terms)
+	}
+
+	var nothing SearchResponse2
+	if status := get("/book/1.jpg/search/2?q=bird", &nothing); status != http.StatusNotFound {
+		t.Errorf("an image without text expected a 404, got %v", status)
+	}
+}
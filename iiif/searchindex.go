@@ -0,0 +1,243 @@
+package iiif
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/groupcache"
+)
+
+// maxSearchIndexes is the number of indexes kept in memory, the least
+// recently used being dropped.
+const maxSearchIndexes = 64
+
+// searchIndex is the text of the pages of an image or directory, and where
+// their terms are.
+type searchIndex struct {
+	State    string
+	Pages    []searchPage
+	Postings map[string][]searchPosting
+	// Terms are sorted by value, for the autocompletion.
+	Terms []Term2
+	used  time.Time
+}
+
+// searchPosting is the position of a term, the word of a page.
+type searchPosting struct {
+	Page int
+	Word int
+}
+
+// searchIndexes are the indexes by identifier.
+var searchIndexes = struct {
+	sync.Mutex
+	m map[string]*searchIndex
+}{m: make(map[string]*searchIndex)}
+
+// searchSource is an image having a text.
+type searchSource struct {
+	Identifier string
+	Target     string
+	OCR        string
+	OCRStat    os.FileInfo
+}
+
+// loadSearchIndex gives the index of the image, or of the images of the
+// directory as the canvases of its manifest. The targets of the pages are
+// relative to the base URL of the server. The index is built again once the
+// texts or the images change.
+func loadSearchIndex(identifier string, config *Config, images *groupcache.Group) (*searchIndex, error) {
+	sources, state, err := searchSources(identifier, config)
+	if err != nil {
+		return nil, err
+	}
+
+	searchIndexes.Lock()
+	index, ok := searchIndexes.m[identifier]
+	if ok && index.State == state {
+		index.used = time.Now()
+		searchIndexes.Unlock()
+		return index, nil
+	}
+	searchIndexes.Unlock()
+
+	var pages []searchPage
+	for _, source := range sources {
+		text, err := loadOCR(source.OCR, source.OCRStat, images)
+		if err != nil {
+			log.Printf("Cannot read the text of %#v: %s", source.Identifier, err)
+			continue
+		}
+
+		page := searchPage{Target: source.Target, Text: text, ScaleX: 1, ScaleY: 1}
+		if text.Width > 0 && text.Height > 0 {
+			size, _, err := loadImageSize(source.Identifier, config, images)
+			if err != nil {
+				log.Printf("Cannot scale the text of %#v: %s", source.Identifier, err)
+				continue
+			}
+			page.ScaleX = float64(size.Width) / text.Width
+			page.ScaleY = float64(size.Height) / text.Height
+		}
+		pages = append(pages, page)
+	}
+
+	if len(pages) == 0 {
+		return nil, HTTPError{http.StatusNotFound, fmt.Sprintf(searchError, identifier)}
+	}
+
+	index = newSearchIndex(pages)
+	index.State = state
+	index.used = time.Now()
+
+	searchIndexes.Lock()
+	defer searchIndexes.Unlock()
+	searchIndexes.m[identifier] = index
+	if len(searchIndexes.m) > maxSearchIndexes {
+		oldest := ""
+		for k, v := range searchIndexes.m {
+			if oldest == "" || v.used.Before(searchIndexes.m[oldest].used) {
+				oldest = k
+			}
+		}
+		delete(searchIndexes.m, oldest)
+	}
+	return index, nil
+}
+
+// searchSources lists the images of the identifier having a text, and
+// fingerprints them from their files without reading them.
+func searchSources(identifier string, config *Config) ([]searchSource, string, error) {
+	filename := filepath.Join(config.Images, identifier)
+	stat, err := os.Stat(filename)
+	if err != nil {
+		return nil, "", HTTPError{http.StatusNotFound, fmt.Sprintf(searchError, identifier)}
+	}
+
+	identifiers := []string{identifier}
+	targets := []string{"/" + identifier}
+	if stat.IsDir() {
+		names, err := listImages(filename, config)
+		if err != nil {
+			return nil, "", HTTPError{http.StatusNotFound, fmt.Sprintf(searchError, identifier)}
+		}
+		identifiers, targets = nil, nil
+		for i, name := range names {
+			identifiers = append(identifiers, identifier+"/"+name)
+			targets = append(targets, canvasID("/"+identifier, i))
+		}
+	}
+
+	var sources []searchSource
+	hash := sha1.New()
+	for i, imageIdentifier := range identifiers {
+		imageFilename := filepath.Join(config.Images, imageIdentifier)
+		ocr, ocrStat, ok := findOCR(imageFilename)
+		if !ok {
+			continue
+		}
+		sources = append(sources, searchSource{imageIdentifier, targets[i], ocr, ocrStat})
+
+		fmt.Fprintf(hash, "%s %s %d %d", imageIdentifier, ocr, ocrStat.Size(), ocrStat.ModTime().UnixNano())
+		if imageStat, err := os.Stat(imageFilename); err == nil {
+			fmt.Fprintf(hash, " %d %d", imageStat.Size(), imageStat.ModTime().UnixNano())
+		}
+		fmt.Fprintln(hash)
+	}
+
+	if len(sources) == 0 {
+		return nil, "", HTTPError{http.StatusNotFound, fmt.Sprintf(searchError, identifier)}
+	}
+	return sources, fmt.Sprintf("%x", hash.Sum(nil)), nil
+}
+
+// newSearchIndex indexes the terms of the pages.
+func newSearchIndex(pages []searchPage) *searchIndex {
+	index := &searchIndex{
+		Pages:    pages,
+		Postings: make(map[string][]searchPosting),
+	}
+	for p, page := range pages {
+		for w, word := range page.Text.Words {
+			if word.Term == "" {
+				continue
+			}
+			index.Postings[word.Term] = append(index.Postings[word.Term], searchPosting{p, w})
+		}
+	}
+
+	for term, postings := range index.Postings {
+		index.Terms = append(index.Terms, Term2{term, len(postings)})
+	}
+	sort.Slice(index.Terms, func(i, j int) bool {
+		return index.Terms[i].Value < index.Terms[j].Value
+	})
+	return index
+}
+
+// search finds the consecutive words matching the terms, from the positions
+// of the first one.
+func (index *searchIndex) search(terms []string) []searchHit {
+	var hits []searchHit
+	if len(terms) == 0 {
+		return hits
+	}
+
+	for _, posting := range index.Postings[terms[0]] {
+		page := index.Pages[posting.Page]
+		words := page.Text.Words
+		start, end := posting.Word, posting.Word+len(terms)
+		if end > len(words) {
+			continue
+		}
+
+		match := true
+		for j, term := range terms[1:] {
+			if words[start+j+1].Term != term {
+				match = false
+				break
+			}
+		}
+		if match {
+			hits = append(hits, searchHit{
+				Page:    posting.Page,
+				Start:   start,
+				End:     end,
+				Regions: page.regions(start, end),
+			})
+		}
+	}
+	return hits
+}
+
+// autocomplete gives the terms starting with the prefix, the most frequent
+// first.
+func (index *searchIndex) autocomplete(prefix string) []Term2 {
+	terms := []Term2{}
+	if prefix == "" {
+		return terms
+	}
+
+	i := sort.Search(len(index.Terms), func(i int) bool {
+		return index.Terms[i].Value >= prefix
+	})
+	for ; i < len(index.Terms) && strings.HasPrefix(index.Terms[i].Value, prefix); i++ {
+		terms = append(terms, index.Terms[i])
+	}
+
+	sort.SliceStable(terms, func(i, j int) bool {
+		return terms[i].Total > terms[j].Total
+	})
+	if len(terms) > autocompleteTerms {
+		terms = terms[:autocompleteTerms]
+	}
+	return terms
+}
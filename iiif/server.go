@@ -1,7 +1,9 @@
 package iiif
 
 import (
+	"fmt"
 	"net/http"
+	"strings"
 
 	"github.com/golang/groupcache"
 	"github.com/gorilla/mux"
@@ -11,10 +13,30 @@ import (
 func MakeRouter() http.Handler {
 	router := mux.NewRouter()
 
+	router.MatcherFunc(isIIP).HandlerFunc(IIPHandler)
+
 	router.HandleFunc("/", IndexHandler)
 	router.HandleFunc("/demo", DemoHandler)
+	router.HandleFunc("/activity/all-changes", ActivityCollectionHandler)
+	router.HandleFunc("/activity/page/{page:[0-9]+}", ActivityPageHandler)
 	router.HandleFunc("/{identifier:.*}/info.json", InfoHandler)
+	router.HandleFunc("/{identifier:.*}/metadata.json", MetadataHandler)
+	router.HandleFunc("/{identifier:.*}/pages.json", PagesHandler)
+	router.HandleFunc("/{identifier:.*}/focus.json", FocusHandler)
+	router.HandleFunc("/{identifier:.*}/manifest.json", ManifestHandler)
+	router.HandleFunc("/{identifier:.*}/search/{version:[12]}", SearchHandler)
+	router.HandleFunc("/{identifier:.*}/autocomplete/{version:[12]}", AutocompleteHandler)
+	router.HandleFunc("/{identifier:.*}/annotations/", AnnotationContainerHandler)
+	router.HandleFunc("/{identifier:.*}/annotations/{id:[^/]+}", AnnotationHandler)
+	router.HandleFunc("/{identifier:.*}.dzi", DZIHandler)
+	router.HandleFunc("/{identifier:.*}_files/{level:[0-9]+}/{col:[0-9]+}_{row:[0-9]+}.{format}", DZITileHandler)
+	router.HandleFunc("/{identifier:.*}/tiles.json", TileJSONHandler)
+	router.HandleFunc("/{identifier:.*}/tiles/{z:[0-9]+}/{x:[0-9]+}/{y:[0-9]+}.{format}", XYZTileHandler)
+	router.HandleFunc("/{identifier:.*}/ImageProperties.xml", ZoomifyHandler)
+	router.HandleFunc("/{identifier:.*}/TileGroup{group:[0-9]+}/{z:[0-9]+}-{x:[0-9]+}-{y:[0-9]+}.jpg", ZoomifyTileHandler)
 	router.HandleFunc("/{identifier:.*}/{region}/{size}/{rotation}/{quality}.{format}", ImageHandler)
+	router.HandleFunc("/collection", CollectionHandler)
+	router.HandleFunc("/collection/{path:.*}", CollectionHandler)
 	router.HandleFunc("/{identifier:.*}/{viewer}.html", ViewerHandler)
 	router.HandleFunc("/{identifier:.*}", RedirectHandler)
 
@@ -27,14 +49,59 @@ func SetGroupCache(router http.Handler, config *Config, peers ...string) http.Ha
 	pool := groupcache.NewHTTPPool(peers[0])
 	pool.Set(peers...)
 
-	var images = groupcache.NewGroup("images", config.Cache.ImagesSize, groupcache.GetterFunc(
+	var images *groupcache.Group
+	images = groupcache.NewGroup("images", config.Cache.ImagesSize, groupcache.GetterFunc(
 		func(ctx groupcache.Context, key string, dest groupcache.Sink) error {
-			url := key
-			data, err := downloadImage(url)
+			if strings.HasPrefix(key, metadataPrefix) {
+				data, err := readMetadata(metadataKey(key), config, images)
+				if err != nil {
+					return err
+				}
+				dest.SetBytes(data)
+				return nil
+			}
+
+			if strings.HasPrefix(key, sizePrefix) {
+				data, err := readImageSize(sizeKey(key), config, images)
+				if err != nil {
+					return err
+				}
+				dest.SetBytes(data)
+				return nil
+			}
+
+			if strings.HasPrefix(key, ocrPrefix) {
+				data, err := readOCR(ocrKey(key))
+				if err != nil {
+					return err
+				}
+				dest.SetBytes(data)
+				return nil
+			}
+
+			if strings.HasPrefix(key, collectionPrefix) {
+				data, err := readCollection(collectionKey(key), config)
+				if err != nil {
+					return err
+				}
+				dest.SetBytes(data)
+				return nil
+			}
+
+			if !isRemote(key) {
+				return fmt.Errorf(remoteError, key)
+			}
+			data, modTime, err := downloadImage(key)
 			if err != nil {
 				return err
 			}
-			dest.SetBytes(data)
+
+			binTime, _ := modTime.MarshalBinary()
+
+			dest.SetProto(&CacheableImage{
+				binTime,
+				data,
+			})
 			return nil
 		},
 	))
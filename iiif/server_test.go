@@ -1,6 +1,7 @@
 package iiif
 
 import (
+	"encoding/base64"
 	"log"
 	"net/http"
 	"net/http/httptest"
@@ -43,3 +44,25 @@ func TestWithGroupCache(t *testing.T) {
 		}
 	}
 }
+
+func TestRemoteURL(t *testing.T) {
+	var tests = []struct {
+		identifier string
+		url        string
+	}{
+		{"http:/example.org/lena.jpg", "http://example.org/lena.jpg"},
+		{base64.StdEncoding.EncodeToString([]byte("https://example.org/lena.jpg")), "https://example.org/lena.jpg"},
+		// The other keys of the images cache are the server's own.
+		{base64.StdEncoding.EncodeToString([]byte("ocr:0:/etc/passwd")), ""},
+		{base64.StdEncoding.EncodeToString([]byte("metadata:0:lena.jpg")), ""},
+		{base64.StdEncoding.EncodeToString([]byte("collection:0:")), ""},
+		{base64.StdEncoding.EncodeToString([]byte("file:///etc/passwd")), ""},
+	}
+
+	for _, test := range tests {
+		u, err := remoteURL(test.identifier)
+		if u != test.url || (err == nil) != (test.url != "") {
+			t.Errorf("%s: got %#v (%v) want %#v", test.identifier, u, err, test.url)
+		}
+	}
+}
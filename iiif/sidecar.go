@@ -0,0 +1,87 @@
+package iiif
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// directorySidecar holds the defaults of all the images of a directory.
+const directorySidecar = "_default.json"
+
+// Sidecar contains the properties describing an image which are stored next
+// to it (e.g. lena.jpg.json) or in the directorySidecar. The Focus steers the
+// square and smart crops.
+type Sidecar struct {
+	Attribution string        `json:"attribution,omitempty" toml:"attribution"`
+	License     string        `json:"license,omitempty" toml:"license"`
+	Logo        string        `json:"logo,omitempty" toml:"logo"`
+	Service     []interface{} `json:"service,omitempty" toml:"service"`
+	Focus       *Focus        `json:"focus,omitempty" toml:"-"`
+}
+
+// readSidecar reads the sidecar of the image, completed by the one of its
+// directory. Missing files are simply ignored.
+func readSidecar(identifier string, root string) (*Sidecar, error) {
+	sidecar := &Sidecar{}
+	for _, name := range sidecarFiles(identifier, root) {
+		var s Sidecar
+		data, err := ioutil.ReadFile(name)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return sidecar, err
+		}
+
+		err = json.Unmarshal(data, &s)
+		if err != nil {
+			return sidecar, err
+		}
+		sidecar.merge(s)
+	}
+
+	return sidecar, nil
+}
+
+// sidecarFiles are the sidecar of the image and the one of its directory.
+func sidecarFiles(identifier string, root string) []string {
+	filename := filepath.Join(root, identifier)
+	return []string{filename + ".json", filepath.Join(filepath.Dir(filename), directorySidecar)}
+}
+
+// sidecarTag fingerprints the sidecar files of the image from their size and
+// modification time, a missing one counting as well.
+func sidecarTag(identifier string, root string) string {
+	tags := make([]string, 0, 2)
+	for _, name := range sidecarFiles(identifier, root) {
+		stat, err := os.Stat(name)
+		if err != nil {
+			tags = append(tags, "-")
+			continue
+		}
+		tags = append(tags, fmt.Sprintf("%d-%d", stat.Size(), stat.ModTime().UnixNano()))
+	}
+	return strings.Join(tags, ",")
+}
+
+// merge completes the missing properties from the other sidecar.
+func (s *Sidecar) merge(other Sidecar) {
+	if s.Attribution == "" {
+		s.Attribution = other.Attribution
+	}
+	if s.License == "" {
+		s.License = other.License
+	}
+	if s.Logo == "" {
+		s.Logo = other.Logo
+	}
+	if len(s.Service) == 0 {
+		s.Service = other.Service
+	}
+	if s.Focus == nil {
+		s.Focus = other.Focus
+	}
+}
@@ -0,0 +1,107 @@
+package iiif
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestReadSidecar(t *testing.T) {
+	sidecar, err := readSidecar("images/test.png", "../fixtures")
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if sidecar.Logo != "https://example.org/logo.png" {
+		t.Errorf("logo expected from the image sidecar, got %#v", sidecar.Logo)
+	}
+	if sidecar.Attribution != "Test images" {
+		t.Errorf("attribution expected from the directory sidecar, got %#v", sidecar.Attribution)
+	}
+
+	sidecar, err = readSidecar("lena.jpg", "../fixtures")
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if sidecar.Attribution != "" || sidecar.License != "" || sidecar.Logo != "" {
+		t.Errorf("no sidecar expected for lena.jpg, got %#v", sidecar)
+	}
+}
+
+func TestSidecarTag(t *testing.T) {
+	dir, err := ioutil.TempDir("", "iiif-sidecar")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tag := sidecarTag("test.png", dir)
+	if err = ioutil.WriteFile(filepath.Join(dir, "test.png.json"), []byte(`{"license": "CC0"}`), 0644); err != nil {
+		log.Fatal(err)
+	}
+	image := sidecarTag("test.png", dir)
+	if image == tag {
+		t.Errorf("the tag was expected to change with the image sidecar, got %#v", image)
+	}
+
+	filename := filepath.Join(dir, directorySidecar)
+	if err = ioutil.WriteFile(filename, []byte(`{"attribution": "Test"}`), 0644); err != nil {
+		log.Fatal(err)
+	}
+	directory := sidecarTag("test.png", dir)
+	if directory == image {
+		t.Errorf("the tag was expected to change with the directory sidecar, got %#v", directory)
+	}
+
+	later := time.Now().Add(time.Minute)
+	if err = os.Chtimes(filename, later, later); err != nil {
+		log.Fatal(err)
+	}
+	if touched := sidecarTag("test.png", dir); touched == directory {
+		t.Errorf("the tag was expected to change with the modification time, got %#v", touched)
+	}
+}
+
+func TestInfoRights(t *testing.T) {
+	ts := newServerWithConfig(&Config{
+		Rights: Sidecar{
+			Attribution: "Default attribution",
+			Logo:        "https://example.org/default.png",
+		},
+	})
+	defer ts.Close()
+
+	var tests = []struct {
+		url         string
+		attribution string
+		license     string
+		logo        string
+	}{
+		{"/images/test.png/info.json", "Test images", "https://creativecommons.org/publicdomain/zero/1.0/", "https://example.org/logo.png"},
+		{"/lena.jpg/info.json", "Default attribution", "", "https://example.org/default.png"},
+	}
+
+	for _, test := range tests {
+		resp, err := http.Get(ts.URL + test.url)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer resp.Body.Close()
+
+		var m Image
+		err = json.NewDecoder(resp.Body).Decode(&m)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		if m.Attribution != test.attribution || m.License != test.license || m.Logo != test.logo {
+			t.Errorf("%v: got %#v, %#v, %#v want %#v, %#v, %#v", test.url, m.Attribution, m.License, m.Logo, test.attribution, test.license, test.logo)
+		}
+	}
+}
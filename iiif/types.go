@@ -45,18 +45,44 @@ type Image struct {
 	Profile  []interface{} `json:"profile"`
 	Sizes    []Size        `json:"sizes,omitempty"`
 	Tiles    []Tile        `json:"tiles,omitempty"`
+
+	Attribution string        `json:"attribution,omitempty"`
+	License     string        `json:"license,omitempty"`
+	Logo        string        `json:"logo,omitempty"`
+	Service     []interface{} `json:"service,omitempty"`
 }
 
 // Config stores the IIIF server configuration.
 type Config struct {
-	Host      string      `toml:"host"`
-	Port      int         `toml:"port"`
-	Templates string      `toml:"templates"`
-	Images    string      `toml:"images"`
-	MaxWidth  int         `toml:"maxWidth"`
-	MaxHeight int         `toml:"maxHeight"`
-	MaxArea   int         `toml:"maxArea"`
-	Cache     CacheConfig `toml:"cache"`
+	Host         string              `toml:"host"`
+	Port         int                 `toml:"port"`
+	Templates    string              `toml:"templates"`
+	Images       string              `toml:"images"`
+	MaxWidth     int                 `toml:"maxWidth"`
+	MaxHeight    int                 `toml:"maxHeight"`
+	MaxArea      int                 `toml:"maxArea"`
+	AutoOrient   *bool               `toml:"autoOrient"`
+	Cache        CacheConfig         `toml:"cache"`
+	Encoding     EncodingConfig      `toml:"encoding"`
+	Color        ColorConfig         `toml:"color"`
+	Metadata     MetadataConfig      `toml:"metadata"`
+	Rights       Sidecar             `toml:"rights"`
+	Pages        PagesConfig         `toml:"pages"`
+	Derivatives  DerivativesConfig   `toml:"derivatives"`
+	Export       ExportConfig        `toml:"export"`
+	DZI          DZIConfig           `toml:"dzi"`
+	Compat       CompatConfig        `toml:"compat"`
+	Tiles        TilesConfig         `toml:"tiles"`
+	Collections  CollectionsConfig   `toml:"collections"`
+	Annotations  AnnotationsConfig   `toml:"annotations"`
+	Discovery    DiscoveryConfig     `toml:"discovery"`
+	Watch        WatchConfig         `toml:"watch"`
+	Errors       ErrorsConfig        `toml:"errors"`
+	Placeholders []PlaceholderConfig `toml:"placeholders"`
+	Watermark    WatermarkConfig     `toml:"watermark"`
+	Adjustments  AdjustmentsConfig   `toml:"adjustments"`
+	Focus        FocusConfig         `toml:"focus"`
+	Watcher      *Watcher            `toml:"-"`
 }
 
 // CacheConfig represents the configuration information regarding the cache.
@@ -68,10 +94,224 @@ type CacheConfig struct {
 	ThumbnailsSize int64
 }
 
+// EncodingConfig represents the encoder settings per output format.
+//
+// Overrides allows the query parameters (quality, compression, progressive,
+// palette and lossless) to change those settings for a single request.
+type EncodingConfig struct {
+	StripMetadata bool       `toml:"stripMetadata"`
+	Overrides     bool       `toml:"overrides"`
+	MinQuality    int        `toml:"minQuality"`
+	MaxQuality    int        `toml:"maxQuality"`
+	JPEG          JPEGConfig `toml:"jpeg"`
+	PNG           PNGConfig  `toml:"png"`
+	WebP          WebPConfig `toml:"webp"`
+	TIFF          TIFFConfig `toml:"tiff"`
+}
+
+// JPEGConfig represents the JPEG encoder settings.
+//
+// Subsampling is the chroma subsampling: auto (libvips picks it from the
+// quality), on (4:2:0) or off (4:4:4).
+type JPEGConfig struct {
+	Quality     int    `toml:"quality"`
+	Progressive bool   `toml:"progressive"`
+	Subsampling string `toml:"subsampling"`
+}
+
+// PNGConfig represents the PNG encoder settings.
+type PNGConfig struct {
+	Compression int  `toml:"compression"`
+	Interlace   bool `toml:"interlace"`
+	Palette     bool `toml:"palette"`
+}
+
+// WebPConfig represents the WebP encoder settings.
+type WebPConfig struct {
+	Quality  int  `toml:"quality"`
+	Lossless bool `toml:"lossless"`
+}
+
+// TIFFConfig represents the TIFF encoder settings.
+//
+// Compression is one of none, jpeg, deflate, packbits, lzw, webp or zstd, the
+// quality being the one of the lossy ones. Tile writes tiles of TileSize
+// pixels instead of strips.
+type TIFFConfig struct {
+	Compression string `toml:"compression"`
+	Quality     int    `toml:"quality"`
+	Tile        bool   `toml:"tile"`
+	TileSize    int    `toml:"tileSize"`
+}
+
+// ColorConfig represents the colour management settings.
+//
+// Profile is either the path to an ICC profile, a libvips built-in profile
+// name (srgb by default) or embedded to skip the conversion altogether.
+type ColorConfig struct {
+	Profile      string `toml:"profile"`
+	StripProfile bool   `toml:"stripProfile"`
+}
+
+// MetadataConfig represents which embedded metadata are made public.
+//
+// Fields are patterns (e.g. exif.Make or iptc.*) of the metadata shown by
+// the metadata.json endpoint. Info maps the properties of info.json
+// (attribution or license) to a metadata field.
+type MetadataConfig struct {
+	Fields []string          `toml:"fields"`
+	Info   map[string]string `toml:"info"`
+}
+
+// PagesConfig represents the settings of the multi-page documents (TIFF,
+// PDF) whose pages are read by libvips within the server. Vips is the
+// command line tool writing the derivatives, see Convert.
+type PagesConfig struct {
+	Separator string `toml:"separator"`
+	DPI       int    `toml:"dpi"`
+	Vips      string `toml:"vips"`
+}
+
+// DerivativesConfig tells where the tiled pyramids of the images are written
+// by Convert, and how.
+type DerivativesConfig struct {
+	Path        string `toml:"path"`
+	Format      string `toml:"format"`
+	TileSize    int    `toml:"tileSize"`
+	Compression string `toml:"compression"`
+	Quality     int    `toml:"quality"`
+	Workers     int    `toml:"workers"`
+}
+
+// ExportConfig tells where the static Level 0 images are written by Export,
+// and the base URL of their identifiers.
+type ExportConfig struct {
+	BaseURL  string `toml:"baseURL"`
+	Output   string `toml:"output"`
+	TileSize int    `toml:"tileSize"`
+	Format   string `toml:"format"`
+}
+
+// DZIConfig contains the tiling of the Deep Zoom images.
+type DZIConfig struct {
+	TileSize int    `toml:"tileSize"`
+	Overlap  int    `toml:"overlap"`
+	Format   string `toml:"format"`
+}
+
+// CompatConfig enables the IIP and Zoomify protocols. IIPRoot is the
+// directory of the images as known by iipsrv, it's removed from the FIF paths.
+type CompatConfig struct {
+	IIP      bool   `toml:"iip"`
+	IIPRoot  string `toml:"iipRoot"`
+	Zoomify  bool   `toml:"zoomify"`
+	TileSize int    `toml:"tileSize"`
+}
+
+// TilesConfig contains the slippy map tiling, the scheme being xyz or tms.
+type TilesConfig struct {
+	TileSize int    `toml:"tileSize"`
+	Scheme   string `toml:"scheme"`
+}
+
+// CollectionsConfig contains the number of items per page of the
+// Presentation collections.
+type CollectionsConfig struct {
+	PageSize int `toml:"pageSize"`
+}
+
+// AnnotationsConfig tells where the local store keeps the annotations, and
+// the number of annotations per page of their containers. Writable enables
+// their changes, which have no authentication of their own.
+type AnnotationsConfig struct {
+	Path     string `toml:"path"`
+	PageSize int    `toml:"pageSize"`
+	Writable bool   `toml:"writable"`
+}
+
+// DiscoveryConfig tells where the activity log of the Change Discovery feed
+// is kept, how often the images are scanned (in seconds) and the number of
+// activities per page.
+type DiscoveryConfig struct {
+	Log      string `toml:"log"`
+	Interval int    `toml:"interval"`
+	PageSize int    `toml:"pageSize"`
+}
+
+// WatchConfig enables the watcher of the images directory, scanned every
+// interval (in seconds) on top of the inotify events.
+type WatchConfig struct {
+	Enabled  bool `toml:"enabled"`
+	Interval int  `toml:"interval"`
+}
+
+// ErrorsConfig contains the placeholder image given, if any, to the clients
+// expecting an image when the request fails.
+type ErrorsConfig struct {
+	Placeholder string `toml:"placeholder"`
+}
+
+// PlaceholderConfig tells which image, of the images directory, replaces the
+// ones of the identifiers starting with Prefix when they're missing,
+// forbidden or fail to be made. OK serves them as 200 rather than with the
+// status of the error.
+type PlaceholderConfig struct {
+	Prefix    string `toml:"prefix"`
+	NotFound  string `toml:"notFound"`
+	Forbidden string `toml:"forbidden"`
+	Failed    string `toml:"failed"`
+	OK        bool   `toml:"ok"`
+}
+
+// WatermarkConfig contains the watermark rules, the first one matching the
+// identifier applying. The users whose request has the ExemptHeader (e.g.
+// set by an authenticating proxy) get the images without them.
+type WatermarkConfig struct {
+	ExemptHeader string          `toml:"exemptHeader"`
+	Rules        []WatermarkRule `toml:"rules"`
+}
+
+// WatermarkRule composites either the Image (a PNG logo) or the Text onto
+// the images whose identifier matches Pattern, when their output is at least
+// MinSize pixels wide or high. Scale is relative to the width of the output.
+type WatermarkRule struct {
+	Pattern  string  `toml:"pattern"`
+	MinSize  int     `toml:"minSize"`
+	Image    string  `toml:"image"`
+	Text     string  `toml:"text"`
+	Font     string  `toml:"font"`
+	Position string  `toml:"position"`
+	Margin   int     `toml:"margin"`
+	Opacity  float32 `toml:"opacity"`
+	Scale    float64 `toml:"scale"`
+	Tile     bool    `toml:"tile"`
+}
+
+// AdjustmentsConfig enables the adjustments of the images, e.g. sharpen, as
+// query parameters. Enhanced holds the ones of the enhanced quality, as a
+// query string, e.g. autolevels=true&sharpen=1.
+type AdjustmentsConfig struct {
+	Enabled  bool   `toml:"enabled"`
+	Enhanced string `toml:"enhanced"`
+}
+
+// FocusConfig names the Detector of the smart crops of the images having no
+// focus, and enables the administration of the focus over HTTP (Admin).
+type FocusConfig struct {
+	Detector string `toml:"detector"`
+	Admin    bool   `toml:"admin"`
+}
+
 // LoadedImage represents an image just loaded over HTTP or cache.
+//
+// The documents and pyramids may be read at a lower resolution, or cropped.
+// Size is then the one of the full resolution and Vars the request as it
+// applies to Image.
 type LoadedImage struct {
 	Image   *bimg.Image
 	ModTime *time.Time
+	Size    *bimg.ImageSize
+	Vars    map[string]string
 }
 
 // CroppedImage represents an image ready to be served or cached.
@@ -14,13 +14,16 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/golang/groupcache"
 	"github.com/gorilla/mux"
+	"gopkg.in/h2non/bimg.v1"
 )
 
 // error messages
 var openError = "libvips cannot open this file: %#v"
+var viewerError = "The viewer %#v doesn't exist"
 
 // encodedURL contains a file URL and its base64 encoded version.
 type encodedURL struct {
@@ -152,52 +155,66 @@ func InfoHandler(w http.ResponseWriter, r *http.Request) {
 	identifier, err := url.QueryUnescape(identifier)
 	if err != nil {
 		log.Printf("Filename is frob %#v", identifier)
-		http.NotFound(w, r)
+		serveError(w, r, HTTPError{http.StatusNotFound, identifier})
 		return
 	}
 
 	ctx := r.Context()
 	config, _ := ctx.Value(ContextKey("config")).(*Config)
-	groupcache, _ := ctx.Value(ContextKey("groupcache")).(*groupcache.Group)
+	images, _ := ctx.Value(ContextKey("images")).(*groupcache.Group)
 
 	identifier = strings.Replace(identifier, "../", "", -1)
 
-	loadedImage, err := openImage(identifier, config.Images, groupcache)
-	if err != nil {
-		e, ok := err.(HTTPError)
-		if ok {
-			http.Error(w, e.Error(), e.StatusCode)
-		} else {
-			http.NotFound(w, r)
+	contentType := "application/json"
+	if strings.Contains(r.Header.Get("Accept"), "application/ld+json") {
+		contentType = "application/ld+json"
+	}
+
+	// The ETag covers the request, its representation, the source and the
+	// sidecar files giving the rights.
+	etag := getETag(r.URL.String())
+	if tag, modTime, err := sourceTag(identifier, config, images); err == nil {
+		sidecar := sidecarTag(identifier, config.Images)
+		etag = getETag(fmt.Sprintf("%s %s@%s %s", r.URL, contentType, tag, sidecar))
+		if checkPreconditions(w, r, etag, modTime, config) {
+			return
 		}
-		return
 	}
 
-	image := loadedImage.Image
-	size, err := image.Size()
+	id := fmt.Sprintf("%s/%s", baseURL(r), identifier)
+	p, modTime, err := newImage(identifier, id, config, images)
 	if err != nil {
-		message := fmt.Sprintf(openError, identifier)
-		http.Error(w, message, http.StatusBadRequest)
+		serveError(w, r, err)
 		return
 	}
 
-	scheme := r.URL.Scheme
-
-	if r.TLS == nil {
-		scheme = "http"
-	}
-	if r.Header.Get("X-Forwarded-Proto") != "" {
-		scheme = r.Header.Get("X-Forwarded-Proto")
+	buffer, err := json.MarshalIndent(p, "", "  ")
+	if err != nil {
+		serveError(w, r, HTTPError{http.StatusInternalServerError, "Cannot create profile"})
+		return
 	}
 
-	host := r.Host
-	if r.Header.Get("X-Forwarded-Host") != "" {
-		host = r.Header.Get("X-Forwarded-Host")
+	header := w.Header()
+	header.Set("Content-Type", contentType)
+	header.Set("Access-Control-Allow-Origin", "*")
+	header.Set("Access-Control-Allow-Methods", "GET, HEAD, OPTIONS")
+	header.Set("Vary", "Accept")
+	header.Set("ETag", etag)
+	header.Set("Cache-Control", fmt.Sprintf("max-age=%v, public", config.Cache.HTTP))
+	http.ServeContent(w, r, "info.json", *modTime, bytes.NewReader(buffer))
+}
+
+// newImage describes the image for info.json, id being its URI. The
+// modification time of the image is returned as well.
+func newImage(identifier, id string, config *Config, images *groupcache.Group) (*Image, *time.Time, error) {
+	size, modTime, err := imageSize(identifier, config, images)
+	if err != nil {
+		return nil, nil, err
 	}
 
-	p := Image{
+	p := &Image{
 		Context:  "http://iiif.io/api/image/2/context.json",
-		ID:       fmt.Sprintf("%s://%s/%s", scheme, host, identifier),
+		ID:       id,
 		Type:     "iiif:Image",
 		Protocol: "http://iiif.io/api/image",
 		Width:    size.Width,
@@ -237,25 +254,113 @@ func InfoHandler(w http.ResponseWriter, r *http.Request) {
 		},
 	}
 
-	buffer, err := json.MarshalIndent(p, "", "  ")
+	// The adjustments are extensions, with the enhanced quality.
+	if supports := adjustSupports(config); len(supports) > 0 {
+		profile := p.Profile[1].(*ImageProfile)
+		profile.Qualities = append(profile.Qualities, adjustQuality)
+		profile.Supports = append(profile.Supports, supports...)
+	}
+
+	// Rights, from the most specific to the most generic: the sidecar
+	// files, the embedded metadata and the configuration.
+	rights, err := readSidecar(identifier, config.Images)
 	if err != nil {
-		http.Error(w, "Cannot create profile", http.StatusInternalServerError)
-		return
+		log.Printf("Cannot read the sidecar of %#v: %s", identifier, err)
 	}
 
-	header := w.Header()
+	if len(config.Metadata.Info) > 0 {
+		metadata, err := loadMetadata(identifier, config, images)
+		if err != nil {
+			log.Printf("Cannot read the metadata of %#v: %s", identifier, err)
+		}
+		rights.merge(Sidecar{
+			Attribution: metadata[config.Metadata.Info["attribution"]],
+			License:     metadata[config.Metadata.Info["license"]],
+		})
+	}
+
+	rights.merge(config.Rights)
 
-	accept := r.Header.Get("Accept")
-	if strings.Contains(accept, "application/ld+json") {
-		header.Set("Content-Type", "application/ld+json")
-	} else {
-		header.Set("Content-Type", "application/json")
+	p.Attribution = rights.Attribution
+	p.License = rights.License
+	p.Logo = rights.Logo
+	p.Service = rights.Service
+
+	return p, modTime, nil
+}
+
+// imageSize gives the dimensions of the image as seen by the clients, and its
+// modification time.
+func imageSize(identifier string, config *Config, images *groupcache.Group) (bimg.ImageSize, *time.Time, error) {
+	var size bimg.ImageSize
+	loadedImage, err := openImage(identifier, config, images, nil)
+	if err != nil {
+		e, ok := err.(HTTPError)
+		if ok {
+			return size, nil, e
+		}
+		return size, nil, HTTPError{http.StatusNotFound, identifier}
 	}
-	header.Set("Access-Control-Allow-Origin", "*")
-	header.Set("Access-Control-Allow-Methods", "GET, HEAD, OPTIONS")
-	header.Set("ETag", getETag(r.URL.String()))
-	header.Set("Cache-Control", fmt.Sprintf("max-age=%v, public", config.Cache.HTTP))
-	http.ServeContent(w, r, "info.json", *loadedImage.ModTime, bytes.NewReader(buffer))
+
+	if loadedImage.Size != nil {
+		return *loadedImage.Size, loadedImage.ModTime, nil
+	}
+
+	size, _, err = orientedSize(loadedImage.Image, config)
+	if err != nil {
+		message := fmt.Sprintf(openError, identifier)
+		return size, nil, HTTPError{http.StatusBadRequest, message}
+	}
+	return size, loadedImage.ModTime, nil
+}
+
+// sizePrefix distinguishes the size keys from the URLs in the images cache.
+const sizePrefix = "size:"
+
+// cachedSize is the size of an image, as kept in the images cache.
+type cachedSize struct {
+	Width   int        `json:"width"`
+	Height  int        `json:"height"`
+	ModTime *time.Time `json:"modTime,omitempty"`
+}
+
+// loadImageSize gives the size of the image from the images cache, the
+// fingerprint of its source being part of the key, so that the listings of
+// many images don't open them at every request.
+func loadImageSize(identifier string, config *Config, cache *groupcache.Group) (bimg.ImageSize, *time.Time, error) {
+	if cache == nil {
+		return imageSize(identifier, config, cache)
+	}
+
+	tag, _, err := sourceTag(url.QueryEscape(identifier), config, cache)
+	if err != nil {
+		return bimg.ImageSize{}, nil, HTTPError{http.StatusNotFound, identifier}
+	}
+
+	var buffer []byte
+	key := fmt.Sprintf("%s%s:%s", sizePrefix, tag, identifier)
+	if err = cache.Get(nil, key, groupcache.AllocatingByteSliceSink(&buffer)); err != nil {
+		return bimg.ImageSize{}, nil, err
+	}
+
+	var size cachedSize
+	err = json.Unmarshal(buffer, &size)
+	return bimg.ImageSize{Width: size.Width, Height: size.Height}, size.ModTime, err
+}
+
+// readImageSize gives the size of the image as JSON.
+func readImageSize(identifier string, config *Config, cache *groupcache.Group) ([]byte, error) {
+	size, modTime, err := imageSize(identifier, config, cache)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(&cachedSize{size.Width, size.Height, modTime})
+}
+
+// sizeKey gives the identifier of a size cache key.
+func sizeKey(key string) string {
+	key = strings.TrimPrefix(key, sizePrefix)
+	return key[strings.Index(key, ":")+1:]
 }
 
 // ViewerHandler responds with the existing templates.
@@ -267,19 +372,27 @@ func ViewerHandler(w http.ResponseWriter, r *http.Request) {
 	identifier, err := url.QueryUnescape(identifier)
 	if err != nil {
 		log.Printf("Filename is frob %#v", identifier)
-		http.NotFound(w, r)
+		serveError(w, r, HTTPError{http.StatusNotFound, identifier})
 		return
 	}
 	identifier = strings.Replace(identifier, "../", "", -1)
 
 	p := &struct{ Image string }{Image: identifier}
 
-	config := r.Context().Value(ContextKey("config")).(*Config)
+	ctx := r.Context()
+	config, _ := ctx.Value(ContextKey("config")).(*Config)
+	images, _ := ctx.Value(ContextKey("images")).(*groupcache.Group)
 
 	tpl := filepath.Join(config.Templates, "viewer", viewer)
 	t, err := template.ParseFiles(tpl)
 	if err != nil {
-		http.NotFound(w, r)
+		serveError(w, r, HTTPError{http.StatusNotFound, fmt.Sprintf(viewerError, vars["viewer"])})
+		return
+	}
+
+	// The viewer of a missing image fails like its info.json would.
+	if _, _, err = sourceTag(vars["identifier"], config, images); err != nil {
+		serveError(w, r, HTTPError{http.StatusNotFound, identifier})
 		return
 	}
 
@@ -287,6 +400,25 @@ func ViewerHandler(w http.ResponseWriter, r *http.Request) {
 	t.Execute(w, p)
 }
 
+// baseURL gives the scheme and host of the server, as seen by the client.
+func baseURL(r *http.Request) string {
+	scheme := r.URL.Scheme
+
+	if r.TLS == nil {
+		scheme = "http"
+	}
+	if r.Header.Get("X-Forwarded-Proto") != "" {
+		scheme = r.Header.Get("X-Forwarded-Proto")
+	}
+
+	host := r.Host
+	if r.Header.Get("X-Forwarded-Host") != "" {
+		host = r.Header.Get("X-Forwarded-Host")
+	}
+
+	return fmt.Sprintf("%s://%s", scheme, host)
+}
+
 func getETag(str string) string {
 	return fmt.Sprintf("\"%x\"", sha1.Sum([]byte(str)))
 }
@@ -92,6 +92,55 @@ func TestEtag(t *testing.T) {
 	}
 }
 
+func TestConditionalRequests(t *testing.T) {
+	ts := newServer()
+	defer ts.Close()
+
+	for _, path := range []string{"/images/test.png/full/max/0/default.png", "/images/test.png/info.json"} {
+		resp, err := http.Get(ts.URL + path)
+		if err != nil {
+			log.Fatal(err)
+		}
+		resp.Body.Close()
+
+		etag := resp.Header.Get("ETag")
+		if strings.HasPrefix(etag, "W/") || resp.Header.Get("Last-Modified") == "" {
+			t.Errorf("%s: expected a strong ETag and a Last-Modified, got %#v", path, resp.Header)
+		}
+
+		var tests = []struct {
+			header string
+			value  string
+			status int
+		}{
+			{"If-None-Match", etag, http.StatusNotModified},
+			{"If-None-Match", `"stale", ` + etag, http.StatusNotModified},
+			{"If-None-Match", `"stale"`, http.StatusOK},
+			{"If-Match", `"stale"`, http.StatusPreconditionFailed},
+			{"If-Match", etag, http.StatusOK},
+			{"If-Modified-Since", resp.Header.Get("Last-Modified"), http.StatusNotModified},
+		}
+
+		for _, test := range tests {
+			req, err := http.NewRequest("GET", ts.URL+path, nil)
+			if err != nil {
+				log.Fatal(err)
+			}
+			req.Header.Set(test.header, test.value)
+
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				log.Fatal(err)
+			}
+			resp.Body.Close()
+
+			if resp.StatusCode != test.status {
+				t.Errorf("%s %s: %#v, got %v want %v", path, test.header, test.value, resp.StatusCode, test.status)
+			}
+		}
+	}
+}
+
 func TestInfoAsJson(t *testing.T) {
 	ts := newServer()
 	defer ts.Close()
@@ -188,6 +237,43 @@ func TestInfoMaxSize(t *testing.T) {
 	}
 }
 
+func TestInfoAutoOrient(t *testing.T) {
+	var tests = []struct {
+		autoOrient bool
+		width      int
+		height     int
+	}{
+		{false, 300, 200},
+		{true, 200, 300},
+	}
+
+	for _, test := range tests {
+		autoOrient := test.autoOrient
+		ts := newServerWithConfig(&Config{
+			AutoOrient: &autoOrient,
+		})
+		defer ts.Close()
+
+		resp, err := http.Get(ts.URL + "/orientation.jpg/info.json")
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		defer resp.Body.Close()
+		decoder := json.NewDecoder(resp.Body)
+
+		var m Image
+		err = decoder.Decode(&m)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		if m.Width != test.width || m.Height != test.height {
+			t.Errorf("image expected to be %dx%d (autoOrient %v): got %dx%d", test.width, test.height, test.autoOrient, m.Width, m.Height)
+		}
+	}
+}
+
 func TestInfoAsJsonLd(t *testing.T) {
 	ts := newServer()
 	defer ts.Close()
@@ -287,13 +373,18 @@ func newServer() *httptest.Server {
 }
 
 func newServerWithMaxSize(width, height, area int) *httptest.Server {
-	r := MakeRouter()
-	r = WithConfig(r, &Config{
-		Images:    "../fixtures",
-		Templates: "../templates",
+	return newServerWithConfig(&Config{
 		MaxArea:   area,
 		MaxWidth:  width,
 		MaxHeight: height,
 	})
+}
+
+func newServerWithConfig(config *Config) *httptest.Server {
+	config.Images = "../fixtures"
+	config.Templates = "../templates"
+
+	r := MakeRouter()
+	r = WithConfig(r, config)
 	return httptest.NewServer(r)
 }
@@ -0,0 +1,236 @@
+package iiif
+
+/*
+#cgo pkg-config: vips
+#include <stdlib.h>
+#include <vips/vips.h>
+
+// iiif_load reads the file, its load options being part of the filename (e.g.
+// pyramid.tif[page=2]), and saves the area, if any, as an uncompressed TIFF.
+static int
+iiif_load(const char *filename, int left, int top, int width, int height, void **buf, size_t *len) {
+	VipsImage *image, *area;
+	int err;
+
+	image = vips_image_new_from_file(filename, NULL);
+	if (image == NULL) {
+		return -1;
+	}
+
+	if (width > 0 && height > 0) {
+		err = vips_extract_area(image, &area, left, top, width, height, NULL);
+		g_object_unref(image);
+		if (err != 0) {
+			return err;
+		}
+		image = area;
+	}
+
+	err = vips_tiffsave_buffer(image, buf, len, NULL);
+	g_object_unref(image);
+	return err;
+}
+
+// iiif_header reads the size and the number of pages of the file, without
+// decoding it. The single page formats count one.
+static int
+iiif_header(const char *filename, int *width, int *height, int *pages) {
+	VipsImage *image;
+
+	image = vips_image_new_from_file(filename, NULL);
+	if (image == NULL) {
+		return -1;
+	}
+
+	*width = vips_image_get_width(image);
+	*height = vips_image_get_height(image);
+	*pages = vips_image_get_n_pages(image);
+	g_object_unref(image);
+	return 0;
+}
+
+// iiif_pad embeds the image at the top left corner of a larger one, the
+// added area being transparent, or white without an alpha channel. It's
+// saved as an uncompressed TIFF.
+static int
+iiif_pad(void *in, size_t in_len, int width, int height, int alpha, void **buf, size_t *len) {
+	VipsImage *image, *out;
+	int err;
+
+	image = vips_image_new_from_buffer(in, in_len, "", NULL);
+	if (image == NULL) {
+		return -1;
+	}
+
+	if (alpha && !vips_image_hasalpha(image)) {
+		err = vips_addalpha(image, &out, NULL);
+		g_object_unref(image);
+		if (err != 0) {
+			return err;
+		}
+		image = out;
+	}
+
+	err = vips_embed(image, &out, 0, 0, width, height,
+		"extend", alpha ? VIPS_EXTEND_BLACK : VIPS_EXTEND_WHITE,
+		NULL);
+	g_object_unref(image);
+	if (err != 0) {
+		return err;
+	}
+
+	err = vips_tiffsave_buffer(out, buf, len, NULL);
+	g_object_unref(out);
+	return err;
+}
+
+// iiif_jpegsave encodes the image with the given chroma subsampling mode.
+static int
+iiif_jpegsave(void *in, size_t in_len, int quality, int interlace, int strip, int subsample, void **buf, size_t *len) {
+	VipsImage *image;
+	int err;
+
+	image = vips_image_new_from_buffer(in, in_len, "", NULL);
+	if (image == NULL) {
+		return -1;
+	}
+
+	err = vips_jpegsave_buffer(image, buf, len,
+		"Q", quality,
+		"interlace", interlace,
+		"strip", strip,
+		"subsample_mode", subsample,
+		NULL);
+	g_object_unref(image);
+	return err;
+}
+
+// iiif_tiffsave encodes the image with the given compression, in tiles or
+// in strips.
+static int
+iiif_tiffsave(void *in, size_t in_len, int quality, int strip, int compression, int tile, int tile_size, void **buf, size_t *len) {
+	VipsImage *image;
+	int err;
+
+	image = vips_image_new_from_buffer(in, in_len, "", NULL);
+	if (image == NULL) {
+		return -1;
+	}
+
+	err = vips_tiffsave_buffer(image, buf, len,
+		"Q", quality,
+		"strip", strip,
+		"compression", compression,
+		"tile", tile,
+		"tile_width", tile_size,
+		"tile_height", tile_size,
+		NULL);
+	g_object_unref(image);
+	return err;
+}
+*/
+import "C"
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"unsafe"
+
+	"gopkg.in/h2non/bimg.v1"
+)
+
+// error messages
+var vipsSaveError = "vips couldn't encode the image: %#v"
+
+// vipsLoadFile reads the page, or level, within the process using libvips,
+// the options being given with the filename, e.g. book.pdf[page=1,dpi=300].
+// Only the area of the box, if any, is decoded from a tiled image.
+func vipsLoadFile(load string, box []int) ([]byte, error) {
+	filename := C.CString(load)
+	defer C.free(unsafe.Pointer(filename))
+
+	var left, top, width, height C.int
+	if box != nil {
+		left, top, width, height = C.int(box[0]), C.int(box[1]), C.int(box[2]), C.int(box[3])
+	}
+
+	var ptr unsafe.Pointer
+	var length C.size_t
+	if C.iiif_load(filename, left, top, width, height, &ptr, &length) != 0 {
+		return nil, HTTPError{http.StatusInternalServerError, fmt.Sprintf(vipsError, vipsErrorMessage())}
+	}
+	defer C.g_free(C.gpointer(ptr))
+
+	return C.GoBytes(ptr, C.int(length)), nil
+}
+
+// vipsHeaderFile reads the size of the page, or level, and the number of
+// pages of the file within the process, only its header being read. The
+// options are given with the filename, see vipsLoadFile.
+func vipsHeaderFile(load string) (int, int, int, error) {
+	filename := C.CString(load)
+	defer C.free(unsafe.Pointer(filename))
+
+	var width, height, pages C.int
+	if C.iiif_header(filename, &width, &height, &pages) != 0 {
+		return 0, 0, 0, HTTPError{http.StatusInternalServerError, fmt.Sprintf(vipsError, vipsErrorMessage())}
+	}
+	return int(width), int(height), int(pages), nil
+}
+
+// vipsPad enlarges the image to the given size, see iiif_pad. The input is
+// copied as libvips may keep it past the call.
+func vipsPad(buffer []byte, width, height int, alpha bool) ([]byte, error) {
+	in := C.CBytes(buffer)
+	defer C.free(in)
+
+	var ptr unsafe.Pointer
+	var length C.size_t
+	if C.iiif_pad(in, C.size_t(len(buffer)), C.int(width), C.int(height), cBool(alpha), &ptr, &length) != 0 {
+		return nil, HTTPError{http.StatusInternalServerError, fmt.Sprintf(vipsSaveError, vipsErrorMessage())}
+	}
+	defer C.g_free(C.gpointer(ptr))
+
+	return C.GoBytes(ptr, C.int(length)), nil
+}
+
+// vipsSave encodes the image using libvips, for the settings bimg doesn't
+// expose. The input is copied as libvips may keep it past the call.
+func vipsSave(buffer []byte, e *vipsEncoder) ([]byte, error) {
+	in := C.CBytes(buffer)
+	defer C.free(in)
+
+	var ptr unsafe.Pointer
+	var length C.size_t
+	var err C.int
+	switch e.Type {
+	case bimg.JPEG:
+		err = C.iiif_jpegsave(in, C.size_t(len(buffer)), C.int(e.Quality), cBool(e.Interlace), cBool(e.Strip), C.int(e.Subsampling), &ptr, &length)
+	case bimg.TIFF:
+		err = C.iiif_tiffsave(in, C.size_t(len(buffer)), C.int(e.Quality), cBool(e.Strip), C.int(e.Compression), cBool(e.Tile), C.int(e.TileSize), &ptr, &length)
+	default:
+		message := fmt.Sprintf(vipsSaveError, bimg.ImageTypeName(e.Type))
+		return nil, HTTPError{http.StatusInternalServerError, message}
+	}
+	if err != 0 {
+		return nil, HTTPError{http.StatusInternalServerError, fmt.Sprintf(vipsSaveError, vipsErrorMessage())}
+	}
+	defer C.g_free(C.gpointer(ptr))
+
+	return C.GoBytes(ptr, C.int(length)), nil
+}
+
+// vipsErrorMessage empties the libvips error buffer.
+func vipsErrorMessage() string {
+	message := strings.TrimSpace(C.GoString(C.vips_error_buffer()))
+	C.vips_error_clear()
+	return message
+}
+
+func cBool(b bool) C.int {
+	if b {
+		return 1
+	}
+	return 0
+}
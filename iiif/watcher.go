@@ -0,0 +1,224 @@
+package iiif
+
+import (
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultWatchInterval is the number of seconds between two scans of the
+// images directory.
+const defaultWatchInterval = 300
+
+// Watcher follows the changes of the files of the images directory, the
+// generation of an identifier being bumped whenever its content changes. It
+// versions the cache keys and the ETags so that a replaced image is served
+// at once.
+//
+// The files are hashed when their modification time or size changes, a touched
+// file keeping its generation once its hash is known.
+type Watcher struct {
+	config      *Config
+	mu          sync.RWMutex
+	files       map[string]watchedFile
+	generations map[string]int64
+	listeners   []chan struct{}
+}
+
+type watchedFile struct {
+	ModTime time.Time
+	Size    int64
+	Hash    string
+}
+
+// NewWatcher creates the watcher of the images directory of the
+// configuration.
+func NewWatcher(config *Config) *Watcher {
+	return &Watcher{
+		config:      config,
+		files:       make(map[string]watchedFile),
+		generations: make(map[string]int64),
+	}
+}
+
+// Generation gives the generation of the identifier, 0 until it changes.
+func (w *Watcher) Generation(identifier string) int64 {
+	if w == nil {
+		return 0
+	}
+	if unescaped, err := url.QueryUnescape(identifier); err == nil {
+		identifier = unescaped
+	}
+	identifier = strings.Trim(strings.Replace(identifier, "../", "", -1), "/")
+
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	return w.generations[identifier]
+}
+
+// Changes gives a channel receiving a value once files were created, changed
+// or removed, the changes made meanwhile being coalesced.
+func (w *Watcher) Changes() <-chan struct{} {
+	c := make(chan struct{}, 1)
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.listeners = append(w.listeners, c)
+	return c
+}
+
+// notify tells the listeners about a change, the lock being held.
+func (w *Watcher) notify() {
+	for _, c := range w.listeners {
+		select {
+		case c <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Watch follows the changes until stopped, using inotify when available. The
+// images directory is scanned anyway every interval.
+func (w *Watcher) Watch(stop <-chan struct{}) {
+	if err := w.Scan(); err != nil {
+		log.Printf("Cannot scan the images: %s", err)
+	}
+
+	events, err := watchEvents(w.config.Images, w.ignored, stop)
+	if err != nil {
+		log.Printf("Cannot watch the images, scanning them only: %s", err)
+	}
+
+	interval := w.config.Watch.Interval
+	if interval <= 0 {
+		interval = defaultWatchInterval
+	}
+	ticker := time.NewTicker(time.Duration(interval) * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case filename, ok := <-events:
+			if !ok {
+				events = nil
+				continue
+			}
+			w.refresh(filename)
+		case <-ticker.C:
+			if err := w.Scan(); err != nil {
+				log.Printf("Cannot scan the images: %s", err)
+			}
+		}
+	}
+}
+
+// Scan compares the files of the images directory with the known ones.
+func (w *Watcher) Scan() error {
+	seen := make(map[string]bool)
+	err := filepath.Walk(w.config.Images, func(filename string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if w.ignored(filename, info) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if info.Mode().IsRegular() {
+			seen[w.identifier(filename)] = true
+			w.update(filename, info)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for identifier := range w.files {
+		if !seen[identifier] {
+			delete(w.files, identifier)
+			w.generations[identifier]++
+			w.notify()
+		}
+	}
+	return nil
+}
+
+// refresh checks the single file, e.g. after an inotify event.
+func (w *Watcher) refresh(filename string) {
+	info, err := os.Stat(filename)
+	if err == nil && !info.Mode().IsRegular() {
+		return
+	}
+	if err == nil && !w.ignored(filename, info) {
+		w.update(filename, info)
+		return
+	}
+
+	identifier := w.identifier(filename)
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if _, ok := w.files[identifier]; ok {
+		delete(w.files, identifier)
+		w.generations[identifier]++
+		w.notify()
+	}
+}
+
+// update records the file, bumping its generation when its content changed.
+func (w *Watcher) update(filename string, info os.FileInfo) {
+	identifier := w.identifier(filename)
+
+	w.mu.RLock()
+	known, ok := w.files[identifier]
+	w.mu.RUnlock()
+
+	if ok && known.ModTime.Equal(info.ModTime()) && known.Size == info.Size() {
+		return
+	}
+
+	file := watchedFile{ModTime: info.ModTime(), Size: info.Size()}
+	if ok {
+		hash, err := fileHash(filename)
+		if err != nil {
+			log.Printf("Cannot hash %#v: %s", filename, err)
+		}
+		file.Hash = hash
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.files[identifier] = file
+	if ok && (known.Hash == "" || known.Hash != file.Hash) {
+		w.generations[identifier]++
+	}
+	w.notify()
+}
+
+// ignored tells whether the file, or directory, is left out: the hidden ones
+// and the derivatives.
+func (w *Watcher) ignored(filename string, info os.FileInfo) bool {
+	if filename == w.config.Images {
+		return false
+	}
+	if strings.HasPrefix(info.Name(), ".") {
+		return true
+	}
+	return w.config.Derivatives.Path != "" && isWithin(filename, w.config.Derivatives.Path)
+}
+
+func (w *Watcher) identifier(filename string) string {
+	rel, err := filepath.Rel(w.config.Images, filename)
+	if err != nil {
+		return filename
+	}
+	return filepath.ToSlash(rel)
+}
@@ -0,0 +1,112 @@
+package iiif
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"unsafe"
+)
+
+// inotifyMask are the events telling that a file was written, moved or
+// removed.
+const inotifyMask = syscall.IN_CLOSE_WRITE | syscall.IN_CREATE | syscall.IN_DELETE | syscall.IN_MOVED_FROM | syscall.IN_MOVED_TO | syscall.IN_DELETE_SELF
+
+// watchEvents gives the files changed within the root, using inotify. Every
+// directory is watched, the new ones as they're created.
+func watchEvents(root string, ignored func(string, os.FileInfo) bool, stop <-chan struct{}) (<-chan string, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return nil, os.NewSyscallError("inotify_init1", err)
+	}
+	// A non-blocking file uses the poller, Close then stops the pending Read.
+	f := os.NewFile(uintptr(fd), "inotify")
+
+	directories := make(map[int32]string)
+	add := func(dir string) error {
+		return filepath.Walk(dir, func(filename string, info os.FileInfo, err error) error {
+			if err != nil || !info.IsDir() {
+				return err
+			}
+			if ignored(filename, info) {
+				return filepath.SkipDir
+			}
+			wd, err := syscall.InotifyAddWatch(fd, filename, inotifyMask)
+			if err != nil {
+				return os.NewSyscallError("inotify_add_watch", err)
+			}
+			directories[int32(wd)] = filename
+			return nil
+		})
+	}
+	if err = add(root); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	events := make(chan string)
+	go func() {
+		<-stop
+		f.Close()
+	}()
+	go func() {
+		defer close(events)
+
+		buffer := make([]byte, 64*(syscall.SizeofInotifyEvent+syscall.NAME_MAX+1))
+		for {
+			n, err := f.Read(buffer)
+			if err != nil {
+				return
+			}
+
+			for offset := 0; offset+syscall.SizeofInotifyEvent <= n; {
+				event := (*syscall.InotifyEvent)(unsafe.Pointer(&buffer[offset]))
+				name := buffer[offset+syscall.SizeofInotifyEvent : offset+syscall.SizeofInotifyEvent+int(event.Len)]
+				offset += syscall.SizeofInotifyEvent + int(event.Len)
+
+				dir, ok := directories[event.Wd]
+				if !ok {
+					continue
+				}
+				if event.Mask&(syscall.IN_DELETE_SELF|syscall.IN_IGNORED) != 0 {
+					delete(directories, event.Wd)
+					continue
+				}
+
+				filename := filepath.Join(dir, string(trimNull(name)))
+				if event.Mask&syscall.IN_ISDIR != 0 {
+					// The files of a directory moved in aren't announced.
+					if event.Mask&(syscall.IN_CREATE|syscall.IN_MOVED_TO) != 0 {
+						add(filename)
+						filepath.Walk(filename, func(p string, info os.FileInfo, err error) error {
+							if err == nil && !info.IsDir() {
+								select {
+								case events <- p:
+								case <-stop:
+									return filepath.SkipDir
+								}
+							}
+							return nil
+						})
+					}
+					continue
+				}
+
+				select {
+				case events <- filename:
+				case <-stop:
+					return
+				}
+			}
+		}
+	}()
+	return events, nil
+}
+
+func trimNull(name []byte) []byte {
+	for i, b := range name {
+		if b == 0 {
+			return name[:i]
+		}
+	}
+	return name
+}
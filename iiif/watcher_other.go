@@ -0,0 +1,15 @@
+//go:build !linux
+// +build !linux
+
+package iiif
+
+import (
+	"errors"
+	"os"
+)
+
+// watchEvents isn't available without inotify, the images directory being
+// scanned only.
+func watchEvents(root string, ignored func(string, os.FileInfo) bool, stop <-chan struct{}) (<-chan string, error) {
+	return nil, errors.New("inotify is not available")
+}
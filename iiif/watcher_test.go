@@ -0,0 +1,74 @@
+package iiif
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestWatcher(t *testing.T) {
+	dir, err := ioutil.TempDir("", "iiif-watcher")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	filename := filepath.Join(dir, "books", "page1.jpg")
+	if err = os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
+		log.Fatal(err)
+	}
+	write := func(content string, modTime time.Time) {
+		if err := ioutil.WriteFile(filename, []byte(content), 0644); err != nil {
+			log.Fatal(err)
+		}
+		if err := os.Chtimes(filename, modTime, modTime); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	now := time.Now()
+	write("first", now.Add(-time.Hour))
+
+	config := &Config{Images: dir}
+	w := NewWatcher(config)
+	config.Watcher = w
+
+	var tests = []struct {
+		change     func()
+		generation int64
+	}{
+		{func() {}, 0},
+		{func() { write("second", now.Add(-time.Minute)) }, 1},
+		{func() { write("second", now) }, 1},
+		{func() { write("third", now) }, 2},
+		{func() { os.Remove(filename) }, 3},
+	}
+
+	changes := w.Changes()
+	for i, test := range tests {
+		test.change()
+		if err = w.Scan(); err != nil {
+			log.Fatal(err)
+		}
+		select {
+		case <-changes:
+		default:
+			t.Errorf("%d: the change wasn't notified", i)
+		}
+		if g := w.Generation("books%2Fpage1.jpg"); g != test.generation {
+			t.Errorf("%d: expected generation %d, got %d", i, test.generation, g)
+		}
+	}
+
+	if err = w.Scan(); err != nil {
+		log.Fatal(err)
+	}
+	select {
+	case <-changes:
+		t.Error("nothing changed, yet it was notified")
+	default:
+	}
+}
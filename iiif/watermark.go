@@ -0,0 +1,233 @@
+package iiif
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/png"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+
+	"gopkg.in/h2non/bimg.v1"
+)
+
+// the default watermark settings, the scale being relative to the width of
+// the output.
+const (
+	defaultWatermarkScale   = 0.2
+	defaultWatermarkOpacity = 0.5
+	defaultWatermarkFont    = "sans 10"
+)
+
+// watermarkRule gives the index of the watermark rule of the identifier, as
+// a string for the request vars, or an empty string when there is none or the
+// user is exempted.
+func watermarkRule(r *http.Request, identifier string, config *Config) string {
+	if watermarkExempt(r, config) {
+		return ""
+	}
+	return matchWatermark(identifier, config)
+}
+
+// matchWatermark gives the index of the first watermark rule matching the
+// identifier, whoever asks for it, or an empty string.
+func matchWatermark(identifier string, config *Config) string {
+	if unescaped, err := url.QueryUnescape(identifier); err == nil {
+		identifier = unescaped
+	}
+	identifier = strings.Replace(identifier, "../", "", -1)
+
+	for i, rule := range config.Watermark.Rules {
+		if ok, _ := path.Match(rule.Pattern, identifier); ok || rule.Pattern == "" {
+			return strconv.Itoa(i)
+		}
+	}
+	return ""
+}
+
+// watermarkExempt tells whether the request has the exempt header.
+func watermarkExempt(r *http.Request, config *Config) bool {
+	header := config.Watermark.ExemptHeader
+	return header != "" && r.Header.Get(header) != ""
+}
+
+// watermarkHeaders keeps the shared caches from serving the clean image to
+// everyone: the responses of the watermarked identifiers vary on the exempt
+// header, and the exempted ones are private.
+func watermarkHeaders(w http.ResponseWriter, r *http.Request, identifier string, config *Config) {
+	header := config.Watermark.ExemptHeader
+	if header == "" || matchWatermark(identifier, config) == "" {
+		return
+	}
+	w.Header().Add("Vary", header)
+	if watermarkExempt(r, config) {
+		w.Header().Set("Cache-Control", fmt.Sprintf("max-age=%v, private", config.Cache.HTTP))
+	}
+}
+
+// handleWatermark composites the watermark of the rule onto the image, when
+// it's rendered large enough. The rendered size is the one of the full image
+// at the scale of the output, so that the tiles of a large image are
+// watermarked as well. The options are the ones of the encoding.
+func handleWatermark(img *bimg.Image, watermark string, rendered bimg.ImageSize, config *Config, options bimg.Options) error {
+	if watermark == "" {
+		return nil
+	}
+	i, err := strconv.Atoi(watermark)
+	if err != nil || i < 0 || i >= len(config.Watermark.Rules) {
+		return nil
+	}
+	rule := config.Watermark.Rules[i]
+
+	if rendered.Width < rule.MinSize && rendered.Height < rule.MinSize {
+		return nil
+	}
+	size, err := img.Size()
+	if err != nil {
+		return err
+	}
+
+	scale := rule.Scale
+	if scale <= 0 {
+		scale = defaultWatermarkScale
+	}
+	opacity := rule.Opacity
+	if opacity <= 0 {
+		opacity = defaultWatermarkOpacity
+	}
+
+	if rule.Text != "" {
+		font := rule.Font
+		if font == "" {
+			font = defaultWatermarkFont
+		}
+		// The text grows with the output, 300 dpi for a scale of 1 on
+		// 1000 pixels.
+		options.Watermark = bimg.Watermark{
+			Text:        rule.Text,
+			Font:        font,
+			Width:       int(scale * float64(size.Width)),
+			DPI:         int(math.Max(36, 300*scale*float64(size.Width)/1000)),
+			Margin:      rule.Margin,
+			Opacity:     opacity,
+			NoReplicate: !rule.Tile,
+			Background:  bimg.Color{R: 255, G: 255, B: 255},
+		}
+	} else {
+		overlay, left, top, err := watermarkOverlay(rule, size.Width, size.Height, scale)
+		if err != nil {
+			return err
+		}
+		options.WatermarkImage = bimg.WatermarkImage{
+			Left:    left,
+			Top:     top,
+			Buf:     overlay,
+			Opacity: opacity,
+		}
+	}
+
+	_, err = img.Process(options)
+	return err
+}
+
+// renderedSize gives the size of the full image at the scale of the output,
+// from the options made by handleSizeAndRegion for the image of that size.
+func renderedSize(options bimg.Options, size bimg.ImageSize) bimg.ImageSize {
+	width, height := options.Width, options.Height
+	if size.Width == 0 || size.Height == 0 {
+		return bimg.ImageSize{Width: width, Height: height}
+	}
+
+	// The square and smart regions are covered by the scaled image.
+	if options.Crop {
+		scale := math.Max(float64(width)/float64(size.Width), float64(height)/float64(size.Height))
+		return bimg.ImageSize{
+			Width:  int(scale * float64(size.Width)),
+			Height: int(scale * float64(size.Height)),
+		}
+	}
+
+	if width == 0 {
+		width = height * size.Width / size.Height
+	} else if height == 0 {
+		height = width * size.Height / size.Width
+	}
+	return bimg.ImageSize{Width: width, Height: height}
+}
+
+// watermarkOverlay scales the logo of the rule to the output, and gives it
+// with its position. A tiled logo is repeated over an overlay of the size of
+// the output.
+func watermarkOverlay(rule WatermarkRule, width, height int, scale float64) ([]byte, int, int, error) {
+	buffer, err := ioutil.ReadFile(rule.Image)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+
+	logo, err := bimg.NewImage(buffer).Process(bimg.Options{
+		Width:   int(math.Max(1, scale*float64(width))),
+		Type:    bimg.PNG,
+		Enlarge: true,
+	})
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	logoSize, err := bimg.Size(logo)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+
+	if !rule.Tile {
+		left, top := watermarkPosition(rule.Position, width, height, logoSize.Width, logoSize.Height, rule.Margin)
+		return logo, left, top, nil
+	}
+
+	src, err := png.Decode(bytes.NewReader(logo))
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	canvas := image.NewNRGBA(image.Rect(0, 0, width, height))
+	stepX, stepY := logoSize.Width+rule.Margin, logoSize.Height+rule.Margin
+	for y := rule.Margin; y < height; y += stepY {
+		for x := rule.Margin; x < width; x += stepX {
+			r := image.Rect(x, y, x+logoSize.Width, y+logoSize.Height)
+			draw.Draw(canvas, r, src, src.Bounds().Min, draw.Over)
+		}
+	}
+
+	var output bytes.Buffer
+	if err = png.Encode(&output, canvas); err != nil {
+		return nil, 0, 0, err
+	}
+	return output.Bytes(), 0, 0, nil
+}
+
+// watermarkPosition places the logo, e.g. top-left or center, at the margin
+// of the edges. It's in the bottom-right corner by default.
+func watermarkPosition(position string, width, height, w, h, margin int) (int, int) {
+	if position == "" {
+		position = "bottom-right"
+	}
+
+	left := (width - w) / 2
+	top := (height - h) / 2
+
+	if strings.Contains(position, "left") {
+		left = margin
+	} else if strings.Contains(position, "right") {
+		left = width - w - margin
+	}
+	if strings.HasPrefix(position, "top") {
+		top = margin
+	} else if strings.HasPrefix(position, "bottom") {
+		top = height - h - margin
+	}
+
+	return maxInt(0, left), maxInt(0, top)
+}
@@ -0,0 +1,156 @@
+package iiif
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+	"testing"
+
+	"gopkg.in/h2non/bimg.v1"
+)
+
+func TestWatermarkRule(t *testing.T) {
+	config := &Config{
+		Watermark: WatermarkConfig{
+			ExemptHeader: "X-Remote-User",
+			Rules: []WatermarkRule{
+				{Pattern: "images/*"},
+				{Pattern: "*.tif"},
+			},
+		},
+	}
+
+	var tests = []struct {
+		identifier string
+		user       string
+		rule       string
+	}{
+		{"images/test.png", "", "0"},
+		{"images%2Ftest.png", "", "0"},
+		{"pyramid.tif", "", "1"},
+		{"lena.jpg", "", ""},
+		{"images/test.png", "jdoe", ""},
+	}
+
+	for _, test := range tests {
+		r, err := http.NewRequest("GET", "/", nil)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if test.user != "" {
+			r.Header.Set("X-Remote-User", test.user)
+		}
+		if rule := watermarkRule(r, test.identifier, config); rule != test.rule {
+			t.Errorf("%s (%s): got %#v want %#v", test.identifier, test.user, rule, test.rule)
+		}
+	}
+}
+
+func TestWatermarkPosition(t *testing.T) {
+	var tests = []struct {
+		position  string
+		left, top int
+	}{
+		{"", 890, 390},
+		{"top-left", 10, 10},
+		{"top", 450, 10},
+		{"center", 450, 200},
+		{"left", 10, 200},
+		{"bottom-right", 890, 390},
+	}
+
+	for _, test := range tests {
+		left, top := watermarkPosition(test.position, 1000, 500, 100, 100, 10)
+		if left != test.left || top != test.top {
+			t.Errorf("%#v: got %d,%d want %d,%d", test.position, left, top, test.left, test.top)
+		}
+	}
+}
+
+func TestRenderedSize(t *testing.T) {
+	size := bimg.ImageSize{Width: 2000, Height: 1000}
+
+	var tests = []struct {
+		options       bimg.Options
+		width, height int
+	}{
+		{bimg.Options{Width: 500, Height: 250}, 500, 250},
+		{bimg.Options{Width: 500}, 500, 250},
+		{bimg.Options{Height: 100}, 200, 100},
+		// a tile of the full resolution
+		{bimg.Options{Width: 2000, Height: 1000, AreaWidth: 256, AreaHeight: 256}, 2000, 1000},
+		// a square thumbnail
+		{bimg.Options{Width: 100, Height: 100, Crop: true}, 200, 100},
+	}
+
+	for _, test := range tests {
+		rendered := renderedSize(test.options, size)
+		if rendered.Width != test.width || rendered.Height != test.height {
+			t.Errorf("%#v: got %v want %dx%d", test.options, rendered, test.width, test.height)
+		}
+	}
+}
+
+func TestWatermark(t *testing.T) {
+	ts := newServerWithConfig(&Config{
+		Watermark: WatermarkConfig{
+			ExemptHeader: "X-Remote-User",
+			Rules: []WatermarkRule{
+				{Pattern: "lena.jpg", Image: "../fixtures/images/test.png", Tile: true, MinSize: 500},
+			},
+		},
+	})
+	defer ts.Close()
+
+	get := func(path, user string) (*http.Response, []byte) {
+		req, err := http.NewRequest("GET", ts.URL+path, nil)
+		if err != nil {
+			log.Fatal(err)
+		}
+		req.Header.Set("X-Remote-User", user)
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("%s %#v: got %v", path, user, resp.StatusCode)
+		}
+		return resp, body
+	}
+
+	var tests = []struct {
+		path        string
+		watermarked bool
+	}{
+		{"/lena.jpg/full/max/0/default.jpg", true},
+		// a tile smaller than the minimum size, of the full resolution
+		{"/lena.jpg/0,0,256,256/256,/0/default.jpg", true},
+		{"/lena.jpg/full/100,/0/default.jpg", false},
+	}
+
+	for _, test := range tests {
+		anonymous, watermarked := get(test.path, "")
+		exempted, clean := get(test.path, "jdoe")
+
+		if bytes.Equal(watermarked, clean) == test.watermarked {
+			t.Errorf("%s: watermarked %v, got the same bytes %v", test.path, test.watermarked, bytes.Equal(watermarked, clean))
+		}
+		if vary := anonymous.Header.Get("Vary"); !strings.Contains(vary, "X-Remote-User") {
+			t.Errorf("%s: got Vary %#v", test.path, vary)
+		}
+		if cc := exempted.Header.Get("Cache-Control"); !strings.Contains(cc, "private") {
+			t.Errorf("%s: got Cache-Control %#v for the exempted user", test.path, cc)
+		}
+		if cc := anonymous.Header.Get("Cache-Control"); !strings.Contains(cc, "public") {
+			t.Errorf("%s: got Cache-Control %#v", test.path, cc)
+		}
+	}
+}
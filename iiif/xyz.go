@@ -0,0 +1,208 @@
+package iiif
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/golang/groupcache"
+	"github.com/gorilla/mux"
+	"gopkg.in/h2non/bimg.v1"
+)
+
+// error messages
+var xyzTileError = "The tile %v/%v/%v doesn't exist"
+
+// TileJSON describes the slippy map tiles of the image, see
+// https://github.com/mapbox/tilejson-spec
+type TileJSON struct {
+	TileJSON    string   `json:"tilejson"`
+	Name        string   `json:"name"`
+	Attribution string   `json:"attribution,omitempty"`
+	Scheme      string   `json:"scheme"`
+	Tiles       []string `json:"tiles"`
+	MinZoom     int      `json:"minzoom"`
+	MaxZoom     int      `json:"maxzoom"`
+	TileSize    int      `json:"tileSize"`
+}
+
+// TileJSONHandler responds with the TileJSON of the image.
+func TileJSONHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	identifier, err := url.QueryUnescape(vars["identifier"])
+	if err != nil {
+		log.Printf("Filename is frob %#v", identifier)
+		serveError(w, r, HTTPError{http.StatusNotFound, identifier})
+		return
+	}
+
+	ctx := r.Context()
+	config, _ := ctx.Value(ContextKey("config")).(*Config)
+	images, _ := ctx.Value(ContextKey("images")).(*groupcache.Group)
+
+	identifier = strings.Replace(identifier, "../", "", -1)
+
+	etag, done := sourceETag(w, r, url.QueryEscape(identifier), config, images)
+	if done {
+		return
+	}
+
+	id := fmt.Sprintf("%s/%s", baseURL(r), identifier)
+	image, modTime, err := newImage(identifier, id, config, images)
+	if err != nil {
+		serveError(w, r, err)
+		return
+	}
+
+	tileSize, scheme := xyzSettings(config)
+	p := TileJSON{
+		TileJSON:    "2.2.0",
+		Name:        identifier,
+		Attribution: image.Attribution,
+		Scheme:      scheme,
+		Tiles:       []string{id + "/tiles/{z}/{x}/{y}.png"},
+		MinZoom:     0,
+		MaxZoom:     xyzMaxZoom(image.Width, image.Height, tileSize),
+		TileSize:    tileSize,
+	}
+
+	buffer, err := json.MarshalIndent(p, "", "  ")
+	if err != nil {
+		serveError(w, r, HTTPError{http.StatusInternalServerError, "Cannot create TileJSON"})
+		return
+	}
+
+	header := w.Header()
+	header.Set("Content-Type", "application/json")
+	header.Set("Access-Control-Allow-Origin", "*")
+	header.Set("ETag", etag)
+	header.Set("Cache-Control", fmt.Sprintf("max-age=%v, public", config.Cache.HTTP))
+	http.ServeContent(w, r, "tiles.json", *modTime, bytes.NewReader(buffer))
+}
+
+// XYZTileHandler responds with a slippy map tile of the image.
+func XYZTileHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	identifier, err := url.QueryUnescape(vars["identifier"])
+	if err != nil {
+		log.Printf("Filename is frob %#v", identifier)
+		serveError(w, r, HTTPError{http.StatusNotFound, identifier})
+		return
+	}
+
+	ctx := r.Context()
+	config, _ := ctx.Value(ContextKey("config")).(*Config)
+	images, _ := ctx.Value(ContextKey("images")).(*groupcache.Group)
+
+	identifier = strings.Replace(identifier, "../", "", -1)
+
+	size, _, err := loadImageSize(identifier, config, images)
+	if err != nil {
+		serveError(w, r, err)
+		return
+	}
+
+	z, _ := strconv.Atoi(vars["z"])
+	x, _ := strconv.Atoi(vars["x"])
+	y, _ := strconv.Atoi(vars["y"])
+
+	tileSize, scheme := xyzSettings(config)
+	region, tile, edge, ok := xyzTile(size.Width, size.Height, tileSize, scheme == "tms", z, x, y)
+	if !ok {
+		message := fmt.Sprintf(xyzTileError, z, x, y)
+		serveError(w, r, HTTPError{http.StatusNotFound, message})
+		return
+	}
+
+	// The maps draw every tile at the same size, the edge ones are padded.
+	pad := 0
+	if edge {
+		pad = tileSize
+	}
+	serveTile(w, r, identifier, region, tile, vars["format"], pad)
+}
+
+// xyzMaxZoom gives the zoom level of the full image, at the zoom level 0 the
+// image fits in a single tile.
+func xyzMaxZoom(width, height, tileSize int) int {
+	ratio := math.Max(float64(width), float64(height)) / float64(tileSize)
+	if ratio <= 1 {
+		return 0
+	}
+	return int(math.Ceil(math.Log2(ratio)))
+}
+
+// xyzTile gives the IIIF region and size of the tile. The rows are counted
+// from the bottom with the TMS scheme. The tiles of the last row and column
+// are cropped to the image, they are told apart as they need to be padded.
+func xyzTile(width, height, tileSize int, tms bool, z, x, y int) (string, string, bool, bool) {
+	maxZoom := xyzMaxZoom(width, height, tileSize)
+	if z < 0 || z > maxZoom {
+		return "", "", false, false
+	}
+
+	sf := 1 << uint(maxZoom-z)
+	w, h := scaled(width, sf), scaled(height, sf)
+
+	if tms {
+		y = scaled(h, tileSize) - 1 - y
+	}
+
+	left, tw, ok := dziSpan(w, tileSize, 0, x)
+	if !ok {
+		return "", "", false, false
+	}
+	top, th, ok := dziSpan(h, tileSize, 0, y)
+	if !ok {
+		return "", "", false, false
+	}
+
+	region, size := tileRegion(width, height, w, h, sf, left, top, tw, th)
+	return region, size, tw < tileSize || th < tileSize, true
+}
+
+// handlePadding enlarges the image to the size of the padding, if any, the
+// image being left at the top left corner. The alpha channel makes the
+// added area transparent.
+func handlePadding(image *bimg.Image, pad string, alpha bool) (*bimg.Image, error) {
+	if pad == "" {
+		return image, nil
+	}
+	n, err := strconv.Atoi(pad)
+	if err != nil || n <= 0 {
+		return image, nil
+	}
+
+	size, err := image.Size()
+	if err != nil {
+		message := fmt.Sprintf(openError, err.Error())
+		return nil, HTTPError{http.StatusInternalServerError, message}
+	}
+	if size.Width >= n && size.Height >= n {
+		return image, nil
+	}
+
+	buffer, err := vipsPad(image.Image(), maxInt(n, size.Width), maxInt(n, size.Height), alpha)
+	if err != nil {
+		return nil, err
+	}
+	return bimg.NewImage(buffer), nil
+}
+
+func xyzSettings(config *Config) (int, string) {
+	tileSize := config.Tiles.TileSize
+	if tileSize == 0 {
+		tileSize = defaultTileSize
+	}
+	scheme := strings.ToLower(config.Tiles.Scheme)
+	if scheme != "tms" {
+		scheme = "xyz"
+	}
+	return tileSize, scheme
+}
@@ -0,0 +1,116 @@
+package iiif
+
+import (
+	"encoding/json"
+	"image/png"
+	"log"
+	"net/http"
+	"testing"
+)
+
+func TestXYZMaxZoom(t *testing.T) {
+	var tests = []struct {
+		width   int
+		height  int
+		maxZoom int
+	}{
+		{1084, 2318, 4},
+		{200, 100, 0},
+		{512, 256, 1},
+		{513, 256, 2},
+	}
+
+	for _, test := range tests {
+		if z := xyzMaxZoom(test.width, test.height, 256); z != test.maxZoom {
+			t.Errorf("%vx%v: got %v want %v", test.width, test.height, z, test.maxZoom)
+		}
+	}
+}
+
+func TestXYZTile(t *testing.T) {
+	var tests = []struct {
+		tms    bool
+		z      int
+		x      int
+		y      int
+		region string
+		size   string
+		edge   bool
+		ok     bool
+	}{
+		{false, 0, 0, 0, "full", "68,", true, true},
+		{false, 4, 0, 0, "0,0,256,256", "256,", false, true},
+		{true, 4, 0, 9, "0,0,256,256", "256,", false, true},
+		{false, 3, 1, 0, "512,0,512,512", "256,", false, true},
+		{false, 4, 4, 0, "1024,0,60,256", "60,", true, true},
+		{false, 5, 0, 0, "", "", false, false},
+		{false, 4, 5, 0, "", "", false, false},
+		{true, 4, 0, 10, "", "", false, false},
+	}
+
+	for _, test := range tests {
+		region, size, edge, ok := xyzTile(1084, 2318, 256, test.tms, test.z, test.x, test.y)
+		if region != test.region || size != test.size || edge != test.edge || ok != test.ok {
+			t.Errorf("%v/%v/%v: got %#v %#v %v %v want %#v %#v %v %v", test.z, test.x, test.y, region, size, edge, ok, test.region, test.size, test.edge, test.ok)
+		}
+	}
+}
+
+func TestTileJSON(t *testing.T) {
+	ts := newServer()
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL + "/lena.jpg/tiles.json")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	var p TileJSON
+	if err = json.NewDecoder(resp.Body).Decode(&p); err != nil {
+		log.Fatal(err)
+	}
+
+	if p.MaxZoom != 4 || p.Scheme != "xyz" || len(p.Tiles) != 1 || p.Tiles[0] != ts.URL+"/lena.jpg/tiles/{z}/{x}/{y}.png" {
+		t.Errorf("unexpected TileJSON %#v", p)
+	}
+
+	resp, err = http.Get(ts.URL + "/lena.jpg/tiles/4/0/0.png")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "image/png" {
+		t.Errorf("unexpected tile %v %v", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+}
+
+func TestXYZEdgeTile(t *testing.T) {
+	ts := newServer()
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL + "/lena.jpg/tiles/4/4/0.png")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("unexpected status %v", resp.StatusCode)
+	}
+	img, err := png.Decode(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if b := img.Bounds(); b.Dx() != 256 || b.Dy() != 256 {
+		t.Errorf("the edge tile was expected to be padded, got %vx%v", b.Dx(), b.Dy())
+	}
+	if _, _, _, a := img.At(0, 0).RGBA(); a == 0 {
+		t.Errorf("the image was expected at the top left corner")
+	}
+	if _, _, _, a := img.At(255, 0).RGBA(); a != 0 {
+		t.Errorf("the padding was expected to be transparent, got %v", a)
+	}
+}